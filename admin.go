@@ -0,0 +1,64 @@
+// --- admin.go --- (Admin listener: readiness checks, stats and the dashboard)
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+//go:embed web/dashboard.html
+var dashboardHTML []byte
+
+// StartDraining marks the proxy as shutting down so readiness checks fail
+// and load balancers stop sending new connections.
+func (p *SimpleProxy) StartDraining() {
+	p.draining.Store(true)
+}
+
+// InFlight returns the number of requests being handled and how many of
+// them are still waiting in a queue.
+func (p *SimpleProxy) InFlight() (inFlight, queued int64) {
+	return p.inFlight.Load(), p.queued.Load()
+}
+
+// newAdminHandler serves the admin endpoints:
+//
+//	/health  always 200 while the process is up
+//	/ready   200, or 503 once the proxy is draining
+//	/queries per-fingerprint stats as JSON (?sort=time|count|p99|errors|bytes&limit=50)
+//	/status  replicas, busy groups, rejections and recent errors as JSON
+//	/        read-only dashboard of /status, refreshed live
+func newAdminHandler(p *SimpleProxy) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", func(rw http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(rw, "ok")
+	})
+	mux.HandleFunc("/ready", func(rw http.ResponseWriter, r *http.Request) {
+		if p.draining.Load() {
+			http.Error(rw, "draining", http.StatusServiceUnavailable)
+			return
+		}
+		inFlight, queued := p.InFlight()
+		fmt.Fprintf(rw, "ok (in flight: %d, queued: %d)\n", inFlight, queued)
+	})
+	mux.HandleFunc("/queries", func(rw http.ResponseWriter, r *http.Request) {
+		if p.queryStats == nil {
+			http.Error(rw, "query_stats is not enabled", http.StatusNotFound)
+			return
+		}
+		order, limit := queryStatsParams(r)
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(p.queryStats.Report(order, limit))
+	})
+	mux.HandleFunc("/status", func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(p.Status())
+	})
+	mux.HandleFunc("/{$}", func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+		rw.Write(dashboardHTML)
+	})
+	return mux
+}
@@ -0,0 +1,403 @@
+// --- audit.go --- (Audit log of every request, written in the background)
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"clickhouse-test/config"
+)
+
+const (
+	defaultAuditMaxSize       = 100 << 20
+	defaultAuditMaxBackups    = 5
+	defaultAuditBuffer        = 10000
+	defaultAuditBatchSize     = 1000
+	defaultAuditFlushInterval = 5 * time.Second
+	auditInsertTimeout        = 30 * time.Second
+)
+
+// AuditRecord is one line of the audit log. With output "clickhouse" the
+// fields are inserted as JSONEachRow, so the table columns use these names:
+//
+//	CREATE TABLE audit.proxy_queries (
+//	    time DateTime64(3), user String, group String, client_ip String,
+//	    kind LowCardinality(String), query_id String, query String,
+//	    truncated Bool, node String, status UInt16, exception_code UInt32, rows_read UInt64,
+//	    duration_ms Float64, rejected LowCardinality(String), shared LowCardinality(String)
+//	) ENGINE = MergeTree ORDER BY time
+type AuditRecord struct {
+	Time          time.Time `json:"time"`
+	User          string    `json:"user"`
+	Group         string    `json:"group"`
+	ClientIP      string    `json:"client_ip"`
+	Kind          string    `json:"kind"`
+	QueryID       string    `json:"query_id"`
+	Query         string    `json:"query"`
+	Truncated     bool      `json:"truncated"` // Query is only the first 64 KB of the statement
+	Node          string    `json:"node"`
+	Status        int       `json:"status"`
+	ExceptionCode int       `json:"exception_code"` // From X-ClickHouse-Exception-Code or the body, 0 if none
+	RowsRead      uint64    `json:"rows_read"`      // From X-ClickHouse-Summary
+	DurationMs    float64   `json:"duration_ms"`
+	Rejected      string    `json:"rejected"` // Why the proxy answered itself, if it did
+	Shared        string    `json:"shared"`   // "cache" or "coalesced" if ClickHouse did not run it for this request
+}
+
+// auditSink writes batches of records somewhere durable.
+type auditSink interface {
+	Write(batch []AuditRecord) error
+	Close() error
+}
+
+// Auditor collects records from requests and writes them in batches from a
+// single goroutine. The queue is bounded: when the sink is slow or failing,
+// records are dropped (and counted) instead of holding up requests.
+type Auditor struct {
+	sink          auditSink
+	records       chan AuditRecord
+	batchSize     int
+	flushInterval time.Duration
+	redact        bool
+	dropped       atomic.Int64
+
+	stopOnce sync.Once
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+func NewAuditor(cfg config.AuditConfig, p *SimpleProxy) (*Auditor, error) {
+	var sink auditSink
+	switch cfg.Output {
+	case "", "file":
+		if cfg.File == "" {
+			return nil, errors.New("audit output \"file\" needs audit.file")
+		}
+		fileSink, err := newFileAuditSink(cfg.File, cfg.MaxSize, cfg.MaxBackups)
+		if err != nil {
+			return nil, err
+		}
+		sink = fileSink
+	case "clickhouse":
+		if cfg.Table == "" {
+			return nil, errors.New("audit output \"clickhouse\" needs audit.table")
+		}
+		sink = &clickhouseAuditSink{proxy: p, table: cfg.Table, backendUser: cfg.BackendUser}
+	default:
+		return nil, fmt.Errorf("unknown audit output %q", cfg.Output)
+	}
+
+	buffer := cfg.Buffer
+	if buffer <= 0 {
+		buffer = defaultAuditBuffer
+	}
+	batchSize := cfg.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultAuditBatchSize
+	}
+	flushInterval := cfg.FlushInterval
+	if flushInterval <= 0 {
+		flushInterval = defaultAuditFlushInterval
+	}
+	a := &Auditor{
+		sink:          sink,
+		records:       make(chan AuditRecord, buffer),
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+		redact:        cfg.Redact,
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+	go a.run()
+	return a, nil
+}
+
+// Record queues the audit record for a finished request. It never blocks.
+func (a *Auditor) Record(l *accessLog) {
+	rec := AuditRecord{
+		Time:       l.start,
+		User:       l.user,
+		Group:      l.groupKey,
+		ClientIP:   l.r.RemoteAddr,
+		Kind:       l.kind.String(),
+		QueryID:    l.queryID(),
+		Query:      auditQuery(l.query, l.kind),
+		Node:       l.node,
+		Status:     l.statusCode(),
+		DurationMs: float64(time.Since(l.start).Microseconds()) / 1000,
+		Rejected:   l.rejected,
+		Shared:     l.shared,
+	}
+	if host, _, err := net.SplitHostPort(l.r.RemoteAddr); err == nil {
+		rec.ClientIP = host
+	}
+	header := l.rw.Header()
+	rec.ExceptionCode, _ = l.clickhouseException()
+	rec.RowsRead, _ = parseSummary(header.Get("X-ClickHouse-Summary"))
+	// The classifier only keeps a prefix. An INSERT cut at FORMAT or VALUES
+	// is still complete; anything else is where the prefix ended.
+	rec.Truncated = l.truncated && len(rec.Query) == len(l.query)
+	a.add(rec)
+}
+
+// add queues a record, with literals stripped if configured. It never blocks.
+// Queries are kept to the size the classifier sees for HTTP requests.
+func (a *Auditor) add(rec AuditRecord) {
+	if len(rec.Query) > maxClassifyBytes {
+		rec.Query, rec.Truncated = rec.Query[:maxClassifyBytes], true
+	}
+	if a.redact {
+		rec.Query = stripLiterals(rec.Query)
+	}
+	select {
+	case a.records <- rec:
+	default:
+		a.dropped.Add(1)
+	}
+}
+
+// Close writes the queued records and closes the sink, giving up when ctx
+// expires. Records arriving later are dropped.
+func (a *Auditor) Close(ctx context.Context) error {
+	a.stopOnce.Do(func() { close(a.stop) })
+	select {
+	case <-a.done:
+		return a.sink.Close()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (a *Auditor) run() {
+	defer close(a.done)
+	ticker := time.NewTicker(a.flushInterval)
+	defer ticker.Stop()
+	batch := make([]AuditRecord, 0, a.batchSize)
+	flush := func() {
+		if dropped := a.dropped.Swap(0); dropped > 0 {
+			slog.Warn("Audit records dropped, the audit output is falling behind", "dropped", dropped)
+		}
+		if len(batch) == 0 {
+			return
+		}
+		if err := a.sink.Write(batch); err != nil {
+			slog.Warn("Failed to write audit records", "records", len(batch), "err", err)
+		}
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case rec := <-a.records:
+			batch = append(batch, rec)
+			if len(batch) >= a.batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-a.stop:
+			// Write what is already queued, then stop
+			for {
+				select {
+				case rec := <-a.records:
+					batch = append(batch, rec)
+					if len(batch) >= a.batchSize {
+						flush()
+					}
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// auditQuery returns the query text to record. For INSERTs the classifier
+// also saw the start of the data, which is cut off after FORMAT or VALUES.
+func auditQuery(query string, kind QueryKind) string {
+	if kind != QueryInsert {
+		return query
+	}
+	lexer := sqlLexer{sql: query}
+	for tok, ok := lexer.Next(); ok; tok, ok = lexer.Next() {
+		if tok.kind != tokWord {
+			continue
+		}
+		switch strings.ToUpper(tok.text) {
+		case "FORMAT":
+			lexer.Next() // Format name
+			return query[:lexer.pos]
+		case "VALUES":
+			return query[:lexer.pos]
+		}
+	}
+	return query
+}
+
+// parseSummary returns read_rows and read_bytes from an X-ClickHouse-Summary
+// header, e.g. {"read_rows":"1000","read_bytes":"8000",...}.
+func parseSummary(summary string) (readRows, readBytes uint64) {
+	if summary == "" {
+		return 0, 0
+	}
+	var fields map[string]string
+	if err := json.Unmarshal([]byte(summary), &fields); err != nil {
+		return 0, 0
+	}
+	readRows, _ = strconv.ParseUint(fields["read_rows"], 10, 64)
+	readBytes, _ = strconv.ParseUint(fields["read_bytes"], 10, 64)
+	return readRows, readBytes
+}
+
+func encodeAuditBatch(batch []AuditRecord) []byte {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, rec := range batch {
+		enc.Encode(rec)
+	}
+	return buf.Bytes()
+}
+
+// fileAuditSink appends JSON lines to a file, rotating it to file.1,
+// file.2, ... once it reaches maxSize.
+type fileAuditSink struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+func newFileAuditSink(path string, maxSize int64, maxBackups int) (*fileAuditSink, error) {
+	if maxSize <= 0 {
+		maxSize = defaultAuditMaxSize
+	}
+	if maxBackups <= 0 {
+		maxBackups = defaultAuditMaxBackups
+	}
+	s := &fileAuditSink{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *fileAuditSink) open() error {
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return fmt.Errorf("failed to open audit file: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.file, s.size = f, info.Size()
+	return nil
+}
+
+func (s *fileAuditSink) Write(batch []AuditRecord) error {
+	data := encodeAuditBatch(batch)
+	if s.size > 0 && s.size+int64(len(data)) > s.maxSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := s.file.Write(data)
+	s.size += int64(n)
+	return err
+}
+
+func (s *fileAuditSink) rotate() error {
+	s.file.Close()
+	os.Remove(fmt.Sprintf("%s.%d", s.path, s.maxBackups))
+	for i := s.maxBackups - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", s.path, i), fmt.Sprintf("%s.%d", s.path, i+1))
+	}
+	if err := os.Rename(s.path, s.path+".1"); err != nil {
+		slog.Warn("Failed to rotate audit file", "file", s.path, "err", err)
+	}
+	return s.open()
+}
+
+func (s *fileAuditSink) Close() error {
+	return s.file.Close()
+}
+
+// clickhouseAuditSink inserts batches into a table through the proxy's own
+// replicas, trying each node of a replica in turn. The inserts bypass the
+// group limits, as they are not made on behalf of a client.
+type clickhouseAuditSink struct {
+	proxy       *SimpleProxy
+	table       string
+	backendUser string
+}
+
+func (s *clickhouseAuditSink) Write(batch []AuditRecord) error {
+	p := s.proxy
+	replica := p.selectReplica(p.replicaLabelsFor(QueryInsert))
+	if replica == nil || len(replica.Nodes) == 0 {
+		return errors.New("no replica available")
+	}
+	data := encodeAuditBatch(batch)
+	params := url.Values{}
+	params.Set("query", fmt.Sprintf("INSERT INTO %s FORMAT JSONEachRow", s.table))
+	params.Set("date_time_input_format", "best_effort")
+	params.Set("input_format_skip_unknown_fields", "1")
+
+	var err error
+	for range replica.Nodes {
+		node := replica.NextNode()
+		if err = s.insert(node, params, data); err == nil {
+			return nil
+		}
+		slog.Debug("Audit insert failed", "node", node.Address, "err", err)
+	}
+	return err
+}
+
+func (s *clickhouseAuditSink) insert(node *Node, params url.Values, data []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), auditInsertTimeout)
+	defer cancel()
+	ctx = WithNode(ctx, node)
+	if s.backendUser != "" {
+		ctx = WithIdentity(ctx, &Identity{BackendUser: s.backendUser})
+	}
+	u := *node.URL
+	u.Path = "/"
+	u.RawQuery = params.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	s.proxy.directTo(req, node)
+	resp, err := s.proxy.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+func (s *clickhouseAuditSink) Close() error {
+	return nil
+}
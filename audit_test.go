@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"clickhouse-test/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuditFileRecordsRequests(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-ClickHouse-Query-Id", "q-1")
+		w.Header().Set("X-ClickHouse-Summary", `{"read_rows":"42","read_bytes":"336"}`)
+		w.Write([]byte("1\n"))
+	}))
+	defer backend.Close()
+
+	auditFile := filepath.Join(t.TempDir(), "audit.jsonl")
+	cfg := &config.Config{
+		HeaderName:    "X-User-Id",
+		MaxConcurrent: 2,
+		MaxQueue:      1,
+		QueueTimeout:  time.Second,
+		Replicas:      []config.ReplicaConfig{{Name: "r1"}},
+		Nodes:         []config.NodeConfig{{Replica: "r1", Address: strings.TrimPrefix(backend.URL, "http://")}},
+		Audit:         config.AuditConfig{Enabled: true, File: auditFile, Redact: true},
+	}
+	p, err := NewSimpleProxy(cfg)
+	require.NoError(t, err)
+
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("SELECT * FROM t WHERE name = 'secret' AND id > 10"))
+	r.Header.Set("X-User-Id", "123")
+	p.ServeHTTP(httptest.NewRecorder(), r)
+	r = httptest.NewRequest(http.MethodPost, "/", strings.NewReader("SELECT 1"))
+	p.ServeHTTP(httptest.NewRecorder(), r) // No group header
+	padding := strings.Repeat("1, ", maxClassifyBytes/3)
+	for _, query := range []string{"SELECT x IN (" + padding + "1) FROM t", "INSERT INTO t FORMAT CSV\n" + padding + "1\n"} {
+		r = httptest.NewRequest(http.MethodPost, "/", strings.NewReader(query))
+		r.Header.Set("X-User-Id", "123")
+		p.ServeHTTP(httptest.NewRecorder(), r)
+	}
+	require.NoError(t, p.audit.Close(context.Background()))
+
+	f, err := os.Open(auditFile)
+	require.NoError(t, err)
+	defer f.Close()
+	var records []AuditRecord
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20) // Records of long queries are over 64 KB
+	for scanner.Scan() {
+		var rec AuditRecord
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &rec))
+		records = append(records, rec)
+	}
+	require.Len(t, records, 4)
+
+	require.Equal(t, "123", records[0].Group)
+	require.Equal(t, "192.0.2.1", records[0].ClientIP)
+	require.Equal(t, "SELECT * FROM t WHERE name = ? AND id > ?", records[0].Query)
+	require.Equal(t, "q-1", records[0].QueryID)
+	require.Equal(t, http.StatusOK, records[0].Status)
+	require.EqualValues(t, 42, records[0].RowsRead)
+	require.NotEmpty(t, records[0].Node)
+	require.False(t, records[0].Truncated)
+
+	require.Equal(t, http.StatusBadRequest, records[1].Status)
+	require.Equal(t, rejectMissingGroup, records[1].Rejected)
+
+	// Only the first 64 KB of a statement are recorded, and marked as such
+	require.True(t, records[2].Truncated)
+	require.True(t, strings.HasPrefix(records[2].Query, "SELECT x IN ( ? , ?"))
+	require.False(t, records[3].Truncated, "the INSERT statement is complete, only its data is left out")
+	require.Equal(t, "INSERT INTO t FORMAT CSV", records[3].Query)
+}
+
+func TestAuditFileRotates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	sink, err := newFileAuditSink(path, 100, 2)
+	require.NoError(t, err)
+	rec := AuditRecord{Query: "SELECT 1"}
+	for i := 0; i < 5; i++ {
+		require.NoError(t, sink.Write([]AuditRecord{rec}))
+	}
+	require.NoError(t, sink.Close())
+
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		info, err := os.Stat(name)
+		require.NoError(t, err)
+		require.LessOrEqual(t, info.Size(), int64(300))
+	}
+	_, err = os.Stat(path + ".3")
+	require.True(t, os.IsNotExist(err))
+
+	require.Equal(t, "INSERT INTO t FORMAT TSV", auditQuery("INSERT INTO t FORMAT TSV 1\t'a'\n2\t'b'", QueryInsert))
+	require.Equal(t, "INSERT INTO t VALUES", auditQuery("INSERT INTO t VALUES (1, 'a')", QueryInsert))
+}
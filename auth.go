@@ -0,0 +1,267 @@
+// --- auth.go --- (Client authentication and mapping to ClickHouse users)
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"clickhouse-test/config"
+)
+
+const errCodeAuthenticationFailed = 516
+
+var ErrUnauthenticated = errors.New("authentication failed")
+
+// Identity is an authenticated client.
+type Identity struct {
+	Name        string
+	Group       string // Group key used for limits
+	BackendUser string // Key into the replica credentials
+	Class       string // Settings class name, overrides the group's class if set
+}
+
+type authUser struct {
+	identity *Identity
+	password string
+}
+
+// Authenticator checks client credentials: an API key header, a bearer
+// token from the token file, or a user and password (basic auth, the
+// X-ClickHouse-User/Key headers or the user/password URL parameters).
+type Authenticator struct {
+	apiKeyHeader string
+	users        map[string]*authUser
+	apiKeys      map[string]*Identity
+	tokens       map[string]*Identity
+	jwt          *JWTValidator   // Optional bearer JWT validation
+	backendUsers map[string]bool // Backend users with credentials on every replica
+}
+
+func NewAuthenticator(cfg config.AuthConfig) (*Authenticator, error) {
+	a := &Authenticator{
+		apiKeyHeader: cfg.APIKeyHeader,
+		users:        make(map[string]*authUser),
+		apiKeys:      make(map[string]*Identity),
+		tokens:       make(map[string]*Identity),
+	}
+	for _, userCfg := range cfg.Users {
+		identity := &Identity{
+			Name:        userCfg.Name,
+			Group:       userCfg.Group,
+			BackendUser: userCfg.BackendUser,
+		}
+		if identity.Group == "" {
+			identity.Group = userCfg.Name
+		}
+		if identity.BackendUser == "" {
+			identity.BackendUser = userCfg.Name
+		}
+		a.users[userCfg.Name] = &authUser{identity: identity, password: userCfg.Password}
+		for _, key := range userCfg.APIKeys {
+			a.apiKeys[key] = identity
+		}
+	}
+	if cfg.TokenFile != "" {
+		if err := a.loadTokens(cfg.TokenFile); err != nil {
+			return nil, fmt.Errorf("failed to load token file %s: %w", cfg.TokenFile, err)
+		}
+	}
+	if cfg.JWT.Enabled {
+		jwt, err := NewJWTValidator(cfg.JWT)
+		if err != nil {
+			return nil, err
+		}
+		a.jwt = jwt
+		go jwt.Watch()
+	}
+	return a, nil
+}
+
+// loadTokens reads "<token> <user name>" lines; blank lines and lines
+// starting with # are ignored.
+func (a *Authenticator) loadTokens(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return fmt.Errorf("line %d: expected \"<token> <user name>\"", lineNo)
+		}
+		user, ok := a.users[fields[1]]
+		if !ok {
+			return fmt.Errorf("line %d: unknown user %q", lineNo, fields[1])
+		}
+		a.tokens[fields[0]] = user.identity
+	}
+	return scanner.Err()
+}
+
+// Authenticate returns the identity of the client or ErrUnauthenticated.
+func (a *Authenticator) Authenticate(r *http.Request) (*Identity, error) {
+	if a.apiKeyHeader != "" {
+		if key := r.Header.Get(a.apiKeyHeader); key != "" {
+			return lookupSecret(a.apiKeys, key)
+		}
+	}
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		if a.jwt != nil && strings.Count(token, ".") == 2 {
+			return a.authenticateJWT(token)
+		}
+		return lookupSecret(a.tokens, token)
+	}
+	name, password, ok := clientCredentials(r)
+	if !ok {
+		return nil, ErrUnauthenticated
+	}
+	return a.AuthenticatePassword(name, password)
+}
+
+// AuthenticatePassword checks a user name and password, as sent over HTTP or
+// in the native protocol handshake.
+func (a *Authenticator) AuthenticatePassword(name, password string) (*Identity, error) {
+	user, ok := a.users[name]
+	if !ok || user.password == "" || subtle.ConstantTimeCompare([]byte(user.password), []byte(password)) != 1 {
+		return nil, ErrUnauthenticated
+	}
+	return user.identity, nil
+}
+
+// authenticateJWT validates a bearer JWT and maps its claims to an identity
+// whose backend user the proxy has credentials for.
+func (a *Authenticator) authenticateJWT(token string) (*Identity, error) {
+	claims, err := a.jwt.Validate(token)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnauthenticated, err)
+	}
+	identity, err := a.jwt.Identity(claims)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnauthenticated, err)
+	}
+	if !a.backendUsers[identity.BackendUser] {
+		return nil, fmt.Errorf("%w: no credentials for backend user %q", ErrUnauthenticated, identity.BackendUser)
+	}
+	return identity, nil
+}
+
+// lookupSecret finds the identity for an API key or token, comparing in
+// constant time so the lookup does not leak how much of a key matched.
+func lookupSecret(secrets map[string]*Identity, secret string) (*Identity, error) {
+	var found *Identity
+	for candidate, identity := range secrets {
+		if subtle.ConstantTimeCompare([]byte(candidate), []byte(secret)) == 1 {
+			found = identity
+		}
+	}
+	if found == nil {
+		return nil, ErrUnauthenticated
+	}
+	return found, nil
+}
+
+// clientCredentials extracts a user and password the way ClickHouse accepts them.
+func clientCredentials(r *http.Request) (string, string, bool) {
+	if user, password, ok := r.BasicAuth(); ok {
+		return user, password, true
+	}
+	if user := r.Header.Get("X-ClickHouse-User"); user != "" {
+		return user, r.Header.Get("X-ClickHouse-Key"), true
+	}
+	params := r.URL.Query()
+	if user := params.Get("user"); user != "" {
+		return user, params.Get("password"), true
+	}
+	return "", "", false
+}
+
+// applyCredentials replaces whatever credentials the client sent with the
+// backend credentials of the authenticated identity on the node's replica.
+// Requests without an identity (auth disabled) are left untouched.
+func (p *SimpleProxy) applyCredentials(req *http.Request, node *Node) {
+	identity := GetIdentity(req.Context())
+	if identity == nil {
+		return
+	}
+	req.Header.Del("Authorization")
+	req.Header.Del("X-ClickHouse-User")
+	req.Header.Del("X-ClickHouse-Key")
+	if p.config.Auth.APIKeyHeader != "" {
+		req.Header.Del(p.config.Auth.APIKeyHeader)
+	}
+	params := req.URL.Query()
+	if params.Has("user") || params.Has("password") {
+		params.Del("user")
+		params.Del("password")
+		req.URL.RawQuery = params.Encode()
+	}
+
+	if creds, ok := backendCredentials(p.config, node.Replica, identity.BackendUser); ok {
+		req.Header.Set("X-ClickHouse-User", creds.User)
+		req.Header.Set("X-ClickHouse-Key", creds.Password)
+	}
+}
+
+// backendCredentials looks up the ClickHouse credentials for a backend user,
+// preferring the replica's own over the global backend_credentials.
+func backendCredentials(cfg *config.Config, replica *Replica, backendUser string) (config.Credentials, bool) {
+	if creds, ok := replica.Credentials[backendUser]; ok {
+		return creds, true
+	}
+	creds, ok := cfg.BackendCredentials[backendUser]
+	return creds, ok
+}
+
+// availableBackendUsers returns the backend users that have credentials on
+// every replica.
+func availableBackendUsers(cfg *config.Config, replicas []*Replica) map[string]bool {
+	candidates := make(map[string]bool)
+	for name := range cfg.BackendCredentials {
+		candidates[name] = true
+	}
+	for _, replica := range replicas {
+		for name := range replica.Credentials {
+			candidates[name] = true
+		}
+	}
+	available := make(map[string]bool)
+	for name := range candidates {
+		available[name] = true
+		for _, replica := range replicas {
+			if _, ok := backendCredentials(cfg, replica, name); !ok {
+				available[name] = false
+				break
+			}
+		}
+	}
+	return available
+}
+
+// checkBackendCredentials makes sure every identity can be mapped on every
+// replica, so a request is never forwarded without credentials.
+func checkBackendCredentials(cfg *config.Config, replicas []*Replica) error {
+	for _, userCfg := range cfg.Auth.Users {
+		backendUser := userCfg.BackendUser
+		if backendUser == "" {
+			backendUser = userCfg.Name
+		}
+		for _, replica := range replicas {
+			if _, ok := backendCredentials(cfg, replica, backendUser); !ok {
+				return fmt.Errorf("auth user %q: no credentials for backend user %q on replica %s", userCfg.Name, backendUser, replica.Name)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"clickhouse-test/config"
+	"github.com/stretchr/testify/require"
+)
+
+var testAuthConfig = config.AuthConfig{
+	Enabled:      true,
+	APIKeyHeader: "X-Api-Key",
+	Users: []config.AuthUser{
+		{Name: "alice", Password: "secret", Group: "team", BackendUser: "reader"},
+		{Name: "bob", APIKeys: []string{"bob-key"}}, // No password, API key only
+	},
+}
+
+func TestAuthenticator(t *testing.T) {
+	cfg := testAuthConfig
+	cfg.TokenFile = filepath.Join(t.TempDir(), "tokens")
+	require.NoError(t, os.WriteFile(cfg.TokenFile, []byte("# comment\n\nalice-token alice\n"), 0o600))
+	auth, err := NewAuthenticator(cfg)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		prepare func(r *http.Request)
+		want    string // Identity name, empty if rejected
+	}{
+		{"basic auth", func(r *http.Request) { r.SetBasicAuth("alice", "secret") }, "alice"},
+		{"basic auth wrong password", func(r *http.Request) { r.SetBasicAuth("alice", "wrong") }, ""},
+		{"basic auth unknown user", func(r *http.Request) { r.SetBasicAuth("eve", "secret") }, ""},
+		{"clickhouse headers", func(r *http.Request) {
+			r.Header.Set("X-ClickHouse-User", "alice")
+			r.Header.Set("X-ClickHouse-Key", "secret")
+		}, "alice"},
+		{"url parameters", func(r *http.Request) { r.URL.RawQuery = "user=alice&password=secret" }, "alice"},
+		{"url parameters wrong password", func(r *http.Request) { r.URL.RawQuery = "user=alice&password=wrong" }, ""},
+		{"user without password", func(r *http.Request) { r.SetBasicAuth("bob", "") }, ""},
+		{"api key", func(r *http.Request) { r.Header.Set("X-Api-Key", "bob-key") }, "bob"},
+		{"unknown api key", func(r *http.Request) { r.Header.Set("X-Api-Key", "bob-ke") }, ""},
+		{"bearer token", func(r *http.Request) { r.Header.Set("Authorization", "Bearer alice-token") }, "alice"},
+		{"unknown bearer token", func(r *http.Request) { r.Header.Set("Authorization", "Bearer bob-token") }, ""},
+		{"no credentials", func(r *http.Request) {}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			tt.prepare(r)
+			identity, err := auth.Authenticate(r)
+			if tt.want == "" {
+				require.True(t, errors.Is(err, ErrUnauthenticated), "got %v", err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, identity.Name)
+		})
+	}
+
+	// Group and backend user as configured, defaulting to the user name
+	identity, err := auth.AuthenticatePassword("alice", "secret")
+	require.NoError(t, err)
+	require.Equal(t, &Identity{Name: "alice", Group: "team", BackendUser: "reader"}, identity)
+	identity, err = lookupSecret(auth.apiKeys, "bob-key")
+	require.NoError(t, err)
+	require.Equal(t, &Identity{Name: "bob", Group: "bob", BackendUser: "bob"}, identity)
+}
+
+func TestAuthCredentialsReplaced(t *testing.T) {
+	var mu sync.Mutex
+	var seen []*http.Request
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		seen = append(seen, r.Clone(r.Context()))
+		mu.Unlock()
+	}))
+	defer backend.Close()
+
+	cfg := &config.Config{
+		HeaderName:    "X-User-Id",
+		MaxConcurrent: 2,
+		MaxQueue:      2,
+		QueueTimeout:  time.Second,
+		Auth:          testAuthConfig,
+		Replicas: []config.ReplicaConfig{{
+			Name:        "r1",
+			Credentials: map[string]config.Credentials{"reader": {User: "ch_reader", Password: "replica-pw"}},
+		}},
+		Nodes:              []config.NodeConfig{{Replica: "r1", Address: strings.TrimPrefix(backend.URL, "http://")}},
+		BackendCredentials: map[string]config.Credentials{"bob": {User: "ch_bob", Password: "global-pw"}},
+	}
+	p, err := NewSimpleProxy(cfg)
+	require.NoError(t, err)
+
+	send := func(prepare func(r *http.Request)) int {
+		r := httptest.NewRequest(http.MethodGet, "/?query=SELECT+1", nil)
+		prepare(r)
+		rw := httptest.NewRecorder()
+		p.ServeHTTP(rw, r)
+		return rw.Code
+	}
+	last := func() *http.Request {
+		mu.Lock()
+		defer mu.Unlock()
+		return seen[len(seen)-1]
+	}
+
+	// Mapped to the replica's credentials for the backend user, the client's
+	// own credentials are not passed on
+	require.Equal(t, http.StatusOK, send(func(r *http.Request) { r.SetBasicAuth("alice", "secret") }))
+	upstream := last()
+	require.Empty(t, upstream.Header.Get("Authorization"))
+	require.Equal(t, "ch_reader", upstream.Header.Get("X-ClickHouse-User"))
+	require.Equal(t, "replica-pw", upstream.Header.Get("X-ClickHouse-Key"))
+
+	require.Equal(t, http.StatusOK, send(func(r *http.Request) { r.URL.RawQuery += "&user=alice&password=secret" }))
+	upstream = last()
+	require.False(t, upstream.URL.Query().Has("user"))
+	require.False(t, upstream.URL.Query().Has("password"))
+	require.Equal(t, "SELECT 1", upstream.URL.Query().Get("query"))
+	require.Equal(t, "ch_reader", upstream.Header.Get("X-ClickHouse-User"))
+
+	// Falls back to backend_credentials, and the API key is not passed on
+	require.Equal(t, http.StatusOK, send(func(r *http.Request) { r.Header.Set("X-Api-Key", "bob-key") }))
+	upstream = last()
+	require.Empty(t, upstream.Header.Get("X-Api-Key"))
+	require.Equal(t, "ch_bob", upstream.Header.Get("X-ClickHouse-User"))
+	require.Equal(t, "global-pw", upstream.Header.Get("X-ClickHouse-Key"))
+
+	// Bad passwords never reach ClickHouse
+	require.Equal(t, http.StatusUnauthorized, send(func(r *http.Request) { r.SetBasicAuth("alice", "wrong") }))
+	require.Equal(t, http.StatusUnauthorized, send(func(r *http.Request) {}))
+	mu.Lock()
+	require.Len(t, seen, 3)
+	mu.Unlock()
+}
+
+func TestCheckBackendCredentials(t *testing.T) {
+	cfg := &config.Config{
+		Auth:     testAuthConfig,
+		Replicas: []config.ReplicaConfig{{Name: "r1"}, {Name: "r2"}},
+	}
+	cfg.Replicas[0].Credentials = map[string]config.Credentials{"reader": {User: "ch_reader"}, "bob": {User: "ch_bob"}}
+	replicas := make([]*Replica, 0, len(cfg.Replicas))
+	for _, replicaCfg := range cfg.Replicas {
+		replicas = append(replicas, &Replica{Name: replicaCfg.Name, Credentials: replicaCfg.Credentials})
+	}
+	err := checkBackendCredentials(cfg, replicas)
+	require.ErrorContains(t, err, "on replica r2")
+
+	cfg.BackendCredentials = map[string]config.Credentials{"reader": {User: "ch_reader"}, "bob": {User: "ch_bob"}}
+	require.NoError(t, checkBackendCredentials(cfg, replicas))
+	require.Equal(t, map[string]bool{"reader": true, "bob": true}, availableBackendUsers(cfg, replicas))
+}
+
+func TestAuthWithoutHeaderName(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	// With auth the group comes from the user, so header_name may be left out
+	cfg := &config.Config{
+		ListenAddr:    ":8080",
+		MaxConcurrent: 1,
+		QueueTimeout:  time.Second,
+		Auth:          testAuthConfig,
+		Replicas: []config.ReplicaConfig{{
+			Name:        "r1",
+			Credentials: map[string]config.Credentials{"reader": {User: "ch_reader"}, "bob": {User: "ch_bob"}},
+		}},
+		Nodes: []config.NodeConfig{{Replica: "r1", Address: strings.TrimPrefix(backend.URL, "http://")}},
+	}
+	require.NoError(t, cfg.Validate())
+	p, err := NewSimpleProxy(cfg)
+	require.NoError(t, err)
+
+	r := httptest.NewRequest(http.MethodGet, "/?query=SELECT+1", nil)
+	r.SetBasicAuth("alice", "secret")
+	rw := httptest.NewRecorder()
+	p.ServeHTTP(rw, r)
+	require.Equal(t, http.StatusOK, rw.Code)
+	_, ok := p.groupLimiters.Load("team")
+	require.True(t, ok, "queries should be limited by the user's group")
+}
@@ -0,0 +1,519 @@
+// --- cache.go --- (Response cache for repeated read queries)
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"clickhouse-test/config"
+)
+
+const (
+	defaultCacheMaxSize      = 256 * 1024 * 1024
+	defaultCacheMaxEntrySize = 8 * 1024 * 1024
+	cacheHeader              = "X-Proxy-Cache"
+)
+
+// cachedResponse is a complete upstream response.
+type cachedResponse struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+}
+
+// bodyStore keeps cached responses, in memory or on disk. The cache holds
+// the index and takes care of expiry and eviction. Stores are safe for
+// concurrent use, so the cache calls them without holding its own lock.
+type bodyStore interface {
+	Save(key string, resp *cachedResponse) error
+	Load(key string) (*cachedResponse, error)
+	Delete(key string)
+}
+
+type memoryStore struct {
+	mu      sync.Mutex
+	entries map[string]*cachedResponse
+}
+
+func (s *memoryStore) Save(key string, resp *cachedResponse) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries[key] = resp
+	return nil
+}
+
+func (s *memoryStore) Load(key string) (*cachedResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	resp, ok := s.entries[key]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return resp, nil
+}
+
+func (s *memoryStore) Delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.entries, key)
+}
+
+// diskStore keeps one gob file per response. Files left from a previous run
+// are removed, since the index is not persisted.
+type diskStore struct {
+	dir string
+}
+
+func newDiskStore(dir string) (*diskStore, error) {
+	if dir == "" {
+		return nil, errors.New("cache: dir is required for the disk store")
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	old, err := filepath.Glob(filepath.Join(dir, "*.cache"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range old {
+		os.Remove(path)
+	}
+	return &diskStore{dir: dir}, nil
+}
+
+func (s *diskStore) path(key string) string {
+	return filepath.Join(s.dir, key+".cache")
+}
+
+func (s *diskStore) Save(key string, resp *cachedResponse) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(resp); err != nil {
+		return err
+	}
+	tmp := s.path(key) + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path(key))
+}
+
+func (s *diskStore) Load(key string) (*cachedResponse, error) {
+	data, err := os.ReadFile(s.path(key))
+	if err != nil {
+		return nil, err
+	}
+	var resp cachedResponse
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (s *diskStore) Delete(key string) {
+	os.Remove(s.path(key))
+}
+
+type cacheRule struct {
+	name   string
+	groups map[string]bool // Empty for all groups
+	match  *regexp.Regexp  // nil matches every query
+	ttl    time.Duration
+}
+
+type cacheEntry struct {
+	key     string
+	name    string // Of the body in the store, unique per entry
+	size    int64
+	expires time.Time
+}
+
+// cacheFill is a response being fetched for a key. Requests for the same
+// key wait for it instead of going upstream themselves.
+type cacheFill struct {
+	cache  *ResponseCache
+	key    string
+	ttl    time.Duration
+	done   chan struct{}
+	resp   *cachedResponse // Set before done is closed, nil if not cacheable
+	saving bool            // Complete was called; later calls do nothing
+}
+
+// ResponseCache caches complete responses of read queries, bounded by total
+// size and evicting the least recently used entries first.
+type ResponseCache struct {
+	rules        []cacheRule
+	scope        string
+	maxSize      int64
+	maxEntrySize int64
+
+	mu      sync.Mutex
+	store   bodyStore
+	entries map[string]*list.Element // key -> *cacheEntry in lru
+	lru     *list.List               // Front is most recently used
+	size    int64
+	fills   map[string]*cacheFill
+	saved   int64 // Bodies stored so far, for unique store names
+}
+
+func NewResponseCache(cfg config.CacheConfig) (*ResponseCache, error) {
+	c := &ResponseCache{
+		scope:        cfg.Scope,
+		maxSize:      cfg.MaxSize,
+		maxEntrySize: cfg.MaxEntrySize,
+		entries:      make(map[string]*list.Element),
+		lru:          list.New(),
+		fills:        make(map[string]*cacheFill),
+	}
+	switch c.scope {
+	case "":
+		c.scope = "user"
+	case "user", "group":
+	default:
+		return nil, fmt.Errorf("cache: unknown scope %q", cfg.Scope)
+	}
+	if c.maxSize <= 0 {
+		c.maxSize = defaultCacheMaxSize
+	}
+	if c.maxEntrySize <= 0 {
+		c.maxEntrySize = defaultCacheMaxEntrySize
+	}
+	switch cfg.Store {
+	case "", "memory":
+		c.store = &memoryStore{entries: make(map[string]*cachedResponse)}
+	case "disk":
+		store, err := newDiskStore(cfg.Dir)
+		if err != nil {
+			return nil, err
+		}
+		c.store = store
+	default:
+		return nil, fmt.Errorf("cache: unknown store %q", cfg.Store)
+	}
+
+	for i, ruleCfg := range cfg.Rules {
+		if ruleCfg.TTL <= 0 {
+			return nil, fmt.Errorf("cache rule %d (%s): ttl must be positive", i, ruleCfg.Name)
+		}
+		rule := cacheRule{name: ruleCfg.Name, groups: make(map[string]bool), ttl: ruleCfg.TTL}
+		for _, group := range ruleCfg.Groups {
+			rule.groups[group] = true
+		}
+		if ruleCfg.Match != "" {
+			re, err := regexp.Compile(ruleCfg.Match)
+			if err != nil {
+				return nil, fmt.Errorf("cache rule %d (%s): %w", i, ruleCfg.Name, err)
+			}
+			rule.match = re
+		}
+		c.rules = append(c.rules, rule)
+	}
+	return c, nil
+}
+
+// Key returns the cache key and TTL of a request, or ok=false if the request
+// must not be cached. Only complete SELECTs matching a rule are cached.
+func (c *ResponseCache) Key(r *http.Request, groupKey, user string, info QueryInfo) (key string, ttl time.Duration, ok bool) {
+	if info.Kind != QuerySelect || info.Truncated {
+		return "", 0, false
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		return "", 0, false
+	}
+	for _, rule := range c.rules {
+		if len(rule.groups) > 0 && !rule.groups[groupKey] {
+			continue
+		}
+		if rule.match != nil && !rule.match.MatchString(info.Query) {
+			continue
+		}
+		ttl, ok = rule.ttl, true
+		break
+	}
+	if !ok {
+		return "", 0, false
+	}
+
+	scope := []string{"scope", c.scope, groupKey}
+	if c.scope == "user" {
+		scope = append(scope, user)
+	}
+	scope = append(scope, credentialScope(r)...)
+	return requestKey(r, normalizeQuery(info.Query), scope...), ttl, true
+}
+
+// credentialScope returns the credentials to add to the key of a shared
+// response. With proxy auth the identity was checked and is enough. Without
+// it only ClickHouse checks the password, and a cached response would skip
+// that check, so the key includes the credentials as the client sent them
+// (hashed with the rest of the key): a wrong password never finds an entry.
+func credentialScope(r *http.Request) []string {
+	if GetIdentity(r.Context()) != nil {
+		return nil
+	}
+	user, password, _ := clientCredentials(r)
+	return []string{"credentials", user, password, r.Header.Get("Authorization")}
+}
+
+// requestKey hashes everything that determines the response to a read:
+// the query, database, format, settings and class, plus the given scope.
+func requestKey(r *http.Request, query string, scope ...string) string {
+	h := sha256.New()
+	write := func(parts ...string) {
+		for _, part := range parts {
+			h.Write([]byte(part))
+			h.Write([]byte{0})
+		}
+	}
+	write(scope...)
+	if class := GetClass(r.Context()); class != nil {
+		write("class", class.Name)
+	}
+	write("query", query)
+	write("database", requestDatabase(r))
+	write("format", r.Header.Get("X-ClickHouse-Format"))
+	write("encoding", r.Header.Get("Accept-Encoding"))
+	// Settings and format parameters, in a stable order
+	params := r.URL.Query()
+	names := make([]string, 0, len(params))
+	for name := range params {
+		switch name {
+		case "query", "query_id", "user", "password":
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		write("param", name)
+		write(params[name]...)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// normalizeQuery drops comments and collapses whitespace, so queries that
+// differ only in formatting share an entry.
+func normalizeQuery(query string) string {
+	tokens := tokenize(query)
+	texts := make([]string, len(tokens))
+	for i, tok := range tokens {
+		texts[i] = tok.text
+	}
+	return strings.Join(texts, " ")
+}
+
+// Get returns the cached response for key. If another request is fetching
+// it, Get waits for that request. On a miss the caller gets a fill to
+// complete once it has the response; waiters are released by Complete.
+func (c *ResponseCache) Get(ctx context.Context, key string, ttl time.Duration) (*cachedResponse, *cacheFill) {
+	if resp := c.lookup(key); resp != nil {
+		return resp, nil
+	}
+	c.mu.Lock()
+	fill, ok := c.fills[key]
+	if !ok {
+		fill = &cacheFill{cache: c, key: key, ttl: ttl, done: make(chan struct{})}
+		c.fills[key] = fill
+		c.mu.Unlock()
+		return nil, fill
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-fill.done:
+	case <-ctx.Done():
+		return nil, nil
+	}
+	// A nil response was not cacheable; the caller goes upstream on its own
+	return fill.resp, nil
+}
+
+// lookup returns the stored response for key, if there is a fresh entry.
+// The body is read without holding the lock; the disk store may be slow.
+func (c *ResponseCache) lookup(key string) *cachedResponse {
+	c.mu.Lock()
+	elem, ok := c.entries[key]
+	if !ok {
+		c.mu.Unlock()
+		return nil
+	}
+	entry := elem.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		c.removeLocked(elem)
+		c.mu.Unlock()
+		c.store.Delete(entry.name)
+		return nil
+	}
+	c.lru.MoveToFront(elem)
+	c.mu.Unlock()
+
+	resp, err := c.store.Load(entry.name)
+	if err != nil {
+		// Evicted while we were reading, or the file is gone
+		c.mu.Lock()
+		if c.entries[key] == elem {
+			c.removeLocked(elem)
+		}
+		c.mu.Unlock()
+		c.store.Delete(entry.name)
+		return nil
+	}
+	return resp
+}
+
+// removeLocked drops an entry from the index. The caller deletes its body
+// from the store once it has released the lock.
+func (c *ResponseCache) removeLocked(elem *list.Element) {
+	entry := elem.Value.(*cacheEntry)
+	c.lru.Remove(elem)
+	delete(c.entries, entry.key)
+	c.size -= entry.size
+}
+
+// Complete stores the response, if any, and releases waiting requests. It
+// is safe to call more than once; only the first call counts. The body is
+// written to the store before the lock is taken, so a slow disk only holds
+// up this request and its waiters.
+func (f *cacheFill) Complete(resp *cachedResponse) {
+	c := f.cache
+	c.mu.Lock()
+	if c.fills[f.key] != f || f.saving {
+		c.mu.Unlock()
+		return
+	}
+	f.saving = true // The fill stays registered, so waiters keep waiting for it
+	c.saved++
+	name := fmt.Sprintf("%s-%d", f.key, c.saved)
+	c.mu.Unlock()
+
+	var size int64
+	if resp != nil {
+		size = int64(len(resp.Body))
+		for name, values := range resp.Header {
+			size += int64(len(name))
+			for _, v := range values {
+				size += int64(len(v))
+			}
+		}
+		if size > c.maxEntrySize || c.store.Save(name, resp) != nil {
+			resp = nil
+		}
+	}
+
+	var stale []string // Bodies to delete once the lock is released
+	c.mu.Lock()
+	delete(c.fills, f.key)
+	if resp != nil {
+		if elem, ok := c.entries[f.key]; ok {
+			c.removeLocked(elem)
+			stale = append(stale, elem.Value.(*cacheEntry).name)
+		}
+		c.entries[f.key] = c.lru.PushFront(&cacheEntry{key: f.key, name: name, size: size, expires: time.Now().Add(f.ttl)})
+		c.size += size
+		for c.size > c.maxSize && c.lru.Len() > 0 {
+			elem := c.lru.Back()
+			c.removeLocked(elem)
+			stale = append(stale, elem.Value.(*cacheEntry).name)
+		}
+	}
+	f.resp = resp
+	close(f.done)
+	c.mu.Unlock()
+
+	for _, name := range stale {
+		c.store.Delete(name)
+	}
+}
+
+// writeCachedResponse sends a cached response to the client.
+func writeCachedResponse(rw http.ResponseWriter, resp *cachedResponse) {
+	for name, values := range resp.Header {
+		rw.Header()[name] = values
+	}
+	rw.Header().Set(cacheHeader, "HIT")
+	rw.WriteHeader(resp.StatusCode)
+	rw.Write(resp.Body)
+}
+
+// cacheRecorder passes the response through to the client while keeping a
+// copy for the cache, as long as it stays under the size limit.
+type cacheRecorder struct {
+	http.ResponseWriter
+	statusCode int
+	header     http.Header
+	body       bytes.Buffer
+	limit      int64
+	overflow   bool
+	failed     bool // Writing to the client failed, the copy stopped early
+}
+
+func (w *cacheRecorder) WriteHeader(statusCode int) {
+	if w.statusCode == 0 {
+		w.statusCode = statusCode
+		w.header = w.ResponseWriter.Header().Clone()
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *cacheRecorder) Write(b []byte) (int, error) {
+	if w.statusCode == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.overflow {
+		if int64(w.body.Len()+len(b)) > w.limit {
+			w.overflow = true
+			w.body = bytes.Buffer{}
+		} else {
+			w.body.Write(b)
+		}
+	}
+	n, err := w.ResponseWriter.Write(b)
+	if err != nil {
+		w.failed = true
+	}
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the client connection (flushes).
+func (w *cacheRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *cacheRecorder) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// response returns the recorded response if it can be cached: a complete
+// 200 without a ClickHouse exception, neither in the headers nor at the end
+// of a body that was already streaming when the query failed.
+func (w *cacheRecorder) response() *cachedResponse {
+	if w.statusCode != http.StatusOK || w.overflow || w.failed || w.header.Get("X-ClickHouse-Exception-Code") != "" {
+		return nil
+	}
+	if endsWithException(w.body.Bytes()) {
+		return nil
+	}
+	if length := w.header.Get("Content-Length"); length != "" && length != strconv.Itoa(w.body.Len()) {
+		return nil // Upstream response was cut short
+	}
+	header := w.header.Clone()
+	header.Del(cacheHeader)
+	header.Del("Date")
+	return &cachedResponse{StatusCode: w.statusCode, Header: header, Body: bytes.Clone(w.body.Bytes())}
+}
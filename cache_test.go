@@ -0,0 +1,199 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"clickhouse-test/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheKey(t *testing.T) {
+	cache, err := NewResponseCache(config.CacheConfig{
+		Rules: []config.CacheRuleConfig{{Name: "dashboards", Groups: []string{"123"}, TTL: time.Minute}},
+	})
+	require.NoError(t, err)
+
+	key := func(group, user, rawURL string) string {
+		r := httptest.NewRequest(http.MethodGet, rawURL, nil)
+		k, _, ok := cache.Key(r, group, user, ClassifyRequest(r))
+		if !ok {
+			return ""
+		}
+		return k
+	}
+	base := key("123", "alice", "/?query=SELECT+1&default_format=JSON")
+	require.NotEmpty(t, base)
+	require.Equal(t, base, key("123", "alice", "/?query=SELECT++1+--+refresh&default_format=JSON&query_id=x"), "whitespace, comments and query_id don't matter")
+	require.NotEqual(t, base, key("123", "bob", "/?query=SELECT+1&default_format=JSON"), "users don't share entries")
+	require.NotEqual(t, base, key("123", "alice", "/?query=SELECT+1&default_format=CSV"))
+	require.Empty(t, key("456", "alice", "/?query=SELECT+1"), "no rule for the group")
+	require.Empty(t, key("123", "alice", "/?query=INSERT+INTO+t+VALUES+(1)"), "only SELECTs are cached")
+
+	// Without proxy auth the password is part of the key; with it, the identity is enough
+	withPassword := func(password string, identity *Identity) string {
+		r := httptest.NewRequest(http.MethodGet, "/?query=SELECT+1", nil)
+		r.SetBasicAuth("alice", password)
+		if identity != nil {
+			r = r.WithContext(WithIdentity(r.Context(), identity))
+		}
+		k, _, _ := cache.Key(r, "123", "alice", ClassifyRequest(r))
+		return k
+	}
+	require.NotEqual(t, withPassword("secret", nil), withPassword("guess", nil), "a wrong password must not find the entry")
+	identity := &Identity{Name: "alice", Group: "123"}
+	require.Equal(t, withPassword("secret", identity), withPassword("token-2", identity))
+}
+
+func TestCacheSkipsMidStreamExceptions(t *testing.T) {
+	body := "1\n2\nCode: 241. DB::Exception: Memory limit (total) exceeded. (MEMORY_LIMIT_EXCEEDED) (version 23.8.1.1)\n"
+	recorder := &cacheRecorder{ResponseWriter: httptest.NewRecorder(), limit: 1 << 20}
+	recorder.Write([]byte(body))
+	require.Nil(t, recorder.response(), "a result cut short by an exception must not be cached")
+
+	recorder = &cacheRecorder{ResponseWriter: httptest.NewRecorder(), limit: 1 << 20}
+	recorder.Write([]byte("1\n2\n"))
+	require.NotNil(t, recorder.response())
+}
+
+func TestCacheDiskStore(t *testing.T) {
+	cache, err := NewResponseCache(config.CacheConfig{
+		Store:   "disk",
+		Dir:     t.TempDir(),
+		MaxSize: 100,
+		Rules:   []config.CacheRuleConfig{{Name: "all", TTL: time.Minute}},
+	})
+	require.NoError(t, err)
+
+	fill := func(key, body string) {
+		_, f := cache.Get(t.Context(), key, time.Minute)
+		require.NotNil(t, f)
+		f.Complete(&cachedResponse{StatusCode: http.StatusOK, Body: []byte(body)})
+	}
+	fill("a", strings.Repeat("a", 60))
+	resp, _ := cache.Get(t.Context(), "a", time.Minute)
+	require.NotNil(t, resp)
+	require.Equal(t, strings.Repeat("a", 60), string(resp.Body))
+
+	// The second entry pushes the first out, and its file with it
+	fill("b", strings.Repeat("b", 60))
+	resp, f := cache.Get(t.Context(), "a", time.Minute)
+	require.Nil(t, resp)
+	f.Complete(nil)
+	files, err := filepath.Glob(filepath.Join(cache.store.(*diskStore).dir, "*.cache"))
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+}
+
+func TestCacheServesHitsWithoutUpstream(t *testing.T) {
+	var upstreamCalls atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamCalls.Add(1)
+		time.Sleep(50 * time.Millisecond)
+		w.Write([]byte("1\n"))
+	}))
+	defer backend.Close()
+
+	cfg := &config.Config{
+		HeaderName:    "X-User-Id",
+		MaxConcurrent: 2,
+		QueueTimeout:  time.Second,
+		Replicas:      []config.ReplicaConfig{{Name: "r1"}},
+		Nodes:         []config.NodeConfig{{Replica: "r1", Address: strings.TrimPrefix(backend.URL, "http://")}},
+		Cache: config.CacheConfig{
+			Enabled: true,
+			Rules:   []config.CacheRuleConfig{{Name: "all", TTL: time.Minute}},
+		},
+	}
+	p, err := NewSimpleProxy(cfg)
+	require.NoError(t, err)
+
+	get := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/?query=SELECT+1", nil)
+		r.Header.Set("X-User-Id", "123")
+		rw := httptest.NewRecorder()
+		p.ServeHTTP(rw, r)
+		return rw
+	}
+
+	// Concurrent identical requests are collapsed into one upstream call
+	results := make(chan *httptest.ResponseRecorder, 3)
+	for i := 0; i < 3; i++ {
+		go func() { results <- get() }()
+	}
+	for i := 0; i < 3; i++ {
+		rw := <-results
+		require.Equal(t, http.StatusOK, rw.Code)
+		require.Equal(t, "1\n", rw.Body.String())
+	}
+	require.EqualValues(t, 1, upstreamCalls.Load())
+
+	// With the group's slots taken, a hit must not need one
+	require.NoError(t, p.groupLimiter("123").Acquire(t.Context()))
+	require.NoError(t, p.groupLimiter("123").Acquire(t.Context()))
+	rw := get()
+	require.Equal(t, "HIT", rw.Header().Get(cacheHeader))
+	require.Equal(t, "1\n", rw.Body.String())
+	require.EqualValues(t, 1, upstreamCalls.Load())
+}
+
+func TestCacheSkipsBrokenResponses(t *testing.T) {
+	var upstreamCalls atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if upstreamCalls.Add(1) == 1 {
+			// Half a chunked 200, then the connection drops
+			w.Write([]byte("1\n"))
+			w.(http.Flusher).Flush()
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err == nil {
+				conn.Close()
+			}
+			return
+		}
+		w.Write([]byte("1\n2\n"))
+	}))
+	defer backend.Close()
+
+	cfg := &config.Config{
+		HeaderName:    "X-User-Id",
+		MaxConcurrent: 2,
+		QueueTimeout:  time.Second,
+		Replicas:      []config.ReplicaConfig{{Name: "r1"}},
+		Nodes:         []config.NodeConfig{{Replica: "r1", Address: strings.TrimPrefix(backend.URL, "http://")}},
+		Cache: config.CacheConfig{
+			Enabled: true,
+			Rules:   []config.CacheRuleConfig{{Name: "all", TTL: time.Minute}},
+		},
+	}
+	p, err := NewSimpleProxy(cfg)
+	require.NoError(t, err)
+	srv := httptest.NewServer(p) // A real server, so the reverse proxy aborts the handler
+	defer srv.Close()
+	get := func() (*http.Response, string, error) {
+		req, err := http.NewRequest(http.MethodGet, srv.URL+"/?query=SELECT+1", nil)
+		require.NoError(t, err)
+		req.Header.Set("X-User-Id", "123")
+		resp, err := srv.Client().Do(req)
+		if err != nil {
+			return nil, "", err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		return resp, string(body), err
+	}
+
+	_, _, err = get()
+	require.Error(t, err, "the client sees the broken response")
+
+	resp, body, err := get()
+	require.NoError(t, err)
+	require.Equal(t, "MISS", resp.Header.Get(cacheHeader), "the partial body must not be cached")
+	require.Equal(t, "1\n2\n", body)
+	require.EqualValues(t, 2, upstreamCalls.Load())
+}
@@ -0,0 +1,170 @@
+// --- check.go --- (check subcommand: config validation and topology)
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"clickhouse-test/config"
+)
+
+// runCheckCommand validates a config file, prints the topology the proxy
+// would use and optionally checks that every node accepts connections.
+// It returns 0 if everything is fine, 1 on problems and 2 if the file cannot
+// be loaded.
+func runCheckCommand(args []string) int {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	configPath := fs.String("config", "config/config.yml", "Path to config file (YAML, JSON or TOML)")
+	var overrides stringsFlag
+	fs.Var(&overrides, "set", "Override a config value, e.g. -set max_concurrent=5 (repeatable)")
+	dial := fs.Bool("dial", false, "Connect to every node (HTTP and native addresses)")
+	timeout := fs.Duration("timeout", 3*time.Second, "Timeout for each connection with -dial")
+	fs.Parse(args)
+
+	cfg, err := config.LoadConfig(*configPath, overrides...)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading config file %s: %v\n", *configPath, err)
+		return 2
+	}
+
+	status := 0
+	if err := cfg.Validate(); err != nil {
+		var fieldErrs config.ValidationErrors
+		errors.As(err, &fieldErrs)
+		fmt.Printf("%s: %d problem(s)\n", *configPath, len(fieldErrs))
+		for _, fe := range fieldErrs {
+			fmt.Printf("  %s\n", fe)
+		}
+		status = 1
+	} else {
+		fmt.Printf("%s: OK\n", *configPath)
+	}
+	fmt.Println()
+
+	if !printTopology(cfg, *dial, *timeout) {
+		status = 1
+	}
+	return status
+}
+
+// printTopology prints listeners, replicas and their nodes as the proxy
+// resolves them. With dial it connects to each node and reports false if
+// any connection failed.
+func printTopology(cfg *config.Config, dial bool, timeout time.Duration) bool {
+	ok := true
+	fmt.Printf("Listeners: proxy %s", orNone(cfg.ListenAddr))
+	if cfg.TLS.CertFile != "" {
+		fmt.Print(" (TLS)")
+	}
+	fmt.Printf(", admin %s, native %s\n", orNone(cfg.AdminAddr), orNone(cfg.NativeListenAddr))
+	fmt.Printf("Limits per group: %d concurrent, %d queued, %s queue timeout\n",
+		cfg.MaxConcurrent, cfg.MaxQueue, cfg.QueueTimeout)
+
+	for _, replicaCfg := range cfg.Replicas {
+		fmt.Printf("\nReplica %s", replicaCfg.Name)
+		if len(replicaCfg.Labels) > 0 {
+			fmt.Printf(" (%s)", formatLabels(replicaCfg.Labels))
+		}
+		if len(cfg.Insert.ReplicaLabels) > 0 {
+			replica := &Replica{Labels: replicaCfg.Labels}
+			if replica.HasLabels(cfg.Insert.ReplicaLabels) {
+				fmt.Print(", receives INSERTs")
+			}
+		}
+		if len(replicaCfg.Credentials) > 0 {
+			users := make([]string, 0, len(replicaCfg.Credentials))
+			for user := range replicaCfg.Credentials {
+				users = append(users, user)
+			}
+			sort.Strings(users)
+			fmt.Printf(", credentials for %s", strings.Join(users, ", "))
+		}
+		fmt.Println()
+
+		found := false
+		for _, nodeCfg := range cfg.Nodes {
+			if nodeCfg.Replica != replicaCfg.Name {
+				continue
+			}
+			found = true
+			// Resolve the node the same way the proxy does
+			replica, err := NewReplica(replicaCfg, []config.NodeConfig{nodeCfg}, cfg.ReplicaScheme, cfg.SlowdownRate, cfg.SlowdownBurst)
+			if err != nil {
+				fmt.Printf("  %-30s invalid: %v\n", nodeCfg.Address, err)
+				ok = false
+				continue
+			}
+			node := replica.Nodes[0]
+			line := fmt.Sprintf("  %-30s", node.Address)
+			if nodeCfg.Shard != "" {
+				line += " shard " + nodeCfg.Shard
+			}
+			if node.TLS != nil {
+				line += " (TLS settings)"
+			}
+			if dial {
+				result, dialed := dialNode(node.URL.Host, timeout)
+				line += "  " + result
+				ok = ok && dialed
+			}
+			fmt.Println(line)
+			if node.NativeAddress != "" {
+				line = fmt.Sprintf("    native %-23s", node.NativeAddress)
+				if dial {
+					result, dialed := dialNode(node.NativeAddress, timeout)
+					line += "  " + result
+					ok = ok && dialed
+				}
+				fmt.Println(line)
+			}
+		}
+		if !found {
+			fmt.Println("  (no nodes)")
+		}
+	}
+	return ok
+}
+
+// dialNode resolves and connects to addr, describing the outcome.
+func dialNode(addr string, timeout time.Duration) (string, bool) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "FAILED: " + err.Error(), false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	ips, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err != nil {
+		return "FAILED: " + err.Error(), false
+	}
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return "FAILED: " + err.Error(), false
+	}
+	conn.Close()
+	return fmt.Sprintf("ok %s [%s]", time.Since(start).Round(100*time.Microsecond), strings.Join(ips, " ")), true
+}
+
+func formatLabels(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ", ")
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,336 @@
+// --- classify.go --- (Lightweight SQL classification of incoming requests)
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/ClickHouse/ch-go/compress"
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// maxClassifyBytes limits how much of the (decompressed) body is inspected.
+const maxClassifyBytes = 64 * 1024
+
+// QueryKind is the statement type of a request.
+type QueryKind int
+
+const (
+	QueryUnknown QueryKind = iota
+	QuerySelect            // SELECT, WITH, SHOW, DESCRIBE, EXISTS, EXPLAIN
+	QueryInsert
+	QueryDDL // CREATE, ALTER, DROP, RENAME, TRUNCATE, ...
+	QuerySystem
+	QueryKill
+	QueryOther // SET, USE, GRANT, DELETE, ...
+)
+
+var queryKindNames = map[QueryKind]string{
+	QueryUnknown: "unknown",
+	QuerySelect:  "select",
+	QueryInsert:  "insert",
+	QueryDDL:     "ddl",
+	QuerySystem:  "system",
+	QueryKill:    "kill",
+	QueryOther:   "other",
+}
+
+func (k QueryKind) String() string {
+	return queryKindNames[k]
+}
+
+// IsRead reports whether the statement only reads data.
+func (k QueryKind) IsRead() bool {
+	return k == QuerySelect
+}
+
+// ParseQueryKind converts a name such as "select" or "ddl" back to a QueryKind.
+func ParseQueryKind(name string) (QueryKind, bool) {
+	for kind, kindName := range queryKindNames {
+		if strings.EqualFold(kindName, name) {
+			return kind, true
+		}
+	}
+	return QueryUnknown, false
+}
+
+var firstKeywordKinds = map[string]QueryKind{
+	"SELECT":   QuerySelect,
+	"WITH":     QuerySelect,
+	"SHOW":     QuerySelect,
+	"DESCRIBE": QuerySelect,
+	"DESC":     QuerySelect,
+	"EXISTS":   QuerySelect,
+	"EXPLAIN":  QuerySelect,
+	"INSERT":   QueryInsert,
+	"CREATE":   QueryDDL,
+	"ALTER":    QueryDDL,
+	"DROP":     QueryDDL,
+	"RENAME":   QueryDDL,
+	"TRUNCATE": QueryDDL,
+	"ATTACH":   QueryDDL,
+	"DETACH":   QueryDDL,
+	"OPTIMIZE": QueryDDL,
+	"EXCHANGE": QueryDDL,
+	"UNDROP":   QueryDDL,
+	"SYSTEM":   QuerySystem,
+	"KILL":     QueryKill,
+}
+
+// QueryInfo is the result of classifying a request.
+type QueryInfo struct {
+	Kind      QueryKind
+	Query     string // Query text as seen by the classifier (URL param and body prefix)
+	Truncated bool   // Query was cut at maxClassifyBytes
+}
+
+// complete reports whether the classifier saw the whole statement: the query
+// was not cut, or it is an INSERT whose data starts within the part seen.
+func (q QueryInfo) complete() bool {
+	return !q.Truncated || (q.Kind == QueryInsert && analyzeStatement(q.Query).insertData)
+}
+
+// ClassifyQuery returns the statement type of a SQL text based on its first keyword.
+func ClassifyQuery(query string) QueryKind {
+	lexer := sqlLexer{sql: query}
+	for tok, ok := lexer.Next(); ok; tok, ok = lexer.Next() {
+		if tok.kind == tokPunct && tok.text == "(" {
+			continue // e.g. "(SELECT 1) UNION ALL (SELECT 2)"
+		}
+		if tok.kind != tokWord {
+			return QueryUnknown
+		}
+		if kind, ok := firstKeywordKinds[strings.ToUpper(tok.text)]; ok {
+			return kind
+		}
+		return QueryOther
+	}
+	return QueryUnknown
+}
+
+// ClassifyRequest inspects the "query" URL parameter and a prefix of the
+// body (decompressing it if needed) and returns the statement type. The
+// request body is left intact for forwarding.
+func ClassifyRequest(r *http.Request) QueryInfo {
+	// ClickHouse concatenates the query parameter and the body.
+	query := r.URL.Query().Get("query")
+	prefix, truncated := peekBody(r, maxClassifyBytes)
+	if len(prefix) > 0 {
+		if query != "" {
+			query += " "
+		}
+		query += string(prefix)
+	}
+	return QueryInfo{
+		Kind:      ClassifyQuery(query),
+		Query:     query,
+		Truncated: truncated,
+	}
+}
+
+// peekBody returns up to n decompressed bytes of the request body and
+// restores the body so the original (still compressed) bytes are forwarded.
+func peekBody(r *http.Request, n int) ([]byte, bool) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, false
+	}
+	var raw bytes.Buffer
+	tee := io.TeeReader(r.Body, &raw)
+
+	var (
+		prefix []byte
+		err    error
+	)
+	if dec := newBodyDecompressor(r, tee); dec != nil {
+		prefix, err = io.ReadAll(io.LimitReader(dec, int64(n)+1))
+		dec.Close()
+	} else {
+		prefix, err = io.ReadAll(io.LimitReader(tee, int64(n)+1))
+	}
+	r.Body = readCloser{io.MultiReader(bytes.NewReader(raw.Bytes()), r.Body), r.Body}
+	if err != nil && len(prefix) == 0 {
+		return nil, false
+	}
+	if len(prefix) > n {
+		return prefix[:n], true
+	}
+	return prefix, false
+}
+
+// newBodyDecompressor returns a reader decoding the body according to
+// Content-Encoding or ClickHouse's "decompress=1" block compression.
+// Returns nil if the body is not compressed or the encoding is unknown.
+func newBodyDecompressor(r *http.Request, body io.Reader) io.ReadCloser {
+	if r.URL.Query().Get("decompress") == "1" {
+		return io.NopCloser(compress.NewReader(body))
+	}
+	switch strings.ToLower(r.Header.Get("Content-Encoding")) {
+	case "gzip":
+		zr, err := gzip.NewReader(body)
+		if err != nil {
+			return nil
+		}
+		return zr
+	case "deflate":
+		zr, err := zlib.NewReader(body)
+		if err != nil {
+			return nil
+		}
+		return zr
+	case "br":
+		return io.NopCloser(brotli.NewReader(body))
+	case "zstd":
+		zr, err := zstd.NewReader(body)
+		if err != nil {
+			return nil
+		}
+		return zr.IOReadCloser()
+	}
+	return nil
+}
+
+// --- SQL tokenizer ---
+
+type tokenKind int
+
+const (
+	tokWord   tokenKind = iota // Keywords and bare identifiers
+	tokQuoted                  // `identifier` or "identifier"
+	tokString                  // 'string literal'
+	tokNumber
+	tokPunct
+	tokParam // {name:Type} query parameter
+)
+
+type sqlToken struct {
+	kind tokenKind
+	text string
+}
+
+// sqlLexer splits SQL into tokens, dropping whitespace and comments. It is
+// lenient: unterminated strings or comments simply end the token stream.
+type sqlLexer struct {
+	sql string
+	pos int
+}
+
+// Next returns the next token, or false at the end of the input.
+func (l *sqlLexer) Next() (sqlToken, bool) {
+	sql := l.sql
+	for l.pos < len(sql) {
+		i := l.pos
+		c := sql[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f':
+			l.pos++
+		case c == '-' && strings.HasPrefix(sql[i:], "--"), c == '#':
+			end := strings.IndexByte(sql[i:], '\n')
+			if end < 0 {
+				l.pos = len(sql)
+				return sqlToken{}, false
+			}
+			l.pos += end + 1
+		case c == '/' && strings.HasPrefix(sql[i:], "/*"):
+			end := strings.Index(sql[i+2:], "*/")
+			if end < 0 {
+				l.pos = len(sql)
+				return sqlToken{}, false
+			}
+			l.pos += end + 4
+		case c == '\'' || c == '"' || c == '`':
+			kind := tokQuoted
+			if c == '\'' {
+				kind = tokString
+			}
+			l.pos = quotedEnd(sql, i)
+			return sqlToken{kind: kind, text: sql[i:l.pos]}, true
+		case isDigit(c) || (c == '.' && i+1 < len(sql) && isDigit(sql[i+1])):
+			j := i + 1
+			for j < len(sql) && (isWordChar(sql[j]) || sql[j] == '.' ||
+				((sql[j] == '+' || sql[j] == '-') && (sql[j-1] == 'e' || sql[j-1] == 'E'))) {
+				j++
+			}
+			l.pos = j
+			return sqlToken{kind: tokNumber, text: sql[i:j]}, true
+		case isWordChar(c):
+			j := i + 1
+			for j < len(sql) && isWordChar(sql[j]) {
+				j++
+			}
+			l.pos = j
+			return sqlToken{kind: tokWord, text: sql[i:j]}, true
+		case c == '{':
+			end := strings.IndexByte(sql[i:], '}')
+			if end < 0 {
+				end = len(sql) - i - 1
+			}
+			l.pos = i + end + 1
+			return sqlToken{kind: tokParam, text: sql[i:l.pos]}, true
+		default:
+			l.pos++
+			return sqlToken{kind: tokPunct, text: sql[i:l.pos]}, true
+		}
+	}
+	return sqlToken{}, false
+}
+
+// tokenize returns all tokens of the SQL text.
+func tokenize(sql string) []sqlToken {
+	var tokens []sqlToken
+	lexer := sqlLexer{sql: sql}
+	for tok, ok := lexer.Next(); ok; tok, ok = lexer.Next() {
+		tokens = append(tokens, tok)
+	}
+	return tokens
+}
+
+// stripLiterals replaces string and number literals with ?, so the query
+// shape can be logged without the values in it. Comments are dropped and
+// whitespace is normalized as in normalizeQuery.
+func stripLiterals(sql string) string {
+	tokens := tokenize(sql)
+	texts := make([]string, len(tokens))
+	for i, tok := range tokens {
+		if tok.kind == tokString || tok.kind == tokNumber {
+			texts[i] = "?"
+		} else {
+			texts[i] = tok.text
+		}
+	}
+	return strings.Join(texts, " ")
+}
+
+// quotedEnd returns the index just past the quoted token starting at i,
+// honouring backslash escapes and doubled quotes.
+func quotedEnd(sql string, i int) int {
+	quote := sql[i]
+	j := i + 1
+	for j < len(sql) {
+		switch sql[j] {
+		case '\\':
+			j += 2
+			continue
+		case quote:
+			if j+1 < len(sql) && sql[j+1] == quote {
+				j += 2
+				continue
+			}
+			return j + 1
+		}
+		j++
+	}
+	return len(sql)
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isWordChar(c byte) bool {
+	return c == '_' || c == '$' || isDigit(c) || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c >= 0x80
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClassifyQuery(t *testing.T) {
+	tests := []struct {
+		query string
+		want  QueryKind
+	}{
+		{"SELECT version()", QuerySelect},
+		{"  -- comment\n/* block */ select 1", QuerySelect},
+		{"(SELECT 1) UNION ALL (SELECT 2)", QuerySelect},
+		{"WITH x AS (SELECT 1) SELECT * FROM x", QuerySelect},
+		{"SHOW TABLES", QuerySelect},
+		{"INSERT INTO t FORMAT JSONEachRow", QueryInsert},
+		{"CREATE TABLE t (id UInt32) ENGINE = Memory", QueryDDL},
+		{"drop table t", QueryDDL},
+		{"SYSTEM FLUSH LOGS", QuerySystem},
+		{"KILL QUERY WHERE query_id = 'x'", QueryKill},
+		{"SET max_threads = 1", QueryOther},
+		{"", QueryUnknown},
+		{"'oops'", QueryUnknown},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, ClassifyQuery(tt.query), tt.query)
+	}
+}
+
+func TestClassifyRequest(t *testing.T) {
+	// Query parameter and body are concatenated, like ClickHouse does.
+	r, err := http.NewRequest(http.MethodPost, "http://proxy/?query="+url.QueryEscape("INSERT INTO t FORMAT CSV"), strings.NewReader("1,2\n"))
+	require.NoError(t, err)
+	info := ClassifyRequest(r)
+	assert.Equal(t, QueryInsert, info.Kind)
+	body, err := io.ReadAll(r.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "1,2\n", string(body))
+
+	// Compressed bodies are classified, but forwarded as sent.
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	_, err = zw.Write([]byte("ALTER TABLE t DELETE WHERE 1"))
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+	raw := compressed.Bytes()
+
+	r, err = http.NewRequest(http.MethodPost, "http://proxy/", bytes.NewReader(raw))
+	require.NoError(t, err)
+	r.Header.Set("Content-Encoding", "gzip")
+	info = ClassifyRequest(r)
+	assert.Equal(t, QueryDDL, info.Kind)
+	body, err = io.ReadAll(r.Body)
+	require.NoError(t, err)
+	assert.Equal(t, raw, body)
+}
@@ -0,0 +1,330 @@
+// --- coalesce.go --- (Sharing one upstream execution between identical reads)
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"clickhouse-test/config"
+)
+
+const (
+	defaultCoalesceMaxBuffer = 16 * 1024 * 1024
+	coalesceHeader           = "X-Proxy-Coalesced"
+)
+
+// Coalescer lets identical concurrent read requests share one upstream
+// execution. The first request (the leader) goes through the limiter and
+// upstream as usual; the others (followers) take no slot and receive a copy
+// of the leader's response as it streams in.
+type Coalescer struct {
+	maxBuffer int64
+	mu        sync.Mutex
+	flights   map[string]*flight
+}
+
+func NewCoalescer(cfg config.CoalesceConfig) *Coalescer {
+	maxBuffer := cfg.MaxBuffer
+	if maxBuffer <= 0 {
+		maxBuffer = defaultCoalesceMaxBuffer
+	}
+	return &Coalescer{maxBuffer: maxBuffer, flights: make(map[string]*flight)}
+}
+
+// coalesceKey returns the key under which a request may share an execution:
+// byte-identical SELECTs with the same parameters from the same user, and
+// without proxy auth with the same credentials (see credentialScope).
+func coalesceKey(r *http.Request, groupKey, user string, info QueryInfo) (string, bool) {
+	if info.Kind != QuerySelect || info.Truncated {
+		return "", false
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		return "", false
+	}
+	scope := append([]string{"coalesce", groupKey, user}, credentialScope(r)...)
+	return requestKey(r, info.Query, scope...), true
+}
+
+// Join returns the flight for key. If the caller started it, reader is nil
+// and the caller must serve the request, writing through flight.Writer.
+// Otherwise it follows the flight with the returned reader.
+func (c *Coalescer) Join(key string) (*flight, *flightReader) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if f, ok := c.flights[key]; ok {
+		if reader := f.join(); reader != nil {
+			return f, reader
+		}
+	}
+	f := newFlight(c.maxBuffer)
+	c.flights[key] = f
+	return f, nil
+}
+
+// finish ends the leader's flight. It is deferred by the leader so it also
+// runs when the response copy panics; followers then abort too.
+func (c *Coalescer) finish(key string, f *flight) {
+	aborted := recover()
+	c.mu.Lock()
+	if c.flights[key] == f {
+		delete(c.flights, key)
+	}
+	c.mu.Unlock()
+	f.finish(aborted != nil)
+	if aborted != nil {
+		panic(aborted)
+	}
+}
+
+// flight is one shared execution. The leader's response body is buffered
+// from the start while followers may still join; after that only the part
+// not yet read by every follower is kept.
+type flight struct {
+	mu        sync.Mutex
+	cond      *sync.Cond
+	maxBuffer int64
+
+	statusCode int
+	header     http.Header // Set when the leader writes its header
+	data       []byte      // Response body from offset base on
+	base       int64
+	joinable   bool
+	done       bool
+	aborted    bool
+	readers    map[*flightReader]struct{}
+	leaderGone bool               // The leader's client went away
+	cancel     context.CancelFunc // Of the detached upstream context, nil until detach
+}
+
+// flightReader is a follower's read offset into the response body.
+type flightReader struct {
+	pos int64
+}
+
+func newFlight(maxBuffer int64) *flight {
+	f := &flight{maxBuffer: maxBuffer, joinable: true, readers: make(map[*flightReader]struct{})}
+	f.cond = sync.NewCond(&f.mu)
+	return f
+}
+
+// join registers a follower, or returns nil if the flight is closed to them.
+func (f *flight) join() *flightReader {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.joinable {
+		return nil
+	}
+	reader := &flightReader{}
+	f.readers[reader] = struct{}{}
+	return reader
+}
+
+func (f *flight) finish(aborted bool) {
+	f.mu.Lock()
+	f.done, f.aborted, f.joinable = true, aborted, false
+	f.cond.Broadcast()
+	cancel := f.cancel
+	f.mu.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+}
+
+// detach returns the context for the leader's upstream execution. It is not
+// canceled when the leader's client goes away, only once no follower is left
+// to read the response either; a follower must not lose its response because
+// the client that happened to come first hung up.
+func (f *flight) detach(ctx context.Context) context.Context {
+	detached, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	f.mu.Lock()
+	f.cancel = cancel
+	f.mu.Unlock()
+	context.AfterFunc(ctx, func() {
+		f.mu.Lock()
+		f.leaderGone = true
+		f.cancelIfUnusedLocked()
+		f.mu.Unlock()
+	})
+	return detached
+}
+
+// cancelIfUnusedLocked stops the upstream execution once neither the leader
+// nor any follower reads it.
+func (f *flight) cancelIfUnusedLocked() {
+	if f.leaderGone && len(f.readers) == 0 && f.cancel != nil {
+		f.joinable = false
+		f.cancel()
+	}
+}
+
+// shared reports whether a follower still reads the response.
+func (f *flight) shared() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.readers) > 0
+}
+
+// Writer wraps the leader's ResponseWriter so followers see what it writes.
+func (f *flight) Writer(rw http.ResponseWriter) http.ResponseWriter {
+	return &flightWriter{ResponseWriter: rw, flight: f}
+}
+
+func (f *flight) writeHeader(statusCode int, header http.Header) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.header == nil {
+		f.statusCode, f.header = statusCode, header.Clone()
+		f.cond.Broadcast()
+	}
+}
+
+func (f *flight) write(b []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.joinable && len(f.readers) == 0 {
+		return
+	}
+	f.data = append(f.data, b...)
+	if f.joinable && int64(len(f.data)) > f.maxBuffer {
+		f.joinable = false // New followers would need the whole response
+	}
+	f.trimLocked()
+	f.cond.Broadcast()
+}
+
+// trimLocked drops data every follower has read, once no one can join.
+func (f *flight) trimLocked() {
+	if f.joinable {
+		return
+	}
+	end := f.base + int64(len(f.data))
+	min := end
+	for reader := range f.readers {
+		if reader.pos < min {
+			min = reader.pos
+		}
+	}
+	if min == f.base {
+		return
+	}
+	f.data = append([]byte(nil), f.data[min-f.base:]...)
+	f.base = min
+}
+
+// Follow copies the leader's response to rw as it arrives. It returns false
+// if the leader failed before sending anything, in which case the caller
+// serves the request itself.
+func (f *flight) Follow(ctx context.Context, rw http.ResponseWriter, reader *flightReader) bool {
+	defer func() {
+		f.mu.Lock()
+		delete(f.readers, reader)
+		f.trimLocked()
+		f.cancelIfUnusedLocked()
+		f.mu.Unlock()
+	}()
+	stop := context.AfterFunc(ctx, func() {
+		f.mu.Lock()
+		f.cond.Broadcast()
+		f.mu.Unlock()
+	})
+	defer stop()
+
+	f.mu.Lock()
+	for f.header == nil && !f.done && ctx.Err() == nil {
+		f.cond.Wait()
+	}
+	if f.header == nil {
+		f.mu.Unlock()
+		return ctx.Err() != nil // Canceled: nothing to serve; leader failed: serve ourselves
+	}
+	for name, values := range f.header {
+		rw.Header()[name] = values
+	}
+	statusCode := f.statusCode
+	f.mu.Unlock()
+	rw.Header().Set(coalesceHeader, "1")
+	rw.WriteHeader(statusCode)
+
+	flusher, _ := rw.(http.Flusher)
+	for {
+		f.mu.Lock()
+		for reader.pos == f.base+int64(len(f.data)) && !f.done && ctx.Err() == nil {
+			f.cond.Wait()
+		}
+		chunk := append([]byte(nil), f.data[reader.pos-f.base:]...)
+		done, aborted := f.done, f.aborted
+		f.mu.Unlock()
+
+		if len(chunk) > 0 {
+			if _, err := rw.Write(chunk); err != nil {
+				return true
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+			f.mu.Lock()
+			reader.pos += int64(len(chunk))
+			f.trimLocked()
+			f.mu.Unlock()
+			continue
+		}
+		if ctx.Err() != nil {
+			return true
+		}
+		if done {
+			if aborted {
+				// Like the reverse proxy on a broken upstream: cut the connection
+				// so the client does not take a partial response as complete.
+				panic(http.ErrAbortHandler)
+			}
+			return true
+		}
+	}
+}
+
+// flightWriter passes the leader's response through and shares it. Once the
+// leader's client is gone, the response keeps coming for the followers.
+type flightWriter struct {
+	http.ResponseWriter
+	flight      *flight
+	wroteHeader bool
+	err         error // Writing to the leader's client failed
+}
+
+func (w *flightWriter) WriteHeader(statusCode int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.flight.writeHeader(statusCode, w.ResponseWriter.Header())
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *flightWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	w.flight.write(b)
+	if w.err == nil {
+		n, err := w.ResponseWriter.Write(b)
+		if err == nil {
+			return n, nil
+		}
+		w.err = err
+	}
+	if !w.flight.shared() {
+		return 0, w.err // No one left to read the rest
+	}
+	return len(b), nil
+}
+
+// Unwrap lets http.ResponseController reach the client connection (flushes).
+func (w *flightWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *flightWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
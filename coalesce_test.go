@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"clickhouse-test/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCoalesceSharesOneExecution(t *testing.T) {
+	var upstreamCalls atomic.Int32
+	started := make(chan struct{})
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamCalls.Add(1)
+		w.Write([]byte("first\n"))
+		w.(http.Flusher).Flush()
+		close(started)
+		<-release
+		w.Write([]byte("second\n"))
+	}))
+	defer backend.Close()
+
+	cfg := &config.Config{
+		HeaderName:    "X-User-Id",
+		MaxConcurrent: 1,
+		QueueTimeout:  10 * time.Millisecond, // Followers would be rejected if they queued
+		Replicas:      []config.ReplicaConfig{{Name: "r1"}},
+		Nodes:         []config.NodeConfig{{Replica: "r1", Address: strings.TrimPrefix(backend.URL, "http://")}},
+		Coalesce:      config.CoalesceConfig{Enabled: true},
+	}
+	p, err := NewSimpleProxy(cfg)
+	require.NoError(t, err)
+
+	get := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/?query=SELECT+count()+FROM+t", nil)
+		r.Header.Set("X-User-Id", "123")
+		rw := httptest.NewRecorder()
+		p.ServeHTTP(rw, r)
+		return rw
+	}
+
+	results := make(chan *httptest.ResponseRecorder, 4)
+	go func() { results <- get() }()
+	<-started // The leader is streaming its response
+	for i := 0; i < 3; i++ {
+		go func() { results <- get() }()
+	}
+	require.Eventually(t, func() bool {
+		p.coalescer.mu.Lock()
+		defer p.coalescer.mu.Unlock()
+		for _, f := range p.coalescer.flights {
+			f.mu.Lock()
+			n := len(f.readers)
+			f.mu.Unlock()
+			return n == 3
+		}
+		return false
+	}, time.Second, time.Millisecond)
+	close(release)
+
+	followers := 0
+	for i := 0; i < 4; i++ {
+		rw := <-results
+		require.Equal(t, http.StatusOK, rw.Code)
+		require.Equal(t, "first\nsecond\n", rw.Body.String())
+		if rw.Header().Get(coalesceHeader) != "" {
+			followers++
+		}
+	}
+	require.Equal(t, 3, followers)
+	require.EqualValues(t, 1, upstreamCalls.Load())
+}
+
+// brokenClient is a leader whose client hangs up halfway.
+type brokenClient struct {
+	*httptest.ResponseRecorder
+	gone atomic.Bool
+}
+
+func (w *brokenClient) Write(b []byte) (int, error) {
+	if w.gone.Load() {
+		return 0, errors.New("client went away")
+	}
+	return w.ResponseRecorder.Write(b)
+}
+
+func TestCoalesceSurvivesLeaderDisconnect(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("first\n"))
+		w.(http.Flusher).Flush()
+		close(started)
+		<-release
+		w.Write([]byte("second\n"))
+	}))
+	defer backend.Close()
+
+	cfg := &config.Config{
+		HeaderName:    "X-User-Id",
+		MaxConcurrent: 1,
+		QueueTimeout:  10 * time.Millisecond,
+		Replicas:      []config.ReplicaConfig{{Name: "r1"}},
+		Nodes:         []config.NodeConfig{{Replica: "r1", Address: strings.TrimPrefix(backend.URL, "http://")}},
+		Coalesce:      config.CoalesceConfig{Enabled: true},
+	}
+	p, err := NewSimpleProxy(cfg)
+	require.NoError(t, err)
+	request := func(ctx context.Context) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/?query=SELECT+count()+FROM+t", nil).WithContext(ctx)
+		r.Header.Set("X-User-Id", "123")
+		return r
+	}
+
+	leaderCtx, hangUp := context.WithCancel(context.Background())
+	leader := &brokenClient{ResponseRecorder: httptest.NewRecorder()}
+	leaderDone := make(chan struct{})
+	go func() {
+		defer close(leaderDone)
+		p.ServeHTTP(leader, request(leaderCtx))
+	}()
+	<-started
+
+	follower := make(chan *httptest.ResponseRecorder)
+	go func() {
+		rw := httptest.NewRecorder()
+		p.ServeHTTP(rw, request(context.Background()))
+		follower <- rw
+	}()
+	require.Eventually(t, func() bool {
+		p.coalescer.mu.Lock()
+		defer p.coalescer.mu.Unlock()
+		for _, f := range p.coalescer.flights {
+			return f.shared()
+		}
+		return false
+	}, time.Second, time.Millisecond)
+
+	leader.gone.Store(true)
+	hangUp()
+	close(release)
+	rw := <-follower
+	require.Equal(t, http.StatusOK, rw.Code)
+	require.Equal(t, "first\nsecond\n", rw.Body.String())
+	<-leaderDone
+}
+
+func TestCoalesceKeyCredentials(t *testing.T) {
+	key := func(password string) string {
+		r := httptest.NewRequest(http.MethodGet, "/?query=SELECT+1", nil)
+		r.SetBasicAuth("alice", password)
+		k, ok := coalesceKey(r, "123", "alice", ClassifyRequest(r))
+		require.True(t, ok)
+		return k
+	}
+	require.Equal(t, key("secret"), key("secret"))
+	require.NotEqual(t, key("secret"), key("guess"), "a wrong password must not share a response")
+}
@@ -8,8 +8,62 @@ import (
 )
 
 type ReplicaConfig struct {
-	Name   string            `yaml:"name"`
-	Labels map[string]string `yaml:"labels"`
+	Name        string                 `yaml:"name"`
+	Labels      map[string]string      `yaml:"labels"`
+	Credentials map[string]Credentials `yaml:"credentials"` // Backend user name -> ClickHouse credentials on this replica
+	TLS         *BackendTLSConfig      `yaml:"tls"`         // TLS settings for the replica's nodes
+	Transport   *TransportConfig       `yaml:"transport"`   // Overrides the top-level transport for the replica's nodes
+}
+
+// BackendTLSConfig configures TLS toward ClickHouse nodes. Files are re-read
+// when they change.
+type BackendTLSConfig struct {
+	CAFile             string `yaml:"ca_file"`              // CA bundle to verify the node, instead of the system roots
+	CertFile           string `yaml:"cert_file"`            // Client certificate for mTLS
+	KeyFile            string `yaml:"key_file"`             // Client key for mTLS
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"` // Don't verify the node certificate (testing only)
+	ServerName         string `yaml:"server_name"`          // SNI and name to verify, if different from the address
+}
+
+// Credentials are the ClickHouse user and password the proxy sends upstream.
+type Credentials struct {
+	User     string `yaml:"user"`
+	Password string `yaml:"password"`
+}
+
+// AuthUser is a client identity authenticated by the proxy.
+type AuthUser struct {
+	Name        string   `yaml:"name"`
+	Password    string   `yaml:"password"`     // For basic auth (or user/password as ClickHouse clients send them)
+	APIKeys     []string `yaml:"api_keys"`     // Accepted in api_key_header
+	Group       string   `yaml:"group"`        // Group key for limits, defaults to Name
+	BackendUser string   `yaml:"backend_user"` // Key into replica credentials, defaults to Name
+}
+
+// JWTConfig validates bearer JWTs against a JWKS and derives the identity
+// from their claims.
+type JWTConfig struct {
+	Enabled            bool          `yaml:"enabled"`
+	JWKSFile           string        `yaml:"jwks_file"`            // Local JWKS, e.g. for tests
+	JWKSURL            string        `yaml:"jwks_url"`             // Or fetch the JWKS from the identity provider
+	JWKSRefresh        time.Duration `yaml:"jwks_refresh"`         // How often the JWKS is re-read
+	Issuer             string        `yaml:"issuer"`               // Required "iss", if set
+	Audience           string        `yaml:"audience"`             // Required "aud", if set
+	ClockSkew          time.Duration `yaml:"clock_skew"`           // Tolerance for exp/nbf
+	GroupClaim         string        `yaml:"group_claim"`          // Claim with the group key, defaults to "sub"
+	ClassClaim         string        `yaml:"class_claim"`          // Optional claim naming the settings class
+	UserClaim          string        `yaml:"user_claim"`           // Optional claim naming the backend user
+	DefaultBackendUser string        `yaml:"default_backend_user"` // Backend user when the claim is missing
+}
+
+// AuthConfig enables authentication at the proxy. When enabled, the group key
+// comes from the authenticated identity instead of header_name.
+type AuthConfig struct {
+	Enabled      bool       `yaml:"enabled"`
+	APIKeyHeader string     `yaml:"api_key_header"` // e.g. "X-Api-Key"
+	TokenFile    string     `yaml:"token_file"`     // Bearer tokens, one "<token> <user name>" per line
+	Users        []AuthUser `yaml:"users"`
+	JWT          JWTConfig  `yaml:"jwt"` // Optional: bearer JWTs
 }
 
 type ShardConfig struct {
@@ -22,39 +76,272 @@ type NodeConfig struct {
 	Replica string            `yaml:"replica"`
 	Address string            `yaml:"address"`
 	Labels  map[string]string `yaml:"labels"`
+	TLS     *BackendTLSConfig `yaml:"tls"` // Overrides the replica's TLS settings
+
+	NativeAddress string `yaml:"native_address"` // host:port of the native protocol, required with native_listen_addr
+}
+
+// HedgeConfig controls duplicate ("hedged") requests for slow read queries.
+type HedgeConfig struct {
+	Enabled     bool          `yaml:"enabled"`
+	Delay       time.Duration `yaml:"delay"`        // Send a hedge if no response headers arrived within this delay
+	Percentile  float64       `yaml:"percentile"`   // Optional: use this percentile (0-1) of recent latency instead of Delay
+	BudgetRate  float64       `yaml:"budget_rate"`  // Max hedged requests per second across the proxy
+	BudgetBurst int           `yaml:"budget_burst"` // Burst allowance for hedged requests
+}
+
+// InsertConfig holds limits, routing and timeout for INSERT statements.
+// When MaxConcurrent is 0, inserts share the group's regular limiter.
+type InsertConfig struct {
+	MaxConcurrent int               `yaml:"max_concurrent"` // Concurrent inserts per header value
+	MaxQueue      int               `yaml:"max_queue"`      // Queued inserts per header value
+	QueueTimeout  time.Duration     `yaml:"queue_timeout"`  // Max time an insert waits in queue
+	Timeout       time.Duration     `yaml:"timeout"`        // Upstream timeout for inserts, instead of proxy_timeout
+	ReplicaLabels map[string]string `yaml:"replica_labels"` // Only send inserts to replicas with these labels (e.g. role: writer)
+}
+
+// CacheConfig controls the response cache for read queries.
+type CacheConfig struct {
+	Enabled      bool              `yaml:"enabled"`
+	Store        string            `yaml:"store"`          // "memory" (default) or "disk"
+	Dir          string            `yaml:"dir"`            // Directory of the disk store, emptied on start
+	MaxSize      int64             `yaml:"max_size"`       // Total bytes of cached responses (default 256MB)
+	MaxEntrySize int64             `yaml:"max_entry_size"` // Larger responses are not cached (default 8MB)
+	Scope        string            `yaml:"scope"`          // Who shares cached responses: "user" (default) or "group"
+	Rules        []CacheRuleConfig `yaml:"rules"`          // Queries matching no rule are not cached
+}
+
+// CacheRuleConfig selects queries to cache and for how long.
+type CacheRuleConfig struct {
+	Name   string        `yaml:"name"`
+	Groups []string      `yaml:"groups"` // Header values the rule applies to; empty for all
+	Match  string        `yaml:"match"`  // Optional regexp the query must match
+	TTL    time.Duration `yaml:"ttl"`
+}
+
+// CoalesceConfig controls sharing one upstream execution between identical
+// concurrent read requests.
+type CoalesceConfig struct {
+	Enabled   bool  `yaml:"enabled"`
+	MaxBuffer int64 `yaml:"max_buffer"` // Stop taking followers once this much of the response is buffered (default 16MB)
+}
+
+// StreamingConfig controls how responses are streamed to clients, for large
+// exports (JSONEachRow, Parquet, ...) and queries running for a long time.
+type StreamingConfig struct {
+	FlushInterval    time.Duration     `yaml:"flush_interval"`     // How often response data is flushed to the client, 0 after every write
+	WriteIdleTimeout time.Duration     `yaml:"write_idle_timeout"` // Each write pushes the write deadline this far ahead, 0 keeps server.write_timeout fixed (default 60s)
+	ProgressInterval time.Duration     `yaml:"progress_interval"`  // Ask ClickHouse for X-ClickHouse-Progress headers this often on long queries, keeping the connection busy
+	LongQueries      []LongQueryConfig `yaml:"long_queries"`       // Queries exempt from server.write_timeout
+}
+
+// LongQueryConfig selects queries that may run longer than the server write
+// timeout. All lists that are set must match; an empty list matches everyone.
+type LongQueryConfig struct {
+	Name    string        `yaml:"name"`
+	Groups  []string      `yaml:"groups"`  // Header values
+	Users   []string      `yaml:"users"`   // ClickHouse users
+	Classes []string      `yaml:"classes"` // Group classes
+	Kinds   []string      `yaml:"kinds"`   // Statement kinds: select, insert, ...
+	Match   string        `yaml:"match"`   // Regexp the query must match, e.g. "(?i)FORMAT\\s+Parquet"
+	Timeout time.Duration `yaml:"timeout"` // Upstream timeout instead of proxy_timeout
+}
+
+// LogConfig controls log output. Logs go to stderr.
+type LogConfig struct {
+	Level  string `yaml:"level"`  // "debug", "info" (default), "warn" or "error"
+	Format string `yaml:"format"` // "text" (default) or "json"
+}
+
+// TracingConfig enables OpenTelemetry tracing. Incoming W3C traceparent
+// headers are continued and passed on to ClickHouse.
+type TracingConfig struct {
+	Enabled     bool    `yaml:"enabled"`
+	Exporter    string  `yaml:"exporter"`     // "stdout" (default) or "json_file"; stdouttrace JSON, not OTLP
+	File        string  `yaml:"file"`         // Spans are appended here with exporter "json_file"
+	ServiceName string  `yaml:"service_name"` // Defaults to "clickhouse-proxy"
+	SampleRatio float64 `yaml:"sample_ratio"` // Share of new traces recorded (default 1); sampled parents are always followed
+}
+
+// AuditConfig enables the audit log: one record per request with who ran
+// which query and what came of it. Records are written in the background;
+// when the output falls behind, new records are dropped rather than delaying
+// queries.
+type AuditConfig struct {
+	Enabled       bool          `yaml:"enabled"`
+	Output        string        `yaml:"output"`         // "file" (default) or "clickhouse"
+	File          string        `yaml:"file"`           // JSON lines, rotated at max_size
+	MaxSize       int64         `yaml:"max_size"`       // Bytes per file before rotating (default 100MB)
+	MaxBackups    int           `yaml:"max_backups"`    // Rotated files kept as file.1, file.2, ... (default 5)
+	Table         string        `yaml:"table"`          // Table inserted into with output "clickhouse"
+	BackendUser   string        `yaml:"backend_user"`   // Credentials for the inserts (replica credentials or backend_credentials)
+	Buffer        int           `yaml:"buffer"`         // Records held in memory before dropping (default 10000)
+	BatchSize     int           `yaml:"batch_size"`     // Records per write (default 1000)
+	FlushInterval time.Duration `yaml:"flush_interval"` // Max time a record waits to be written (default 5s)
+	Redact        bool          `yaml:"redact"`         // Replace string and number literals in queries with ?
+}
+
+// QueryStatsConfig enables per-fingerprint statistics: queries with their
+// literals replaced by ? are grouped, and latency, errors and bytes read are
+// kept for the last window or two.
+type QueryStatsConfig struct {
+	Enabled            bool          `yaml:"enabled"`
+	Window             time.Duration `yaml:"window"`               // Stats cover between one and two windows (default 15m)
+	MaxFingerprints    int           `yaml:"max_fingerprints"`     // New fingerprints are not tracked beyond this (default 1000)
+	SlowQueryThreshold time.Duration `yaml:"slow_query_threshold"` // Log queries running longer than this (0 disables)
+}
+
+// ClassConfig groups header values that get the same ClickHouse settings.
+type ClassConfig struct {
+	Name        string            `yaml:"name"`
+	Groups      []string          `yaml:"groups"`       // Header values belonging to this class
+	Settings    map[string]string `yaml:"settings"`     // Settings added to every request, overriding the client's
+	MaxSettings map[string]string `yaml:"max_settings"` // Numeric caps clients may not exceed, applied when not set
+}
+
+// ListenerTLSConfig enables TLS on the proxy listener. Certificate files are
+// re-read when they change, without a restart.
+type ListenerTLSConfig struct {
+	CertFile     string `yaml:"cert_file"`
+	KeyFile      string `yaml:"key_file"`
+	ClientCAFile string `yaml:"client_ca_file"` // Enables client certificate verification
+	ClientAuth   string `yaml:"client_auth"`    // "require" (default with client_ca_file) or "verify_if_given"
+	GroupFrom    string `yaml:"group_from"`     // Group key from the client certificate: subject_cn, san_dns, san_email or san_uri
+}
+
+// ServerConfig holds the HTTP server timeouts of the proxy listener.
+type ServerConfig struct {
+	ReadTimeout       time.Duration `yaml:"read_timeout"`        // Reading the whole request, body included (default 10s)
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout"` // Reading the request headers, 0 uses read_timeout
+	WriteTimeout      time.Duration `yaml:"write_timeout"`       // From the end of the request headers to the end of the response (default 180s)
+	IdleTimeout       time.Duration `yaml:"idle_timeout"`        // Idle keep-alive connections are closed after this (default 200s)
+}
+
+// TransportConfig configures connections to ClickHouse nodes. A replica's
+// transport only needs the values that differ from the top-level one.
+type TransportConfig struct {
+	DialTimeout           time.Duration `yaml:"dial_timeout"`             // Connecting to a node (default 10s)
+	TLSHandshakeTimeout   time.Duration `yaml:"tls_handshake_timeout"`    // TLS handshake with a node (default 10s)
+	ResponseHeaderTimeout time.Duration `yaml:"response_header_timeout"`  // Waiting for response headers once the request is sent, 0 for no limit
+	IdleConnTimeout       time.Duration `yaml:"idle_conn_timeout"`        // Idle connections to a node are closed after this (default 90s)
+	MaxIdleConnsPerHost   int           `yaml:"max_idle_conns_per_host"`  // Idle connections kept per node (default 100)
+	MaxConnsPerHost       int           `yaml:"max_conns_per_host"`       // Requests wait for a connection beyond this, 0 for no limit
+	MaxResponseHeaderSize int64         `yaml:"max_response_header_size"` // Limit on response headers, progress headers included (default 10MB)
+}
+
+// Merge returns t with the values set in override replacing its own.
+func (t TransportConfig) Merge(override *TransportConfig) TransportConfig {
+	if override == nil {
+		return t
+	}
+	if override.DialTimeout != 0 {
+		t.DialTimeout = override.DialTimeout
+	}
+	if override.TLSHandshakeTimeout != 0 {
+		t.TLSHandshakeTimeout = override.TLSHandshakeTimeout
+	}
+	if override.ResponseHeaderTimeout != 0 {
+		t.ResponseHeaderTimeout = override.ResponseHeaderTimeout
+	}
+	if override.IdleConnTimeout != 0 {
+		t.IdleConnTimeout = override.IdleConnTimeout
+	}
+	if override.MaxIdleConnsPerHost != 0 {
+		t.MaxIdleConnsPerHost = override.MaxIdleConnsPerHost
+	}
+	if override.MaxConnsPerHost != 0 {
+		t.MaxConnsPerHost = override.MaxConnsPerHost
+	}
+	if override.MaxResponseHeaderSize != 0 {
+		t.MaxResponseHeaderSize = override.MaxResponseHeaderSize
+	}
+	return t
 }
 
 // Config holds the simplified proxy configuration
 type Config struct {
-	ListenAddr    string        `yaml:"listen_addr"`
+	ListenAddr    string            `yaml:"listen_addr"`
+	TLS           ListenerTLSConfig `yaml:"tls"`            // Optional: serve HTTPS
+	Server        ServerConfig      `yaml:"server"`         // HTTP server timeouts
+	AdminAddr     string            `yaml:"admin_addr"`     // Optional: admin listener with /ready and /health
+	AdminServer   ServerConfig      `yaml:"admin_server"`   // Admin listener timeouts
+	ShutdownDelay time.Duration     `yaml:"shutdown_delay"` // How long /ready fails before the listener closes on shutdown
+	DrainTimeout  time.Duration     `yaml:"drain_timeout"`  // How long running and queued requests may finish on shutdown; 0 means the default
+
+	NativeListenAddr string `yaml:"native_listen_addr"` // Optional: ClickHouse native protocol listener (e.g. ":9000")
+	NativeGroupFrom  string `yaml:"native_group_from"`  // Native group key: "user" (default) or "quota_key"
+
 	HeaderName    string        `yaml:"header_name"`    // Header for grouping (e.g., "X-User-Id")
 	MaxConcurrent int           `yaml:"max_concurrent"` // Limit per header value
 	MaxQueue      int           `yaml:"max_queue"`      // Queue size per header value
 	QueueTimeout  time.Duration `yaml:"queue_timeout"`  // Max time to wait in queue
 	ReplicaScheme string        `yaml:"replica_scheme"` // "http" or "https"
 
+	Transport TransportConfig `yaml:"transport"` // Connections to ClickHouse nodes, replicas may override parts of it
+
 	Shards   []ShardConfig   `yaml:"shards"`
 	Replicas []ReplicaConfig `yaml:"replicas"`
 	Nodes    []NodeConfig    `yaml:"nodes"`
 
-	SlowdownError string  `yaml:"slowdown_error"` // Substring in CH error to trigger slowdown (e.g., "Too many simultaneous queries")
-	SlowdownCode  int     `yaml:"slowdown_code"`  // Optional: HTTP status code for slowdown error (e.g., 503, 500)
-	SlowdownRate  float64 `yaml:"slowdown_rate"`  // Target req/sec when slowed down
-	SlowdownBurst int     `yaml:"slowdown_burst"` // Burst allowance when slowed down
+	SlowdownError          string   `yaml:"slowdown_error"`           // Substring in CH error to trigger slowdown (e.g., "Too many simultaneous queries")
+	SlowdownErrors         []string `yaml:"slowdown_errors"`          // More substrings, like slowdown_error
+	SlowdownCode           int      `yaml:"slowdown_code"`            // Optional: HTTP status code for slowdown error (e.g., 503, 500)
+	SlowdownExceptionCodes []int    `yaml:"slowdown_exception_codes"` // ClickHouse exception codes that trigger slowdown (e.g., 202)
+	SlowdownRate           float64  `yaml:"slowdown_rate"`            // Target req/sec when slowed down
+	SlowdownBurst          int      `yaml:"slowdown_burst"`           // Burst allowance when slowed down
+
+	ProxyTimeout  time.Duration `yaml:"proxy_timeout"`  // Timeout for requests to backend replicas, counted from arrival
+	UserAgent     string        `yaml:"user_agent"`     // Custom User-Agent for backend requests
+	TimeoutHeader string        `yaml:"timeout_header"` // Optional: header with the client's timeout (e.g. "X-Request-Timeout: 30s")
 
-	ProxyTimeout time.Duration `yaml:"proxy_timeout"` // Timeout for requests to backend replicas
-	UserAgent    string        `yaml:"user_agent"`    // Custom User-Agent for backend requests
+	Hedge     HedgeConfig     `yaml:"hedge"`     // Hedged requests for read queries
+	Insert    InsertConfig    `yaml:"insert"`    // Separate limits and routing for INSERTs
+	Cache     CacheConfig     `yaml:"cache"`     // Response cache for repeated SELECTs
+	Coalesce  CoalesceConfig  `yaml:"coalesce"`  // Share in-flight executions of identical SELECTs
+	Streaming StreamingConfig `yaml:"streaming"` // Flushing, write deadlines and long-running queries
+
+	Classes      []ClassConfig `yaml:"classes"`       // Per-class ClickHouse settings
+	DefaultClass string        `yaml:"default_class"` // Class for header values not listed in any class
+
+	Auth               AuthConfig             `yaml:"auth"`                // Optional: authenticate clients at the proxy
+	BackendCredentials map[string]Credentials `yaml:"backend_credentials"` // Used when a replica has no credentials for the backend user
+
+	PolicyFile           string        `yaml:"policy_file"`            // Optional: query allow/deny rules, reloaded on change
+	PolicyReloadInterval time.Duration `yaml:"policy_reload_interval"` // How often policy_file is checked for changes
+
+	Log        LogConfig        `yaml:"log"`         // Log level and format; one access log line is written per request
+	Tracing    TracingConfig    `yaml:"tracing"`     // Optional: OpenTelemetry spans for queueing and upstream calls
+	Audit      AuditConfig      `yaml:"audit"`       // Optional: record of every query to a file or ClickHouse table
+	QueryStats QueryStatsConfig `yaml:"query_stats"` // Optional: per-fingerprint stats on the admin API and a slow query log
 
 	Version string `yaml:"version"` // Version of the config file
 }
 
-func LoadConfig(path string) (*Config, error) {
+// PolicyRule restricts the statements a group or user may send. A rule
+// applies when both Groups and Users match; an empty list matches everyone.
+type PolicyRule struct {
+	Name             string   `yaml:"name"`
+	Groups           []string `yaml:"groups"`             // Header values the rule applies to
+	Users            []string `yaml:"users"`              // ClickHouse users the rule applies to
+	DenyKinds        []string `yaml:"deny_kinds"`         // Statement kinds to block: ddl, system, kill, insert, ...
+	DenyStatements   []string `yaml:"deny_statements"`    // Statement prefixes to block, e.g. "DROP" or "ALTER TABLE"
+	RequireLimit     bool     `yaml:"require_limit"`      // SELECTs must have a LIMIT clause
+	ForbidSelectStar []string `yaml:"forbid_select_star"` // Tables ("db.table", "table" or "*") where SELECT * is not allowed
+	AllowedDatabases []string `yaml:"allowed_databases"`  // Only these databases may be queried
+}
+
+// PolicyConfig is the content of policy_file.
+type PolicyConfig struct {
+	Rules []PolicyRule `yaml:"rules"`
+}
+
+func LoadPolicy(path string) (*PolicyConfig, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
 
-	var cfg Config
+	var cfg PolicyConfig
 	if err := yaml.Unmarshal(data, &cfg); err != nil {
 		return nil, err
 	}
@@ -52,13 +52,35 @@ func TestConfig(t *testing.T) {
 				Address: "10.5.0.3:8123",
 			},
 		},
-		SlowdownError: "Too many simultaneous queries",
-		SlowdownCode:  503,
-		SlowdownRate:  1,
-		SlowdownBurst: 1,
-		ProxyTimeout:  120 * time.Second,
-		UserAgent:     "SimpleClickHouseProxy/1.0",
-		Version:       "1.0",
+		SlowdownError:          "Too many simultaneous queries",
+		SlowdownCode:           503,
+		SlowdownExceptionCodes: []int{202},
+		SlowdownRate:           1,
+		SlowdownBurst:          1,
+		ProxyTimeout:           120 * time.Second,
+		UserAgent:              "SimpleClickHouseProxy/1.0",
+		Version:                "1.0",
+		// Not in the file, from Defaults
+		DrainTimeout: 30 * time.Second,
+		Server: ServerConfig{
+			ReadTimeout:  10 * time.Second,
+			WriteTimeout: 180 * time.Second,
+			IdleTimeout:  200 * time.Second,
+		},
+		AdminServer: ServerConfig{
+			ReadTimeout:  10 * time.Second,
+			WriteTimeout: 30 * time.Second,
+			IdleTimeout:  60 * time.Second,
+		},
+		Transport: TransportConfig{
+			DialTimeout:         10 * time.Second,
+			TLSHandshakeTimeout: 10 * time.Second,
+			IdleConnTimeout:     90 * time.Second,
+			MaxIdleConnsPerHost: 100,
+		},
+		Streaming: StreamingConfig{
+			WriteIdleTimeout: 60 * time.Second,
+		},
 	}
 	require.Equal(t, want, cfg)
 }
@@ -0,0 +1,321 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// Defaults returns the configuration used for everything the file does not set.
+func Defaults() *Config {
+	return &Config{
+		ReplicaScheme: "http",
+		QueueTimeout:  10 * time.Second,
+		SlowdownRate:  1.0,
+		SlowdownBurst: 1,
+		ProxyTimeout:  120 * time.Second,
+		DrainTimeout:  30 * time.Second,
+		Server: ServerConfig{
+			ReadTimeout:  10 * time.Second,
+			WriteTimeout: 180 * time.Second, // Allow time for long queries
+			IdleTimeout:  200 * time.Second,
+		},
+		AdminServer: ServerConfig{
+			ReadTimeout:  10 * time.Second,
+			WriteTimeout: 30 * time.Second,
+			IdleTimeout:  60 * time.Second,
+		},
+		Transport: TransportConfig{
+			DialTimeout:         10 * time.Second,
+			TLSHandshakeTimeout: 10 * time.Second,
+			IdleConnTimeout:     90 * time.Second,
+			MaxIdleConnsPerHost: 100,
+		},
+		Streaming: StreamingConfig{
+			WriteIdleTimeout: 60 * time.Second,
+		},
+	}
+}
+
+// LoadConfig reads a YAML, JSON or TOML config file (chosen by extension,
+// YAML otherwise) on top of Defaults. Before decoding:
+//
+//   - ${NAME} in values is replaced by the environment variable NAME, and
+//     ${NAME:-fallback} uses fallback when NAME is unset or empty
+//   - ${file:/run/secrets/x} is replaced by the content of that file, without
+//     the trailing newline, so secrets can stay out of the config
+//   - overrides of the form "path=value" are applied, e.g. "max_concurrent=5",
+//     "hedge.enabled=true" or "nodes[0].address=10.0.0.1:8123"; the value is
+//     parsed as YAML
+func LoadConfig(path string, overrides ...string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	root, err := parseDocument(filepath.Ext(path), data)
+	if err != nil {
+		return nil, err
+	}
+	if err := interpolate(root, ""); err != nil {
+		return nil, err
+	}
+	for _, override := range overrides {
+		if err := applyOverride(root, override); err != nil {
+			return nil, fmt.Errorf("override %q: %w", override, err)
+		}
+	}
+
+	cfg := Defaults()
+	if err := root.Decode(cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// parseDocument returns the top-level mapping of the file as a YAML node
+// tree, whatever the file format.
+func parseDocument(ext string, data []byte) (*yaml.Node, error) {
+	if strings.EqualFold(ext, ".toml") {
+		// Converted through YAML so the yaml field tags apply to every format
+		var tree map[string]any
+		if err := toml.Unmarshal(data, &tree); err != nil {
+			return nil, err
+		}
+		converted, err := yaml.Marshal(tree)
+		if err != nil {
+			return nil, err
+		}
+		data = converted
+	}
+	// JSON is valid YAML
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if len(doc.Content) == 0 {
+		return &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}, nil
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("config must be a mapping at the top level")
+	}
+	return root, nil
+}
+
+// interpolate expands ${...} references in all scalar values under node.
+func interpolate(node *yaml.Node, path string) error {
+	switch node.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if err := interpolate(node.Content[i+1], joinPath(path, node.Content[i].Value)); err != nil {
+				return err
+			}
+		}
+	case yaml.SequenceNode:
+		for i, child := range node.Content {
+			if err := interpolate(child, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	case yaml.ScalarNode:
+		if !strings.Contains(node.Value, "${") {
+			return nil
+		}
+		value, err := expand(node.Value)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		node.Value = value
+		if node.Style == 0 {
+			node.Tag = "" // Resolve the type again, ${PORT} may be a number
+		}
+	}
+	return nil
+}
+
+// expand replaces ${NAME}, ${NAME:-fallback} and ${file:path} in s.
+// "$${" stands for a literal "${".
+func expand(s string) (string, error) {
+	var b strings.Builder
+	for {
+		start := strings.Index(s, "${")
+		if start < 0 {
+			b.WriteString(s)
+			return b.String(), nil
+		}
+		if start > 0 && s[start-1] == '$' {
+			b.WriteString(s[:start-1] + "${")
+			s = s[start+2:]
+			continue
+		}
+		end := strings.IndexByte(s[start:], '}')
+		if end < 0 {
+			return "", fmt.Errorf("unterminated ${ in %q", s)
+		}
+		b.WriteString(s[:start])
+		ref := s[start+2 : start+end]
+		s = s[start+end+1:]
+
+		if file, ok := strings.CutPrefix(ref, "file:"); ok {
+			data, err := os.ReadFile(file)
+			if err != nil {
+				return "", fmt.Errorf("secret file: %w", err)
+			}
+			b.WriteString(strings.TrimRight(string(data), "\r\n"))
+			continue
+		}
+		name, fallback, hasFallback := strings.Cut(ref, ":-")
+		value := os.Getenv(name)
+		if value == "" {
+			if !hasFallback {
+				return "", fmt.Errorf("environment variable %s is not set", name)
+			}
+			value = fallback
+		}
+		b.WriteString(value)
+	}
+}
+
+// applyOverride sets the value at a dotted path, creating missing keys.
+func applyOverride(root *yaml.Node, override string) error {
+	path, raw, ok := strings.Cut(override, "=")
+	if !ok {
+		return fmt.Errorf("expected path=value")
+	}
+	segments, err := parsePath(path)
+	if err != nil {
+		return err
+	}
+	if err := checkPath(reflect.TypeOf(Config{}), segments); err != nil {
+		return err
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal([]byte(raw), &doc); err != nil {
+		return err
+	}
+	value := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: ""}
+	if len(doc.Content) > 0 {
+		value = doc.Content[0]
+	}
+
+	node := root
+	for i, seg := range segments {
+		last := i == len(segments)-1
+		var next **yaml.Node
+		if seg.index < 0 {
+			if node.Kind != yaml.MappingNode {
+				*node = yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+			}
+			for j := 0; j+1 < len(node.Content); j += 2 {
+				if node.Content[j].Value == seg.key {
+					next = &node.Content[j+1]
+					break
+				}
+			}
+			if next == nil {
+				node.Content = append(node.Content,
+					&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: seg.key},
+					&yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"})
+				next = &node.Content[len(node.Content)-1]
+			}
+		} else {
+			if node.Kind != yaml.SequenceNode {
+				*node = yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+			}
+			switch {
+			case seg.index < len(node.Content):
+			case seg.index == len(node.Content):
+				node.Content = append(node.Content, &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"})
+			default:
+				return fmt.Errorf("index %d out of range, the list has %d entries", seg.index, len(node.Content))
+			}
+			next = &node.Content[seg.index]
+		}
+		if last {
+			*next = value
+			return nil
+		}
+		node = *next
+	}
+	return nil
+}
+
+// pathSegment is a map key, or a list index when index >= 0.
+type pathSegment struct {
+	key   string
+	index int
+}
+
+// parsePath splits "nodes[0].address" into segments.
+func parsePath(path string) ([]pathSegment, error) {
+	var segments []pathSegment
+	for _, part := range strings.Split(path, ".") {
+		key, rest, _ := strings.Cut(part, "[")
+		if key == "" {
+			return nil, fmt.Errorf("empty key in %q", path)
+		}
+		segments = append(segments, pathSegment{key: key, index: -1})
+		for rest != "" {
+			idx, after, ok := strings.Cut(rest, "]")
+			n, err := strconv.Atoi(idx)
+			if !ok || err != nil || n < 0 {
+				return nil, fmt.Errorf("bad index in %q", path)
+			}
+			segments = append(segments, pathSegment{index: n})
+			rest = strings.TrimPrefix(after, "[")
+		}
+	}
+	return segments, nil
+}
+
+// checkPath reports paths that do not name a config field, so a typo in an
+// override is not silently ignored.
+func checkPath(t reflect.Type, segments []pathSegment) error {
+	for _, seg := range segments {
+		for t.Kind() == reflect.Pointer {
+			t = t.Elem()
+		}
+		switch {
+		case seg.index >= 0:
+			if t.Kind() != reflect.Slice {
+				return fmt.Errorf("[%d]: not a list", seg.index)
+			}
+			t = t.Elem()
+		case t.Kind() == reflect.Map:
+			t = t.Elem()
+		case t.Kind() == reflect.Struct:
+			field, ok := fieldByTag(t, seg.key)
+			if !ok {
+				return fmt.Errorf("unknown field %q", seg.key)
+			}
+			t = field.Type
+		default:
+			return fmt.Errorf("%q: %s has no fields", seg.key, t)
+		}
+	}
+	return nil
+}
+
+func fieldByTag(t reflect.Type, name string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if tag, _, _ := strings.Cut(field.Tag.Get("yaml"), ","); tag == name {
+			return field, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
@@ -0,0 +1,98 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func writeFile(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+func TestLoadConfigInterpolatesAndOverrides(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("PROXY_PORT", "18124")
+	t.Setenv("PROXY_MAX_CONCURRENT", "7")
+	secret := writeFile(t, dir, "password", "s3cret\n")
+	path := writeFile(t, dir, "config.yml", `
+listen_addr: ":${PROXY_PORT}"
+header_name: "${PROXY_HEADER:-X-User-Id}"
+max_concurrent: ${PROXY_MAX_CONCURRENT}
+server:
+  read_timeout: 5s
+replicas:
+  - name: "a"
+nodes:
+  - replica: "a"
+    address: "10.0.0.1:8123"
+backend_credentials:
+  readonly:
+    user: "reader"
+    password: "${file:`+secret+`}"
+`)
+
+	cfg, err := LoadConfig(path, "nodes[0].address=10.0.0.2:8123", "hedge.enabled=true", "nodes[1].replica=a")
+	require.NoError(t, err)
+	require.Equal(t, ":18124", cfg.ListenAddr)
+	require.Equal(t, "X-User-Id", cfg.HeaderName)
+	require.Equal(t, 7, cfg.MaxConcurrent)
+	require.Equal(t, "s3cret", cfg.BackendCredentials["readonly"].Password)
+	require.Equal(t, "10.0.0.2:8123", cfg.Nodes[0].Address)
+	require.Equal(t, "a", cfg.Nodes[1].Replica)
+	require.True(t, cfg.Hedge.Enabled)
+	// Defaults fill in what the file leaves out, also inside sections
+	require.Equal(t, 5*time.Second, cfg.Server.ReadTimeout)
+	require.Equal(t, 180*time.Second, cfg.Server.WriteTimeout)
+	require.Equal(t, 10*time.Second, cfg.QueueTimeout)
+
+	_, err = LoadConfig(path, "max_concurent=5")
+	require.ErrorContains(t, err, `unknown field "max_concurent"`)
+	os.Unsetenv("PROXY_PORT")
+	_, err = LoadConfig(path)
+	require.ErrorContains(t, err, "listen_addr: environment variable PROXY_PORT is not set")
+}
+
+func TestLoadConfigFormats(t *testing.T) {
+	dir := t.TempDir()
+	fromYAML, err := LoadConfig(writeFile(t, dir, "c.yml", `
+listen_addr: ":8080"
+queue_timeout: 30s
+replicas:
+  - name: "a"
+    labels: {role: "writer"}
+nodes:
+  - {replica: "a", address: "10.0.0.1:8123"}
+`))
+	require.NoError(t, err)
+	fromJSON, err := LoadConfig(writeFile(t, dir, "c.json", `{
+  "listen_addr": ":8080",
+  "queue_timeout": "30s",
+  "replicas": [{"name": "a", "labels": {"role": "writer"}}],
+  "nodes": [{"replica": "a", "address": "10.0.0.1:8123"}]
+}`))
+	require.NoError(t, err)
+	fromTOML, err := LoadConfig(writeFile(t, dir, "c.toml", `
+listen_addr = ":8080"
+queue_timeout = "30s"
+
+[[replicas]]
+name = "a"
+labels = { role = "writer" }
+
+[[nodes]]
+replica = "a"
+address = "10.0.0.1:8123"
+`))
+	require.NoError(t, err)
+
+	require.Equal(t, 30*time.Second, fromYAML.QueueTimeout)
+	require.Equal(t, fromYAML, fromJSON)
+	require.Equal(t, fromYAML, fromTOML)
+}
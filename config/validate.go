@@ -0,0 +1,320 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// FieldError is a problem with one config field.
+type FieldError struct {
+	Path    string // e.g. "nodes[2].replica"
+	Message string
+}
+
+func (e FieldError) Error() string {
+	return e.Path + ": " + e.Message
+}
+
+// ValidationErrors lists every problem found in a config.
+type ValidationErrors []FieldError
+
+func (e ValidationErrors) Error() string {
+	lines := make([]string, len(e))
+	for i, fe := range e {
+		lines[i] = fe.Error()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// validator collects errors while walking the config.
+type validator struct {
+	errs ValidationErrors
+}
+
+func (v *validator) addf(path, format string, args ...any) {
+	v.errs = append(v.errs, FieldError{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+// address checks a host:port value. Empty values are only reported when required.
+func (v *validator) address(path, addr string, required bool) {
+	if addr == "" {
+		if required {
+			v.addf(path, "is required")
+		}
+		return
+	}
+	if _, port, err := net.SplitHostPort(addr); err != nil {
+		v.addf(path, "%q is not a host:port address", addr)
+	} else if port == "" {
+		v.addf(path, "%q has no port", addr)
+	}
+}
+
+func (v *validator) oneOf(path, value string, allowed ...string) {
+	if value == "" {
+		return
+	}
+	for _, a := range allowed {
+		if value == a {
+			return
+		}
+	}
+	v.addf(path, "%q is not one of %s", value, strings.Join(allowed, ", "))
+}
+
+func (v *validator) notNegative(path string, value float64) {
+	if value < 0 {
+		v.addf(path, "must not be negative")
+	}
+}
+
+// server checks the timeouts of an HTTP listener.
+func (v *validator) server(path string, s ServerConfig) {
+	v.notNegative(path+".read_timeout", s.ReadTimeout.Seconds())
+	v.notNegative(path+".read_header_timeout", s.ReadHeaderTimeout.Seconds())
+	v.notNegative(path+".write_timeout", s.WriteTimeout.Seconds())
+	v.notNegative(path+".idle_timeout", s.IdleTimeout.Seconds())
+	if s.ReadTimeout > 0 && s.ReadHeaderTimeout > s.ReadTimeout {
+		v.addf(path+".read_header_timeout", "%s is longer than read_timeout (%s) and would never apply", s.ReadHeaderTimeout, s.ReadTimeout)
+	}
+}
+
+// transport checks connection settings toward nodes, with a replica's
+// overrides already merged in.
+func (v *validator) transport(path string, t TransportConfig, proxyTimeout time.Duration) {
+	v.notNegative(path+".dial_timeout", t.DialTimeout.Seconds())
+	v.notNegative(path+".tls_handshake_timeout", t.TLSHandshakeTimeout.Seconds())
+	v.notNegative(path+".response_header_timeout", t.ResponseHeaderTimeout.Seconds())
+	v.notNegative(path+".idle_conn_timeout", t.IdleConnTimeout.Seconds())
+	v.notNegative(path+".max_idle_conns_per_host", float64(t.MaxIdleConnsPerHost))
+	v.notNegative(path+".max_conns_per_host", float64(t.MaxConnsPerHost))
+	if t.MaxConnsPerHost > 0 && t.MaxIdleConnsPerHost > t.MaxConnsPerHost {
+		v.addf(path+".max_idle_conns_per_host", "%d is more than max_conns_per_host (%d)", t.MaxIdleConnsPerHost, t.MaxConnsPerHost)
+	}
+	if proxyTimeout > 0 && t.ResponseHeaderTimeout > proxyTimeout {
+		v.addf(path+".response_header_timeout", "%s is longer than proxy_timeout (%s) and would never apply", t.ResponseHeaderTimeout, proxyTimeout)
+	}
+}
+
+// Validate checks the config for missing, malformed and inconsistent values
+// and returns all problems found as ValidationErrors, or nil.
+func (c *Config) Validate() error {
+	v := &validator{}
+
+	// Listeners
+	v.address("listen_addr", c.ListenAddr, true)
+	v.address("admin_addr", c.AdminAddr, false)
+	v.address("native_listen_addr", c.NativeListenAddr, false)
+	v.oneOf("native_group_from", c.NativeGroupFrom, "user", "quota_key")
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		v.addf("tls", "cert_file and key_file must be set together")
+	}
+	if c.TLS.CertFile == "" && (c.TLS.ClientCAFile != "" || c.TLS.GroupFrom != "") {
+		v.addf("tls.cert_file", "is required with client_ca_file or group_from")
+	}
+	v.oneOf("tls.client_auth", c.TLS.ClientAuth, "require", "verify_if_given")
+	v.oneOf("tls.group_from", c.TLS.GroupFrom, "subject_cn", "san_dns", "san_email", "san_uri")
+	if c.TLS.GroupFrom != "" && c.TLS.ClientCAFile == "" {
+		v.addf("tls.group_from", "needs tls.client_ca_file to verify client certificates")
+	}
+	v.notNegative("shutdown_delay", c.ShutdownDelay.Seconds())
+	v.notNegative("drain_timeout", c.DrainTimeout.Seconds())
+	v.server("server", c.Server)
+	v.server("admin_server", c.AdminServer)
+
+	// Grouping and limits
+	if c.HeaderName == "" && !c.Auth.Enabled && c.TLS.GroupFrom == "" {
+		v.addf("header_name", "is required unless auth or tls.group_from provides the group key")
+	}
+	v.notNegative("max_concurrent", float64(c.MaxConcurrent))
+	v.notNegative("max_queue", float64(c.MaxQueue))
+	v.notNegative("queue_timeout", c.QueueTimeout.Seconds())
+	v.notNegative("proxy_timeout", c.ProxyTimeout.Seconds())
+	v.notNegative("slowdown_rate", c.SlowdownRate)
+	v.notNegative("slowdown_burst", float64(c.SlowdownBurst))
+	if c.SlowdownRate > 0 && c.SlowdownBurst == 0 {
+		v.addf("slowdown_burst", "must be at least 1 when slowdown_rate is set, or slowed down replicas accept nothing")
+	}
+
+	// Upstream responses must fit in the time the server gives to write them
+	if w := c.Server.WriteTimeout; w > 0 {
+		if c.ProxyTimeout > w {
+			v.addf("proxy_timeout", "%s is longer than server.write_timeout (%s), responses would be cut off", c.ProxyTimeout, w)
+		}
+		if c.Insert.Timeout > w {
+			v.addf("insert.timeout", "%s is longer than server.write_timeout (%s), responses would be cut off", c.Insert.Timeout, w)
+		}
+	}
+
+	// Topology
+	v.oneOf("replica_scheme", c.ReplicaScheme, "http", "https")
+	v.transport("transport", c.Transport, c.ProxyTimeout)
+	shards := make(map[string]bool)
+	for i, shard := range c.Shards {
+		path := fmt.Sprintf("shards[%d]", i)
+		if shard.Name == "" {
+			v.addf(path+".name", "is required")
+		} else if shards[shard.Name] {
+			v.addf(path+".name", "duplicate shard %q", shard.Name)
+		}
+		shards[shard.Name] = true
+	}
+	if len(c.Replicas) == 0 {
+		v.addf("replicas", "at least one replica is required")
+	}
+	replicas := make(map[string]int) // Name -> number of nodes
+	for i, replica := range c.Replicas {
+		path := fmt.Sprintf("replicas[%d]", i)
+		if replica.Name == "" {
+			v.addf(path+".name", "is required")
+			continue
+		}
+		if _, ok := replicas[replica.Name]; ok {
+			v.addf(path+".name", "duplicate replica %q", replica.Name)
+		}
+		replicas[replica.Name] = 0
+		if replica.Transport != nil {
+			v.transport(path+".transport", c.Transport.Merge(replica.Transport), c.ProxyTimeout)
+		}
+	}
+	addresses := make(map[string]bool)
+	for i, node := range c.Nodes {
+		path := fmt.Sprintf("nodes[%d]", i)
+		if n, ok := replicas[node.Replica]; !ok {
+			v.addf(path+".replica", "unknown replica %q", node.Replica)
+		} else {
+			replicas[node.Replica] = n + 1
+		}
+		if node.Shard != "" && !shards[node.Shard] {
+			v.addf(path+".shard", "unknown shard %q", node.Shard)
+		}
+		v.address(path+".address", node.Address, true)
+		if addresses[node.Address] && node.Address != "" {
+			v.addf(path+".address", "duplicate node address %q", node.Address)
+		}
+		addresses[node.Address] = true
+		v.address(path+".native_address", node.NativeAddress, c.NativeListenAddr != "")
+	}
+	for i, replica := range c.Replicas {
+		if n, ok := replicas[replica.Name]; ok && n == 0 && replica.Name != "" {
+			v.addf(fmt.Sprintf("replicas[%d]", i), "replica %q has no nodes", replica.Name)
+		}
+	}
+	labelsMatch := func(labels map[string]string) bool {
+		for _, replica := range c.Replicas {
+			matches := true
+			for k, want := range labels {
+				if replica.Labels[k] != want {
+					matches = false
+					break
+				}
+			}
+			if matches {
+				return true
+			}
+		}
+		return false
+	}
+
+	// Features
+	if c.Hedge.Enabled {
+		if c.Hedge.Percentile < 0 || c.Hedge.Percentile >= 1 {
+			v.addf("hedge.percentile", "must be between 0 and 1")
+		}
+		v.notNegative("hedge.budget_rate", c.Hedge.BudgetRate)
+	}
+	v.notNegative("insert.max_concurrent", float64(c.Insert.MaxConcurrent))
+	v.notNegative("insert.max_queue", float64(c.Insert.MaxQueue))
+	if len(c.Insert.ReplicaLabels) > 0 && !labelsMatch(c.Insert.ReplicaLabels) {
+		v.addf("insert.replica_labels", "no replica has these labels")
+	}
+	if c.Cache.Enabled {
+		v.oneOf("cache.store", c.Cache.Store, "memory", "disk")
+		if c.Cache.Store == "disk" && c.Cache.Dir == "" {
+			v.addf("cache.dir", "is required with store \"disk\"")
+		}
+		v.oneOf("cache.scope", c.Cache.Scope, "user", "group")
+		if len(c.Cache.Rules) == 0 {
+			v.addf("cache.rules", "no rules, nothing would be cached")
+		}
+		for i, rule := range c.Cache.Rules {
+			path := fmt.Sprintf("cache.rules[%d]", i)
+			if rule.TTL <= 0 {
+				v.addf(path+".ttl", "must be positive")
+			}
+			if _, err := regexp.Compile(rule.Match); err != nil {
+				v.addf(path+".match", "invalid regexp: %v", err)
+			}
+		}
+	}
+	classes := make(map[string]bool)
+	for i, class := range c.Classes {
+		path := fmt.Sprintf("classes[%d].name", i)
+		if class.Name == "" {
+			v.addf(path, "is required")
+		} else if classes[class.Name] {
+			v.addf(path, "duplicate class %q", class.Name)
+		}
+		classes[class.Name] = true
+	}
+	if c.DefaultClass != "" && !classes[c.DefaultClass] {
+		v.addf("default_class", "unknown class %q", c.DefaultClass)
+	}
+	if c.Auth.Enabled {
+		if len(c.Auth.Users) == 0 && c.Auth.TokenFile == "" && !c.Auth.JWT.Enabled {
+			v.addf("auth", "no users, token_file or jwt, every request would be rejected")
+		}
+		if c.Auth.JWT.Enabled && c.Auth.JWT.JWKSFile == "" && c.Auth.JWT.JWKSURL == "" {
+			v.addf("auth.jwt", "jwks_file or jwks_url is required")
+		}
+	}
+	v.notNegative("streaming.flush_interval", c.Streaming.FlushInterval.Seconds())
+	v.notNegative("streaming.write_idle_timeout", c.Streaming.WriteIdleTimeout.Seconds())
+	v.notNegative("streaming.progress_interval", c.Streaming.ProgressInterval.Seconds())
+	for i, long := range c.Streaming.LongQueries {
+		path := fmt.Sprintf("streaming.long_queries[%d]", i)
+		if len(long.Groups) == 0 && len(long.Users) == 0 && len(long.Classes) == 0 && len(long.Kinds) == 0 && long.Match == "" {
+			v.addf(path, "matches every query, set groups, users, classes, kinds or match")
+		}
+		for _, class := range long.Classes {
+			if !classes[class] {
+				v.addf(path+".classes", "unknown class %q", class)
+			}
+		}
+		if _, err := regexp.Compile(long.Match); err != nil {
+			v.addf(path+".match", "invalid regexp: %v", err)
+		}
+		v.notNegative(path+".timeout", long.Timeout.Seconds())
+	}
+	v.notNegative("policy_reload_interval", c.PolicyReloadInterval.Seconds())
+
+	// Observability
+	v.oneOf("log.level", strings.ToLower(c.Log.Level), "debug", "info", "warn", "warning", "error")
+	v.oneOf("log.format", c.Log.Format, "text", "json")
+	if c.Tracing.Enabled {
+		v.oneOf("tracing.exporter", c.Tracing.Exporter, "stdout", "json_file")
+		if c.Tracing.Exporter == "json_file" && c.Tracing.File == "" {
+			v.addf("tracing.file", "is required with exporter \"json_file\"")
+		}
+		if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+			v.addf("tracing.sample_ratio", "must be between 0 and 1")
+		}
+	}
+	if c.Audit.Enabled {
+		v.oneOf("audit.output", c.Audit.Output, "file", "clickhouse")
+		if (c.Audit.Output == "" || c.Audit.Output == "file") && c.Audit.File == "" {
+			v.addf("audit.file", "is required with output \"file\"")
+		}
+		if c.Audit.Output == "clickhouse" && c.Audit.Table == "" {
+			v.addf("audit.table", "is required with output \"clickhouse\"")
+		}
+	}
+
+	if len(v.errs) == 0 {
+		return nil
+	}
+	return v.errs
+}
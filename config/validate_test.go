@@ -0,0 +1,84 @@
+package config
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateExampleConfig(t *testing.T) {
+	cfg, err := LoadConfig("config.yml")
+	require.NoError(t, err)
+	require.NoError(t, cfg.Validate())
+}
+
+func TestValidateReportsEveryProblem(t *testing.T) {
+	cfg := &Config{
+		ListenAddr: ":8080",
+		HeaderName: "X-User-Id",
+		Shards:     []ShardConfig{{Name: "1"}},
+		Replicas:   []ReplicaConfig{{Name: "a"}, {Name: "b"}, {Name: "a"}},
+		Nodes: []NodeConfig{
+			{Replica: "a", Shard: "1", Address: "10.0.0.1:8123"},
+			{Replica: "missing", Shard: "2", Address: "10.0.0.2"},
+			{Replica: "a", Address: "10.0.0.1:8123"},
+		},
+		DefaultClass: "dashboards",
+		Log:          LogConfig{Format: "xml"},
+	}
+	err := cfg.Validate()
+	var fieldErrs ValidationErrors
+	require.True(t, errors.As(err, &fieldErrs))
+
+	paths := make(map[string]bool)
+	for _, fe := range fieldErrs {
+		paths[fe.Path] = true
+	}
+	require.Equal(t, map[string]bool{
+		"replicas[2].name": true, // Duplicate
+		"nodes[1].replica": true,
+		"nodes[1].shard":   true,
+		"nodes[1].address": true, // No port
+		"nodes[2].address": true, // Duplicate
+		"replicas[1]":      true, // No nodes
+		"default_class":    true,
+		"log.format":       true,
+	}, paths)
+}
+
+func TestValidateTimeoutConflicts(t *testing.T) {
+	cfg := Defaults()
+	cfg.ListenAddr = ":8080"
+	cfg.HeaderName = "X-User-Id"
+	cfg.Replicas = []ReplicaConfig{
+		{Name: "a", Transport: &TransportConfig{ResponseHeaderTimeout: 5 * time.Minute}},
+		{Name: "b", Transport: &TransportConfig{MaxConnsPerHost: 10}},
+	}
+	cfg.Nodes = []NodeConfig{{Replica: "a", Address: "10.0.0.1:8123"}, {Replica: "b", Address: "10.0.0.2:8123"}}
+	cfg.ProxyTimeout = 4 * time.Minute
+	cfg.Insert.Timeout = 10 * time.Minute
+	cfg.AdminServer.ReadHeaderTimeout = time.Minute
+
+	var fieldErrs ValidationErrors
+	require.True(t, errors.As(cfg.Validate(), &fieldErrs))
+	paths := make(map[string]bool)
+	for _, fe := range fieldErrs {
+		paths[fe.Path] = true
+	}
+	require.Equal(t, map[string]bool{
+		"proxy_timeout":                                 true, // Longer than server.write_timeout
+		"insert.timeout":                                true,
+		"admin_server.read_header_timeout":              true, // Longer than read_timeout
+		"replicas[0].transport.response_header_timeout": true, // Longer than proxy_timeout
+		"replicas[1].transport.max_idle_conns_per_host": true, // Default 100 is more than 10
+	}, paths)
+
+	// An unlimited write timeout leaves room for any upstream timeout
+	cfg.Server.WriteTimeout = 0
+	cfg.AdminServer.ReadHeaderTimeout = 0
+	cfg.Replicas[0].Transport = nil
+	cfg.Replicas[1].Transport.MaxIdleConnsPerHost = 10
+	require.NoError(t, cfg.Validate())
+}
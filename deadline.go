@@ -0,0 +1,63 @@
+// --- deadline.go --- (Request deadline propagation to ClickHouse)
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const errCodeTimeoutExceeded = 159
+
+// clientTimeout returns the timeout the client asked for, either in the
+// configured timeout header ("30s" or "30") or as max_execution_time.
+func (p *SimpleProxy) clientTimeout(r *http.Request) (time.Duration, bool) {
+	if p.config.TimeoutHeader != "" {
+		if d, ok := parseTimeout(r.Header.Get(p.config.TimeoutHeader)); ok {
+			return d, true
+		}
+	}
+	return parseTimeout(r.URL.Query().Get("max_execution_time"))
+}
+
+// requestDeadline returns when the upstream call must be finished: the
+// client timeout (or the upstream timeout if smaller) counted from arrival,
+// so time spent queued is not given again to ClickHouse.
+func (p *SimpleProxy) requestDeadline(r *http.Request, kind QueryKind, long *longQueryRule, startTime time.Time) time.Time {
+	budget := p.upstreamTimeout(kind, long)
+	if clientTimeout, ok := p.clientTimeout(r); ok && clientTimeout < budget {
+		budget = clientTimeout
+	}
+	return startTime.Add(budget)
+}
+
+// capExecutionTime lowers max_execution_time so ClickHouse stops working on a
+// query once the client will no longer see the result.
+func capExecutionTime(params url.Values, deadline time.Time) {
+	remaining := time.Until(deadline).Truncate(time.Second)
+	if remaining < time.Second {
+		remaining = time.Second
+	}
+	if current, ok := parseTimeout(params.Get("max_execution_time")); ok && current <= remaining {
+		return
+	}
+	params.Set("max_execution_time", strconv.Itoa(int(remaining.Seconds())))
+}
+
+// parseTimeout accepts a Go duration or a number of seconds. Zero and
+// negative values mean "no timeout" and are ignored.
+func parseTimeout(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		seconds, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return 0, false
+		}
+		d = time.Duration(seconds * float64(time.Second))
+	}
+	return d, d > 0
+}
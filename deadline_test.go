@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"clickhouse-test/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTimeout(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Duration
+		ok    bool
+	}{
+		{"", 0, false},
+		{"30s", 30 * time.Second, true},
+		{"1m30s", 90 * time.Second, true},
+		{"30", 30 * time.Second, true},
+		{"2.5", 2500 * time.Millisecond, true},
+		{"0", 0, false},
+		{"0s", 0, false},
+		{"-5", -5 * time.Second, false},
+		{"soon", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			d, ok := parseTimeout(tt.value)
+			require.Equal(t, tt.ok, ok)
+			if ok {
+				require.Equal(t, tt.want, d)
+			}
+		})
+	}
+}
+
+func TestRequestDeadline(t *testing.T) {
+	p := &SimpleProxy{
+		config: &config.Config{
+			TimeoutHeader: "X-Timeout",
+			Insert:        config.InsertConfig{Timeout: 5 * time.Minute},
+		},
+		proxyTimeout: time.Minute,
+	}
+	long := &longQueryRule{name: "reports", timeout: time.Hour}
+	tests := []struct {
+		name   string
+		header string
+		param  string
+		kind   QueryKind
+		long   *longQueryRule
+		want   time.Duration
+	}{
+		{"proxy timeout", "", "", QuerySelect, nil, time.Minute},
+		{"header", "10s", "", QuerySelect, nil, 10 * time.Second},
+		{"header in seconds", "10", "", QuerySelect, nil, 10 * time.Second},
+		{"header before max_execution_time", "10s", "20", QuerySelect, nil, 10 * time.Second},
+		{"invalid header falls back", "soon", "20", QuerySelect, nil, 20 * time.Second},
+		{"max_execution_time", "", "20", QuerySelect, nil, 20 * time.Second},
+		{"capped at proxy timeout", "10m", "", QuerySelect, nil, time.Minute},
+		{"unlimited max_execution_time", "", "0", QuerySelect, nil, time.Minute},
+		{"insert timeout", "", "", QueryInsert, nil, 5 * time.Minute},
+		{"long query timeout", "", "", QuerySelect, long, time.Hour},
+		{"client below long query timeout", "", "600", QuerySelect, long, 10 * time.Minute},
+	}
+	start := time.Now()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/?"+url.Values{"max_execution_time": {tt.param}}.Encode(), nil)
+			if tt.header != "" {
+				r.Header.Set("X-Timeout", tt.header)
+			}
+			require.Equal(t, start.Add(tt.want), p.requestDeadline(r, tt.kind, tt.long, start))
+		})
+	}
+}
+
+func TestCapExecutionTime(t *testing.T) {
+	tests := []struct {
+		name     string
+		current  string
+		deadline time.Duration // From now
+		want     string
+	}{
+		{"not set", "", 30*time.Second + 500*time.Millisecond, "30"},
+		{"lower kept", "10", 30*time.Second + 500*time.Millisecond, "10"},
+		{"higher lowered", "600", 30*time.Second + 500*time.Millisecond, "30"},
+		{"unlimited lowered", "0", 30*time.Second + 500*time.Millisecond, "30"},
+		{"at least a second", "", 100 * time.Millisecond, "1"},
+		{"deadline passed", "", -time.Second, "1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params := url.Values{}
+			if tt.current != "" {
+				params.Set("max_execution_time", tt.current)
+			}
+			capExecutionTime(params, time.Now().Add(tt.deadline))
+			require.Equal(t, tt.want, params.Get("max_execution_time"))
+		})
+	}
+}
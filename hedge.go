@@ -0,0 +1,344 @@
+// --- hedge.go --- (Hedged requests for read queries)
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"clickhouse-test/config"
+
+	"github.com/google/uuid"
+	"golang.org/x/time/rate"
+)
+
+const (
+	maxHedgeBody       = 64 * 1024 // Larger bodies are never hedged
+	minLatencySamples  = 20        // Samples needed before the percentile delay is used
+	latencyWindowSize  = 1000
+	killQueryTimeout   = 5 * time.Second
+	defaultHedgeDelay  = 1 * time.Second
+	defaultHedgeBudget = 1.0 // Hedged requests per second
+)
+
+// hedgeTransport sends a duplicate of a slow read query to a second replica
+// and returns whichever response arrives first. The losing attempt is
+// cancelled and its query is killed on the node it was sent to.
+type hedgeTransport struct {
+	proxy      *SimpleProxy
+	next       http.RoundTripper
+	delay      time.Duration
+	percentile float64
+	budget     *rate.Limiter
+	latencies  *latencyWindow
+}
+
+func newHedgeTransport(p *SimpleProxy, next http.RoundTripper, cfg config.HedgeConfig) *hedgeTransport {
+	delay := cfg.Delay
+	if delay <= 0 {
+		delay = defaultHedgeDelay
+	}
+	budgetRate := cfg.BudgetRate
+	if budgetRate <= 0 {
+		budgetRate = defaultHedgeBudget
+	}
+	budgetBurst := cfg.BudgetBurst
+	if budgetBurst <= 0 {
+		budgetBurst = 1
+	}
+	return &hedgeTransport{
+		proxy:      p,
+		next:       next,
+		delay:      delay,
+		percentile: cfg.Percentile,
+		budget:     rate.NewLimiter(rate.Limit(budgetRate), budgetBurst),
+		latencies:  newLatencyWindow(latencyWindowSize),
+	}
+}
+
+// hedgeAttempt is the outcome of one of the (at most two) upstream attempts.
+type hedgeAttempt struct {
+	resp    *http.Response
+	err     error
+	node    *Node
+	cancel  context.CancelFunc
+	release func() // Frees resources held by the attempt (e.g. the hedge's group slot)
+}
+
+func (h *hedgeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !GetQueryInfo(req.Context()).Kind.IsRead() {
+		return h.timedRoundTrip(req)
+	}
+	body, ok := readHedgeBody(req)
+	if !ok {
+		return h.timedRoundTrip(req)
+	}
+
+	// Both attempts must share a query_id so the loser can be killed.
+	queryID := req.URL.Query().Get("query_id")
+	if queryID == "" {
+		queryID = uuid.New().String()
+		q := req.URL.Query()
+		q.Set("query_id", queryID)
+		req.URL.RawQuery = q.Encode()
+	}
+
+	results := make(chan hedgeAttempt, 2)
+	start := func(node *Node, release func()) {
+		ctx, cancel := context.WithCancel(WithNode(req.Context(), node))
+		attemptReq := req.Clone(ctx)
+		h.proxy.directTo(attemptReq, node)
+		if body != nil {
+			attemptReq.Body = io.NopCloser(bytes.NewReader(body))
+			attemptReq.ContentLength = int64(len(body))
+		}
+		go func() {
+			resp, err := h.next.RoundTrip(attemptReq)
+			results <- hedgeAttempt{resp: resp, err: err, node: node, cancel: cancel, release: release}
+		}()
+	}
+
+	startTime := time.Now()
+	primary := GetNode(req.Context())
+	start(primary, func() {})
+	pending := 1
+
+	timer := time.NewTimer(h.hedgeDelay())
+	defer timer.Stop()
+
+	var first hedgeAttempt
+	select {
+	case first = <-results:
+		pending--
+	case <-timer.C:
+		if h.startHedge(req, primary, start) {
+			pending++
+		}
+		first = <-results
+		pending--
+	}
+
+	// If the first attempt failed and the other one is still running, give it a chance.
+	if first.err != nil && pending > 0 {
+		failed := first
+		first = <-results
+		pending--
+		failed.cancel()
+		failed.release()
+	}
+
+	if first.err == nil {
+		h.latencies.Add(time.Since(startTime))
+	}
+	if pending > 0 {
+		go h.discardLoser(results, req, queryID)
+	}
+	if first.err != nil {
+		first.cancel()
+		first.release()
+		return nil, first.err
+	}
+	if access := getAccessLog(req.Context()); access != nil {
+		access.node = first.node.Address // The hedge may have won
+	}
+	first.resp.Body = &hedgeBody{ReadCloser: first.resp.Body, done: func() {
+		first.cancel()
+		first.release()
+	}}
+	return first.resp, nil
+}
+
+// startHedge launches the duplicate attempt if the hedge budget, the group's
+// concurrency limit and the second replica's rate limiter all allow it.
+func (h *hedgeTransport) startHedge(req *http.Request, primary *Node, start func(*Node, func())) bool {
+	var exclude *Replica
+	if primary != nil {
+		exclude = primary.Replica
+	}
+	replica := h.proxy.selectReplicaExcept(exclude)
+	if replica == nil || !replica.Allow() {
+		return false
+	}
+	groupKey := GetGroupKey(req.Context())
+	limiter := h.proxy.groupLimiter(groupKey)
+	if !limiter.TryAcquire() {
+		return false
+	}
+	if !h.budget.Allow() {
+		limiter.Release()
+		return false
+	}
+	node := replica.NextNode()
+	slog.Info("Hedging request", "group", groupKey, "node", node.Address, "primary", primary.Address)
+	var once sync.Once
+	start(node, func() { once.Do(limiter.Release) })
+	return true
+}
+
+// discardLoser waits for the losing attempt, cancels it and kills its query.
+func (h *hedgeTransport) discardLoser(results <-chan hedgeAttempt, req *http.Request, queryID string) {
+	loser := <-results
+	loser.cancel()
+	if loser.resp != nil {
+		loser.resp.Body.Close()
+	}
+	loser.release()
+	h.killQuery(req, loser.node, queryID)
+}
+
+// killQuery asks the node to stop executing the given query. Credentials are
+// taken from the original request so the KILL runs as the same user.
+func (h *hedgeTransport) killQuery(orig *http.Request, node *Node, queryID string) {
+	ctx, cancel := context.WithTimeout(context.Background(), killQueryTimeout)
+	defer cancel()
+
+	params := url.Values{}
+	origParams := orig.URL.Query()
+	for _, name := range []string{"user", "password"} {
+		if v := origParams.Get(name); v != "" {
+			params.Set(name, v)
+		}
+	}
+	params.Set("query", fmt.Sprintf("KILL QUERY WHERE query_id = '%s' ASYNC", escapeString(queryID)))
+	u := *node.URL
+	u.Path = "/"
+	u.RawQuery = params.Encode()
+
+	ctx = WithIdentity(WithNode(ctx, node), GetIdentity(orig.Context()))
+	killReq, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), nil)
+	if err != nil {
+		slog.Warn("Failed to build KILL QUERY request", "node", node.Address, "err", err)
+		return
+	}
+	for _, name := range []string{"Authorization", "X-ClickHouse-User", "X-ClickHouse-Key", "User-Agent"} {
+		if v := orig.Header.Get(name); v != "" {
+			killReq.Header.Set(name, v)
+		}
+	}
+	// With proxy auth, the loser's replica may use different backend credentials.
+	h.proxy.applyCredentials(killReq, node)
+	resp, err := h.next.RoundTrip(killReq)
+	if err != nil {
+		slog.Warn("Failed to kill hedged query", "query_id", queryID, "node", node.Address, "err", err)
+		return
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		slog.Warn("Failed to kill hedged query", "query_id", queryID, "node", node.Address, "status", resp.Status)
+	}
+}
+
+// timedRoundTrip forwards a request that is not hedged, still recording its
+// latency so the percentile delay reflects all traffic.
+func (h *hedgeTransport) timedRoundTrip(req *http.Request) (*http.Response, error) {
+	startTime := time.Now()
+	resp, err := h.next.RoundTrip(req)
+	if err == nil {
+		h.latencies.Add(time.Since(startTime))
+	}
+	return resp, err
+}
+
+// hedgeDelay returns how long to wait for the first attempt before hedging.
+func (h *hedgeTransport) hedgeDelay() time.Duration {
+	if h.percentile > 0 {
+		if d, ok := h.latencies.Percentile(h.percentile); ok {
+			return d
+		}
+	}
+	return h.delay
+}
+
+// readHedgeBody buffers a small request body so it can be sent twice.
+// Returns false if the body is too large to hedge; the request body is
+// restored either way.
+func readHedgeBody(req *http.Request) ([]byte, bool) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, true
+	}
+	body, err := io.ReadAll(io.LimitReader(req.Body, maxHedgeBody+1))
+	if err != nil || len(body) > maxHedgeBody {
+		req.Body = readCloser{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+		return nil, false
+	}
+	req.Body.Close()
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	return body, true
+}
+
+// escapeString escapes a value for use inside a single-quoted SQL string.
+func escapeString(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s)
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// hedgeBody runs done once the winning response body is closed.
+type hedgeBody struct {
+	io.ReadCloser
+	once sync.Once
+	done func()
+}
+
+func (b *hedgeBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.done)
+	return err
+}
+
+// latencyWindow keeps the most recent response latencies.
+type latencyWindow struct {
+	mu      sync.Mutex
+	samples []time.Duration
+	next    int
+	full    bool
+}
+
+func newLatencyWindow(size int) *latencyWindow {
+	return &latencyWindow{samples: make([]time.Duration, size)}
+}
+
+func (w *latencyWindow) Add(d time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.samples[w.next] = d
+	w.next = (w.next + 1) % len(w.samples)
+	if w.next == 0 {
+		w.full = true
+	}
+}
+
+// Percentile returns the p-th percentile (0-1) of the recorded latencies.
+func (w *latencyWindow) Percentile(p float64) (time.Duration, bool) {
+	w.mu.Lock()
+	n := w.next
+	if w.full {
+		n = len(w.samples)
+	}
+	if n < minLatencySamples {
+		w.mu.Unlock()
+		return 0, false
+	}
+	sorted := make([]time.Duration, n)
+	copy(sorted, w.samples[:n])
+	w.mu.Unlock()
+
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	idx := int(p * float64(n-1))
+	if idx >= n {
+		idx = n - 1
+	}
+	return sorted[idx], true
+}
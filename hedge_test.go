@@ -0,0 +1,170 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"clickhouse-test/config"
+	"github.com/stretchr/testify/require"
+)
+
+// hedgeCluster is two ClickHouse stand-ins that record the queries and
+// KILL QUERY statements they receive.
+type hedgeCluster struct {
+	mu       sync.Mutex
+	arrivals []string            // Node name per query, in arrival order
+	queryIDs []string            // query_id per query, in arrival order
+	kills    map[string][]string // Node name -> query_ids killed there
+	slow     func(arrival int) bool
+}
+
+func newHedgeCluster(t *testing.T, hedge config.HedgeConfig, slow func(arrival int) bool) (*hedgeCluster, *SimpleProxy) {
+	c := &hedgeCluster{kills: make(map[string][]string), slow: slow}
+	cfg := &config.Config{
+		HeaderName:    "X-User-Id",
+		MaxConcurrent: 2,
+		MaxQueue:      2,
+		QueueTimeout:  time.Second,
+		Hedge:         hedge,
+	}
+	for _, name := range []string{"r1", "r2"} {
+		backend := httptest.NewServer(c.handler(name))
+		t.Cleanup(backend.Close)
+		cfg.Replicas = append(cfg.Replicas, config.ReplicaConfig{Name: name})
+		cfg.Nodes = append(cfg.Nodes, config.NodeConfig{Replica: name, Address: strings.TrimPrefix(backend.URL, "http://")})
+	}
+	p, err := NewSimpleProxy(cfg)
+	require.NoError(t, err)
+	return c, p
+}
+
+func (c *hedgeCluster) handler(name string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query().Get("query")
+		if strings.HasPrefix(query, "KILL QUERY") {
+			c.mu.Lock()
+			c.kills[name] = append(c.kills[name], query)
+			c.mu.Unlock()
+			return
+		}
+		c.mu.Lock()
+		arrival := len(c.arrivals)
+		c.arrivals = append(c.arrivals, name)
+		c.queryIDs = append(c.queryIDs, r.URL.Query().Get("query_id"))
+		c.mu.Unlock()
+		if c.slow(arrival) {
+			select {
+			case <-time.After(2 * time.Second):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		io.WriteString(w, name)
+	}
+}
+
+func (c *hedgeCluster) snapshot() (arrivals, queryIDs []string, kills map[string][]string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	kills = make(map[string][]string)
+	for k, v := range c.kills {
+		kills[k] = append([]string(nil), v...)
+	}
+	return append([]string(nil), c.arrivals...), append([]string(nil), c.queryIDs...), kills
+}
+
+func hedgeQuery(t *testing.T, p *SimpleProxy) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, "/?query=SELECT+1", nil)
+	r.Header.Set("X-User-Id", "a")
+	rw := httptest.NewRecorder()
+	p.ServeHTTP(rw, r)
+	return rw
+}
+
+var testHedgeConfig = config.HedgeConfig{Enabled: true, Delay: 50 * time.Millisecond, BudgetRate: 100, BudgetBurst: 10}
+
+func TestHedgePrimaryWins(t *testing.T) {
+	c, p := newHedgeCluster(t, testHedgeConfig, func(int) bool { return false })
+	rw := hedgeQuery(t, p)
+	require.Equal(t, http.StatusOK, rw.Code)
+
+	arrivals, _, kills := c.snapshot()
+	require.Len(t, arrivals, 1, "a fast primary is not hedged")
+	require.Equal(t, arrivals[0], rw.Body.String())
+	require.Empty(t, kills)
+}
+
+func TestHedgeWinsAndLoserIsKilled(t *testing.T) {
+	c, p := newHedgeCluster(t, testHedgeConfig, func(arrival int) bool { return arrival == 0 })
+	start := time.Now()
+	rw := hedgeQuery(t, p)
+	require.Equal(t, http.StatusOK, rw.Code)
+	require.Less(t, time.Since(start), time.Second)
+
+	arrivals, queryIDs, _ := c.snapshot()
+	require.Len(t, arrivals, 2)
+	require.NotEqual(t, arrivals[0], arrivals[1], "the hedge goes to the other replica")
+	require.Equal(t, arrivals[1], rw.Body.String())
+	require.NotEmpty(t, queryIDs[0])
+	require.Equal(t, queryIDs[0], queryIDs[1], "both attempts share the query_id")
+
+	// The access log (and with it the node health) names the node that served the request
+	nodes := make(map[string]string) // Replica name -> node address
+	for _, replica := range p.replicas {
+		nodes[replica.Name] = replica.Nodes[0].Address
+	}
+	p.status.mu.Lock()
+	require.Contains(t, p.status.nodes, nodes[arrivals[1]])
+	require.NotContains(t, p.status.nodes, nodes[arrivals[0]])
+	p.status.mu.Unlock()
+
+	// The slow primary is killed on its own node, by query_id
+	require.Eventually(t, func() bool {
+		_, _, kills := c.snapshot()
+		return len(kills[arrivals[0]]) == 1
+	}, time.Second, 10*time.Millisecond)
+	_, _, kills := c.snapshot()
+	require.Contains(t, kills[arrivals[0]][0], queryIDs[0])
+	require.Empty(t, kills[arrivals[1]])
+
+	// Both slots are given back, the hedge's once the loser is discarded
+	require.Eventually(t, func() bool {
+		active, _ := p.groupLimiter("a").Active()
+		return active == 0
+	}, time.Second, 10*time.Millisecond)
+
+	// Picking the hedge's replica does not move the round-robin on
+	rw = hedgeQuery(t, p)
+	require.Equal(t, arrivals[1], rw.Body.String())
+}
+
+func TestHedgeSkippedWithoutFreeSlot(t *testing.T) {
+	c, p := newHedgeCluster(t, testHedgeConfig, func(arrival int) bool { return arrival == 0 })
+	// Another request of the group holds the second slot
+	require.True(t, p.groupLimiter("a").TryAcquire())
+
+	hedgeQuery(t, p)
+	arrivals, _, kills := c.snapshot()
+	require.Len(t, arrivals, 1, "no slot left for a hedge")
+	require.Empty(t, kills)
+}
+
+func TestHedgeBudgetExhausted(t *testing.T) {
+	hedge := testHedgeConfig
+	hedge.BudgetRate, hedge.BudgetBurst = 0.001, 1
+	c, p := newHedgeCluster(t, hedge, func(arrival int) bool { return arrival == 0 || arrival == 2 })
+
+	hedgeQuery(t, p) // Primary slow, hedged: arrivals 0 and 1
+	rw := hedgeQuery(t, p)
+	require.Equal(t, http.StatusOK, rw.Code)
+
+	arrivals, _, _ := c.snapshot()
+	require.Len(t, arrivals, 3, "the second slow query finds no budget and is not hedged")
+	require.Equal(t, arrivals[2], rw.Body.String())
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"clickhouse-test/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInsertLimitsAndRouting(t *testing.T) {
+	var mu sync.Mutex
+	served := make(map[string][]string) // Node name -> queries
+	cfg := &config.Config{
+		HeaderName:    "X-User-Id",
+		MaxConcurrent: 2,
+		MaxQueue:      2,
+		QueueTimeout:  time.Second,
+		Insert: config.InsertConfig{
+			MaxConcurrent: 1,
+			QueueTimeout:  50 * time.Millisecond,
+			ReplicaLabels: map[string]string{"role": "writer"},
+		},
+	}
+	for _, replica := range []config.ReplicaConfig{
+		{Name: "reader", Labels: map[string]string{"role": "reader"}},
+		{Name: "writer", Labels: map[string]string{"role": "writer"}},
+	} {
+		name := replica.Name
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.Copy(io.Discard, r.Body)
+			mu.Lock()
+			served[name] = append(served[name], r.URL.Query().Get("query"))
+			mu.Unlock()
+		}))
+		defer backend.Close()
+		cfg.Replicas = append(cfg.Replicas, replica)
+		cfg.Nodes = append(cfg.Nodes, config.NodeConfig{Replica: name, Address: strings.TrimPrefix(backend.URL, "http://")})
+	}
+	p, err := NewSimpleProxy(cfg)
+	require.NoError(t, err)
+
+	send := func(query, body string) int {
+		r := httptest.NewRequest(http.MethodPost, "/?query="+strings.ReplaceAll(query, " ", "+"), strings.NewReader(body))
+		r.Header.Set("X-User-Id", "a")
+		rw := httptest.NewRecorder()
+		p.ServeHTTP(rw, r)
+		return rw.Code
+	}
+
+	// INSERTs only go to replicas labelled role=writer, SELECTs to all
+	for i := 0; i < 4; i++ {
+		require.Equal(t, http.StatusOK, send("INSERT INTO t FORMAT TSV", "1\n"))
+	}
+	for i := 0; i < 4; i++ {
+		require.Equal(t, http.StatusOK, send("SELECT 1", ""))
+	}
+	mu.Lock()
+	require.Len(t, served["reader"], 2)
+	require.Len(t, served["writer"], 6)
+	for _, query := range served["reader"] {
+		require.Equal(t, "SELECT 1", query)
+	}
+	mu.Unlock()
+
+	// INSERTs have their own limiter: with its slot taken, INSERTs time out
+	// in the queue while SELECTs of the same group still run
+	insertLimiter := p.limiterFor("a", QueryInsert)
+	require.NotSame(t, p.groupLimiter("a"), insertLimiter)
+	require.Same(t, p.groupLimiter("a"), p.limiterFor("a", QuerySelect))
+	require.True(t, insertLimiter.TryAcquire())
+	require.Equal(t, http.StatusTooManyRequests, send("INSERT INTO t FORMAT TSV", "1\n"))
+	require.Equal(t, http.StatusOK, send("SELECT 1", ""))
+	insertLimiter.Release()
+	require.Equal(t, http.StatusOK, send("INSERT INTO t FORMAT TSV", "1\n"))
+}
@@ -0,0 +1,336 @@
+// --- jwt.go --- (Bearer JWT validation against a JWKS)
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"clickhouse-test/config"
+)
+
+const (
+	defaultJWKSRefresh = 5 * time.Minute
+	jwksFetchTimeout   = 10 * time.Second
+	maxJWKSSize        = 1 * 1024 * 1024
+)
+
+// JWTValidator checks token signatures against the current JWKS and the
+// standard exp, nbf, iss and aud claims.
+type JWTValidator struct {
+	cfg    config.JWTConfig
+	keys   atomic.Pointer[map[string]crypto.PublicKey] // kid -> key
+	client *http.Client
+}
+
+func NewJWTValidator(cfg config.JWTConfig) (*JWTValidator, error) {
+	if cfg.JWKSFile == "" && cfg.JWKSURL == "" {
+		return nil, errors.New("jwt: jwks_file or jwks_url is required")
+	}
+	v := &JWTValidator{
+		cfg:    cfg,
+		client: &http.Client{Timeout: jwksFetchTimeout},
+	}
+	if err := v.Refresh(); err != nil {
+		return nil, fmt.Errorf("jwt: failed to load JWKS: %w", err)
+	}
+	return v, nil
+}
+
+// Refresh re-reads the JWKS from the file or URL.
+func (v *JWTValidator) Refresh() error {
+	var (
+		data []byte
+		err  error
+	)
+	if v.cfg.JWKSFile != "" {
+		data, err = os.ReadFile(v.cfg.JWKSFile)
+	} else {
+		data, err = v.fetchJWKS()
+	}
+	if err != nil {
+		return err
+	}
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return err
+	}
+	v.keys.Store(&keys)
+	return nil
+}
+
+func (v *JWTValidator) fetchJWKS() ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), jwksFetchTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.cfg.JWKSURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", v.cfg.JWKSURL, resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxJWKSSize))
+}
+
+// Watch refreshes the JWKS periodically so rotated keys are picked up. It
+// never returns.
+func (v *JWTValidator) Watch() {
+	interval := v.cfg.JWKSRefresh
+	if interval <= 0 {
+		interval = defaultJWKSRefresh
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := v.Refresh(); err != nil {
+			slog.Warn("Failed to refresh JWKS, keeping previous keys", "err", err)
+		}
+	}
+}
+
+// Validate verifies the token and returns its claims.
+func (v *JWTValidator) Validate(token string) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("invalid header: %w", err)
+	}
+	key, ok := (*v.keys.Load())[header.Kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key id %q", header.Kid)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature encoding: %w", err)
+	}
+	if err := verifySignature(header.Alg, key, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]any
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("invalid claims: %w", err)
+	}
+	if err := v.checkClaims(claims, time.Now()); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func (v *JWTValidator) checkClaims(claims map[string]any, now time.Time) error {
+	skew := v.cfg.ClockSkew
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return errors.New("token has no exp claim")
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(skew)) {
+		return errors.New("token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(skew).Before(time.Unix(int64(nbf), 0)) {
+		return errors.New("token not valid yet")
+	}
+	if v.cfg.Issuer != "" && claims["iss"] != v.cfg.Issuer {
+		return fmt.Errorf("unexpected issuer %v", claims["iss"])
+	}
+	if v.cfg.Audience != "" && !hasAudience(claims["aud"], v.cfg.Audience) {
+		return fmt.Errorf("token is not meant for audience %q", v.cfg.Audience)
+	}
+	return nil
+}
+
+// Identity maps the claims to an identity using the configured claim names.
+func (v *JWTValidator) Identity(claims map[string]any) (*Identity, error) {
+	groupClaim := v.cfg.GroupClaim
+	if groupClaim == "" {
+		groupClaim = "sub"
+	}
+	identity := &Identity{
+		Name:        claimString(claims, "sub"),
+		Group:       claimString(claims, groupClaim),
+		BackendUser: v.cfg.DefaultBackendUser,
+	}
+	if identity.Group == "" {
+		return nil, fmt.Errorf("token has no %q claim", groupClaim)
+	}
+	if v.cfg.UserClaim != "" {
+		if user := claimString(claims, v.cfg.UserClaim); user != "" {
+			identity.BackendUser = user
+		}
+	}
+	if v.cfg.ClassClaim != "" {
+		identity.Class = claimString(claims, v.cfg.ClassClaim)
+	}
+	if identity.Name == "" {
+		identity.Name = identity.Group
+	}
+	return identity, nil
+}
+
+func hasAudience(aud any, want string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == want
+	case []any:
+		for _, a := range aud {
+			if a == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func claimString(claims map[string]any, name string) string {
+	switch v := claims[name].(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return fmt.Sprintf("%.0f", v)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func decodeSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func verifySignature(alg string, key crypto.PublicKey, signed string, signature []byte) error {
+	if len(alg) != 5 {
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	var hash crypto.Hash
+	switch alg[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		switch {
+		case strings.HasPrefix(alg, "RS"):
+			if rsa.VerifyPKCS1v15(key, hash, digest, signature) != nil {
+				return errors.New("invalid signature")
+			}
+			return nil
+		case strings.HasPrefix(alg, "PS"):
+			if rsa.VerifyPSS(key, hash, digest, signature, nil) != nil {
+				return errors.New("invalid signature")
+			}
+			return nil
+		}
+	case *ecdsa.PublicKey:
+		if strings.HasPrefix(alg, "ES") {
+			size := (key.Curve.Params().BitSize + 7) / 8
+			if len(signature) != 2*size {
+				return errors.New("invalid signature")
+			}
+			r := new(big.Int).SetBytes(signature[:size])
+			s := new(big.Int).SetBytes(signature[size:])
+			if !ecdsa.Verify(key, digest, r, s) {
+				return errors.New("invalid signature")
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("algorithm %q does not match key type", alg)
+}
+
+// parseJWKS reads the RSA and EC keys of a JSON Web Key Set.
+func parseJWKS(data []byte) (map[string]crypto.PublicKey, error) {
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		switch k.Kty {
+		case "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(k.N)
+			e, errE := base64.RawURLEncoding.DecodeString(k.E)
+			if errN != nil || errE != nil {
+				return nil, fmt.Errorf("key %q: invalid RSA parameters", k.Kid)
+			}
+			keys[k.Kid] = &rsa.PublicKey{
+				N: new(big.Int).SetBytes(n),
+				E: int(new(big.Int).SetBytes(e).Int64()),
+			}
+		case "EC":
+			var curve elliptic.Curve
+			switch k.Crv {
+			case "P-256":
+				curve = elliptic.P256()
+			case "P-384":
+				curve = elliptic.P384()
+			case "P-521":
+				curve = elliptic.P521()
+			default:
+				return nil, fmt.Errorf("key %q: unsupported curve %q", k.Kid, k.Crv)
+			}
+			x, errX := base64.RawURLEncoding.DecodeString(k.X)
+			y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+			if errX != nil || errY != nil {
+				return nil, fmt.Errorf("key %q: invalid EC parameters", k.Kid)
+			}
+			keys[k.Kid] = &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no usable signing keys")
+	}
+	return keys, nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"clickhouse-test/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJWTValidator(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	jwks, err := json.Marshal(map[string]any{"keys": []map[string]string{{
+		"kty": "RSA",
+		"kid": "test",
+		"use": "sig",
+		"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}}})
+	require.NoError(t, err)
+	jwksFile := filepath.Join(t.TempDir(), "jwks.json")
+	require.NoError(t, os.WriteFile(jwksFile, jwks, 0o600))
+
+	validator, err := NewJWTValidator(config.JWTConfig{
+		Enabled:            true,
+		JWKSFile:           jwksFile,
+		Audience:           "clickhouse-proxy",
+		GroupClaim:         "team_id",
+		ClassClaim:         "tier",
+		DefaultBackendUser: "readonly",
+	})
+	require.NoError(t, err)
+
+	sign := func(claims map[string]any) string {
+		header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test", "typ": "JWT"})
+		payload, _ := json.Marshal(claims)
+		signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+		digest := sha256.Sum256([]byte(signed))
+		signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		require.NoError(t, err)
+		return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+	}
+	valid := map[string]any{
+		"sub":     "alice",
+		"team_id": 456,
+		"tier":    "dashboard",
+		"aud":     []string{"clickhouse-proxy"},
+		"exp":     time.Now().Add(time.Hour).Unix(),
+	}
+
+	claims, err := validator.Validate(sign(valid))
+	require.NoError(t, err)
+	identity, err := validator.Identity(claims)
+	require.NoError(t, err)
+	assert.Equal(t, &Identity{Name: "alice", Group: "456", BackendUser: "readonly", Class: "dashboard"}, identity)
+
+	expired := map[string]any{"sub": "alice", "team_id": "1", "aud": "clickhouse-proxy", "exp": time.Now().Add(-time.Hour).Unix()}
+	_, err = validator.Validate(sign(expired))
+	assert.ErrorContains(t, err, "expired")
+
+	otherAudience := map[string]any{"sub": "alice", "team_id": "1", "aud": "other", "exp": time.Now().Add(time.Hour).Unix()}
+	_, err = validator.Validate(sign(otherAudience))
+	assert.ErrorContains(t, err, "audience")
+
+	tampered := sign(valid)
+	tampered = tampered[:len(tampered)-4] + "AAAA"
+	_, err = validator.Validate(tampered)
+	assert.Error(t, err)
+}
@@ -4,7 +4,7 @@ package main
 import (
 	"context"
 	"errors"
-	"log"
+	"log/slog"
 	"time"
 )
 
@@ -68,19 +68,33 @@ func (gl *GroupLimiter) Acquire(ctx context.Context) error {
 	}
 }
 
+// TryAcquire takes a concurrency slot only if one is free right now.
+// It never queues; used for optional extra work such as hedged requests.
+func (gl *GroupLimiter) TryAcquire() bool {
+	select {
+	case gl.concurrency <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// Active returns the number of slots in use and the number of slots.
+func (gl *GroupLimiter) Active() (active, max int) {
+	return len(gl.concurrency), cap(gl.concurrency)
+}
+
+// Queued returns the number of requests waiting for a slot and the queue size.
+func (gl *GroupLimiter) Queued() (queued, max int) {
+	return len(gl.queue), cap(gl.queue)
+}
+
 // Release gives back the concurrency slot.
 func (gl *GroupLimiter) Release() {
-	// Check if concurrency channel is initialized and not nil
-	if gl.concurrency != nil {
-		// Check channel length to prevent blocking if called incorrectly
-		if len(gl.concurrency) < cap(gl.concurrency) {
-			<-gl.concurrency // Release slot
-		} else {
-			// Log or handle potential error: trying to release when full?
-			// This case shouldn't happen with proper Acquire/Release pairing.
-			log.Printf("Warning: Attempted to release concurrency slot when channel was potentially empty or logic error occurred.")
-		}
-	} else {
-		log.Printf("Warning: Attempted to release concurrency slot on a nil channel.")
+	select {
+	case <-gl.concurrency: // Release slot
+	default:
+		// This case shouldn't happen with proper Acquire/Release pairing.
+		slog.Warn("Attempted to release a concurrency slot that was not held")
 	}
 }
@@ -0,0 +1,200 @@
+// --- listeners.go --- (Listener inheritance for zero-downtime upgrades)
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Listener names, as used in LISTEN_FDNAMES. With systemd socket activation
+// set FileDescriptorName=proxy (admin, native) in the socket units; unnamed
+// descriptors are assigned in order: proxy first, then admin.
+const (
+	listenerProxy  = "proxy"
+	listenerAdmin  = "admin"
+	listenerNative = "native"
+)
+
+const (
+	// upgradeReadyEnv holds the descriptor a new process writes to once it serves.
+	upgradeReadyEnv = "PROXY_UPGRADE_READY_FD"
+	upgradeTimeout  = 30 * time.Second
+)
+
+// listenFDsStart is the first inherited descriptor, after stdin/stdout/stderr.
+// Tests move it past the descriptors the runtime already uses.
+var listenFDsStart = 3
+
+// inheritedListeners returns the listeners passed in by systemd socket
+// activation or by a previous proxy process handing over its sockets,
+// keyed by name. It returns nil when nothing was inherited.
+//
+// LISTEN_PID is checked when set; the handoff leaves it out because the
+// parent cannot know the child's pid before exec.
+func inheritedListeners() (map[string]net.Listener, error) {
+	defer func() {
+		// Don't pass the descriptors on to anything we start later
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return nil, nil
+	}
+	if pid := os.Getenv("LISTEN_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	positional := []string{listenerProxy, listenerAdmin}
+	listeners := make(map[string]net.Listener, count)
+	for i := 0; i < count; i++ {
+		fd := listenFDsStart + i
+		syscall.CloseOnExec(fd)
+		name := ""
+		if i < len(names) {
+			name = names[i]
+		}
+		if name != listenerProxy && name != listenerAdmin && name != listenerNative {
+			if i >= len(positional) {
+				slog.Warn("Ignoring inherited descriptor", "fd", fd, "name", name)
+				continue
+			}
+			name = positional[i]
+		}
+		f := os.NewFile(uintptr(fd), name)
+		l, err := net.FileListener(f)
+		f.Close() // FileListener works on a dup
+		if err != nil {
+			return nil, fmt.Errorf("inherited descriptor %d (%s): %w", fd, name, err)
+		}
+		listeners[name] = l
+	}
+	return listeners, nil
+}
+
+// listen returns the inherited listener with the given name, or a new one on addr.
+func listen(inherited map[string]net.Listener, name, addr string) (net.Listener, error) {
+	if l, ok := inherited[name]; ok {
+		slog.Info("Using inherited listener", "name", name, "addr", l.Addr().String())
+		return l, nil
+	}
+	return net.Listen("tcp", addr)
+}
+
+// notifyUpgradeReady tells the process that started us, if any, that we are
+// serving and it can start draining.
+func notifyUpgradeReady() {
+	value := os.Getenv(upgradeReadyEnv)
+	if value == "" {
+		return
+	}
+	os.Unsetenv(upgradeReadyEnv)
+	fd, err := strconv.Atoi(value)
+	if err != nil {
+		slog.Warn("Invalid upgrade ready descriptor", "env", upgradeReadyEnv, "value", value)
+		return
+	}
+	f := os.NewFile(uintptr(fd), "upgrade-ready")
+	defer f.Close()
+	if _, err := f.Write([]byte{1}); err != nil {
+		slog.Warn("Failed to notify previous process", "err", err)
+	}
+}
+
+// handOff starts a new proxy process from the current executable with the
+// given listeners and waits until it is serving. On error the new process is
+// killed and the caller keeps serving.
+func handOff(listeners map[string]net.Listener) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	var names []string
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, name := range []string{listenerProxy, listenerAdmin, listenerNative} {
+		l, ok := listeners[name]
+		if !ok {
+			continue
+		}
+		filer, ok := l.(interface{ File() (*os.File, error) })
+		if !ok {
+			return fmt.Errorf("%s listener cannot be passed on", name)
+		}
+		f, err := filer.File()
+		if err != nil {
+			return err
+		}
+		names = append(names, name)
+		files = append(files, f)
+	}
+
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer readyR.Close()
+	files = append(files, readyW)
+
+	env := make([]string, 0, len(os.Environ())+3)
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, "LISTEN_") && !strings.HasPrefix(kv, upgradeReadyEnv+"=") {
+			env = append(env, kv)
+		}
+	}
+	env = append(env,
+		"LISTEN_FDS="+strconv.Itoa(len(names)),
+		"LISTEN_FDNAMES="+strings.Join(names, ":"),
+		upgradeReadyEnv+"="+strconv.Itoa(listenFDsStart+len(names)),
+	)
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = env
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	slog.Info("Started new process, waiting for it to serve", "pid", cmd.Process.Pid)
+	// Close our copy of the write end so a read returns EOF if the child exits
+	readyW.Close()
+
+	ready := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 1)
+		if _, err := readyR.Read(buf); err != nil {
+			ready <- errors.New("new process exited before serving")
+			return
+		}
+		ready <- nil
+	}()
+	select {
+	case err = <-ready:
+	case <-time.After(upgradeTimeout):
+		err = fmt.Errorf("new process not serving after %s", upgradeTimeout)
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		go cmd.Wait()
+		return err
+	}
+	// The new process outlives us; don't leave it a zombie if we exit first
+	go cmd.Wait()
+	return nil
+}
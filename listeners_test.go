@@ -0,0 +1,135 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeInheritedFDs places the descriptors of new listeners at consecutive
+// numbers, as systemd or a previous process would, and returns their addresses.
+func fakeInheritedFDs(t *testing.T, count int) []string {
+	listenFDsStart = 200
+	t.Cleanup(func() { listenFDsStart = 3 })
+	addrs := make([]string, count)
+	for i := range addrs {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		f, err := l.(*net.TCPListener).File()
+		require.NoError(t, err)
+		require.NoError(t, syscall.Dup3(int(f.Fd()), listenFDsStart+i, 0))
+		f.Close()
+		l.Close()
+		addrs[i] = l.Addr().String()
+		fd := listenFDsStart + i
+		t.Cleanup(func() { syscall.Close(fd) }) // In case it was not inherited
+	}
+	return addrs
+}
+
+func TestInheritedListeners(t *testing.T) {
+	tests := []struct {
+		name  string
+		fds   int
+		env   map[string]string
+		want  map[string]int // Listener name -> index of its descriptor
+		empty bool
+	}{
+		{"named", 3, map[string]string{"LISTEN_FDNAMES": "native:admin:proxy"}, map[string]int{"native": 0, "admin": 1, "proxy": 2}, false},
+		{"positional", 2, nil, map[string]int{"proxy": 0, "admin": 1}, false},
+		{"unknown names are positional", 2, map[string]string{"LISTEN_FDNAMES": "http:admin"}, map[string]int{"proxy": 0, "admin": 1}, false},
+		{"extra descriptor ignored", 3, nil, map[string]int{"proxy": 0, "admin": 1}, false},
+		{"our pid", 1, map[string]string{"LISTEN_PID": strconv.Itoa(os.Getpid())}, map[string]int{"proxy": 0}, false},
+		{"other pid", 1, map[string]string{"LISTEN_PID": "1"}, nil, true},
+		{"no descriptors", 0, nil, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addrs := fakeInheritedFDs(t, tt.fds)
+			t.Setenv("LISTEN_FDS", strconv.Itoa(tt.fds))
+			t.Setenv("LISTEN_PID", "")
+			t.Setenv("LISTEN_FDNAMES", "")
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+
+			listeners, err := inheritedListeners()
+			require.NoError(t, err)
+			for _, l := range listeners {
+				defer l.Close()
+			}
+			if tt.empty {
+				require.Empty(t, listeners)
+			} else {
+				got := make(map[string]string, len(listeners))
+				for name, l := range listeners {
+					got[name] = l.Addr().String()
+				}
+				want := make(map[string]string, len(tt.want))
+				for name, i := range tt.want {
+					want[name] = addrs[i]
+				}
+				require.Equal(t, want, got)
+			}
+
+			// Not passed on to processes started later
+			for _, key := range []string{"LISTEN_FDS", "LISTEN_PID", "LISTEN_FDNAMES"} {
+				_, set := os.LookupEnv(key)
+				require.False(t, set, key)
+			}
+		})
+	}
+}
+
+func TestInheritedListenerAccepts(t *testing.T) {
+	addrs := fakeInheritedFDs(t, 1)
+	t.Setenv("LISTEN_FDS", "1")
+	t.Setenv("LISTEN_FDNAMES", "proxy")
+	listeners, err := inheritedListeners()
+	require.NoError(t, err)
+	l, err := listen(listeners, listenerProxy, "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	require.Equal(t, addrs[0], l.Addr().String())
+
+	go func() {
+		if conn, err := l.Accept(); err == nil {
+			conn.Write([]byte{1})
+			conn.Close()
+		}
+	}()
+	conn, err := net.Dial("tcp", addrs[0])
+	require.NoError(t, err)
+	defer conn.Close()
+	buf := make([]byte, 1)
+	_, err = conn.Read(buf)
+	require.NoError(t, err)
+
+	// Not inherited: a new listener on the address
+	admin, err := listen(listeners, listenerAdmin, "127.0.0.1:0")
+	require.NoError(t, err)
+	admin.Close()
+}
+
+func TestNotifyUpgradeReady(t *testing.T) {
+	r, w, err := os.Pipe()
+	require.NoError(t, err)
+	defer r.Close()
+	// A descriptor of its own, as notifyUpgradeReady closes it
+	fd, err := syscall.Dup(int(w.Fd()))
+	require.NoError(t, err)
+	w.Close()
+	t.Setenv(upgradeReadyEnv, strconv.Itoa(fd))
+	notifyUpgradeReady()
+
+	buf := make([]byte, 2)
+	n, err := r.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	_, set := os.LookupEnv(upgradeReadyEnv)
+	require.False(t, set)
+}
@@ -0,0 +1,201 @@
+// --- logging.go --- (slog setup and the per-request access log)
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"clickhouse-test/config"
+)
+
+// newLogger builds the process logger from the log config.
+func newLogger(cfg config.LogConfig) (*slog.Logger, error) {
+	var level slog.Level
+	switch strings.ToLower(cfg.Level) {
+	case "debug":
+		level = slog.LevelDebug
+	case "", "info":
+		level = slog.LevelInfo
+	case "warn", "warning":
+		level = slog.LevelWarn
+	case "error":
+		level = slog.LevelError
+	default:
+		return nil, fmt.Errorf("unknown log level %q", cfg.Level)
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	switch cfg.Format {
+	case "", "text":
+		return slog.New(slog.NewTextHandler(os.Stderr, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(os.Stderr, opts)), nil
+	default:
+		return nil, fmt.Errorf("unknown log format %q", cfg.Format)
+	}
+}
+
+// fatal logs an error and exits, for startup failures.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// Reasons a request was answered by the proxy instead of ClickHouse.
+const (
+	rejectUnauthenticated = "unauthenticated"
+	rejectMissingGroup    = "missing_group"
+	rejectPolicy          = "policy"
+	rejectSettings        = "settings"
+	rejectQueueFull       = "queue_full"
+	rejectQueueTimeout    = "queue_timeout"
+	rejectCanceled        = "canceled"
+	rejectNoReplica       = "no_replica"
+	rejectRateLimited     = "rate_limited"
+	rejectDeadline        = "deadline"
+)
+
+// rejectReason returns the reason logged for a failed slot acquisition.
+func rejectReason(err error) string {
+	switch {
+	case errors.Is(err, ErrQueueFull):
+		return rejectQueueFull
+	case errors.Is(err, ErrQueueTimeout):
+		return rejectQueueTimeout
+	default:
+		return rejectCanceled
+	}
+}
+
+// accessLog collects what happened to one request. It is written as a single
+// line when the request ends.
+type accessLog struct {
+	rw          *accessLogWriter
+	r           *http.Request
+	start       time.Time
+	groupKey    string
+	user        string
+	kind        QueryKind
+	query       string // Query text as classified, for the audit log
+	truncated   bool   // query is only the start of a longer statement
+	node        string
+	queueWait   time.Duration // Waiting for a group slot and the replica rate limiter
+	upstream    time.Duration // From sending to ClickHouse until the response was copied
+	rejected    string        // Why the proxy answered itself, if it did
+	shared      string        // "cache" or "coalesced" if no own execution was needed
+	traceID     string        // Set when the request is traced
+	upstreamErr string        // Why the upstream call failed, if it did
+	aborted     bool          // The response copy was cut off midway
+	longQuery   string        // Name of the matching streaming.long_queries rule
+
+	// Exception found at the end of the response body, also after a 200
+	exceptionCode int
+	exception     string
+}
+
+func newAccessLog(rw http.ResponseWriter, r *http.Request, start time.Time) *accessLog {
+	return &accessLog{rw: &accessLogWriter{ResponseWriter: rw}, r: r, start: start}
+}
+
+func (l *accessLog) reject(reason string) {
+	l.rejected = reason
+}
+
+// queryID returns the ClickHouse query id, as reported by ClickHouse or
+// else as chosen by the client.
+func (l *accessLog) queryID() string {
+	if queryID := l.rw.Header().Get("X-ClickHouse-Query-Id"); queryID != "" {
+		return queryID
+	}
+	return l.r.URL.Query().Get("query_id")
+}
+
+// clickhouseException returns the exception ClickHouse reported, from the
+// response body or else from the X-ClickHouse-Exception-Code header.
+func (l *accessLog) clickhouseException() (code int, message string) {
+	if l.exception != "" {
+		return l.exceptionCode, l.exception
+	}
+	code, _ = strconv.Atoi(l.rw.Header().Get("X-ClickHouse-Exception-Code"))
+	return code, ""
+}
+
+func (l *accessLog) statusCode() int {
+	if l.rw.statusCode == 0 {
+		return http.StatusOK
+	}
+	return l.rw.statusCode
+}
+
+func (l *accessLog) write() {
+	queryID, statusCode := l.queryID(), l.statusCode()
+	attrs := []slog.Attr{
+		slog.String("group", l.groupKey),
+		slog.String("user", l.user),
+		slog.String("remote", l.r.RemoteAddr),
+		slog.String("method", l.r.Method),
+		slog.String("kind", l.kind.String()),
+		slog.String("query_id", queryID),
+		slog.String("node", l.node),
+		slog.Int("status", statusCode),
+		slog.Int64("bytes", l.rw.bytes),
+		slog.Duration("queue_wait", l.queueWait),
+		slog.Duration("upstream", l.upstream),
+		slog.Duration("duration", time.Since(l.start)),
+	}
+	if l.rejected != "" {
+		attrs = append(attrs, slog.String("rejected", l.rejected))
+	}
+	if l.shared != "" {
+		attrs = append(attrs, slog.String("shared", l.shared))
+	}
+	if code, _ := l.clickhouseException(); code != 0 {
+		attrs = append(attrs, slog.Int("exception_code", code))
+	}
+	if l.longQuery != "" {
+		attrs = append(attrs, slog.String("long_query", l.longQuery))
+	}
+	if l.traceID != "" {
+		attrs = append(attrs, slog.String("trace_id", l.traceID))
+	}
+	slog.LogAttrs(l.r.Context(), slog.LevelInfo, "request", attrs...)
+}
+
+// accessLogWriter records the status and size of the response.
+type accessLogWriter struct {
+	http.ResponseWriter
+	statusCode int
+	bytes      int64
+}
+
+func (w *accessLogWriter) WriteHeader(statusCode int) {
+	if w.statusCode == 0 {
+		w.statusCode = statusCode
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *accessLogWriter) Write(b []byte) (int, error) {
+	if w.statusCode == 0 {
+		w.statusCode = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the client connection (flushes).
+func (w *accessLogWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *accessLogWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -3,64 +3,292 @@ package main
 
 import (
 	"clickhouse-test/config"
+	"context"
 	"errors"
 	"flag"
-	"log"
+	"fmt"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
-
-	"gopkg.in/yaml.v3" // Example using YAML, adjust as needed
 )
 
 func main() {
-	configPath := flag.String("config", "config/config.yml", "Path to config file")
-	flag.Parse()
-	configData, err := os.ReadFile(*configPath)
-	if err != nil {
-		log.Fatalf("Error reading config file %s: %v", *configPath, err)
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "policy":
+			os.Exit(runPolicyCommand(os.Args[2:]))
+		case "check":
+			os.Exit(runCheckCommand(os.Args[2:]))
+		}
 	}
 
-	// Set defaults
-	cfg := config.Config{
-		ReplicaScheme: "http",
-		QueueTimeout:  10 * time.Second,
-		SlowdownRate:  1.0,
-		SlowdownBurst: 1,
+	configPath := flag.String("config", "config/config.yml", "Path to config file (YAML, JSON or TOML)")
+	var overrides stringsFlag
+	flag.Var(&overrides, "set", "Override a config value, e.g. -set max_concurrent=5 (repeatable)")
+	flag.Parse()
+	cfg, err := config.LoadConfig(*configPath, overrides...)
+	if err != nil {
+		fatal("Error loading config file", "file", *configPath, "err", err)
 	}
-
-	err = yaml.Unmarshal(configData, &cfg)
+	logger, err := newLogger(cfg.Log)
 	if err != nil {
-		log.Fatalf("Error parsing config file %s: %v", *configPath, err)
+		fatal("Invalid log config", "err", err)
 	}
+	slog.SetDefault(logger)
 
 	// --- Validate Config ---
-	if cfg.ListenAddr == "" || cfg.HeaderName == "" || len(cfg.Replicas) == 0 {
-		log.Fatalf("listen_addr, header_name, and replicas are required in config")
+	if err := cfg.Validate(); err != nil {
+		var fieldErrs config.ValidationErrors
+		if errors.As(err, &fieldErrs) {
+			for _, fe := range fieldErrs {
+				slog.Error("Invalid config", "field", fe.Path, "err", fe.Message)
+			}
+		}
+		fatal("Config has errors, see above or run the check subcommand", "file", *configPath)
 	}
-	if cfg.SlowdownError == "" && cfg.SlowdownCode == 0 {
-		log.Printf("Warning: Neither slowdown_error nor slowdown_code is set. Replica slowdown will not be triggered.")
+	if cfg.SlowdownError == "" && len(cfg.SlowdownErrors) == 0 && cfg.SlowdownCode == 0 && len(cfg.SlowdownExceptionCodes) == 0 {
+		slog.Warn("None of slowdown_error, slowdown_errors, slowdown_code or slowdown_exception_codes is set. Replica slowdown will not be triggered.")
+	}
+	slog.Info("Config loaded", "listen", cfg.ListenAddr, "header", cfg.HeaderName,
+		"max_concurrent", cfg.MaxConcurrent, "max_queue", cfg.MaxQueue, "replicas", len(cfg.Replicas))
+
+	// --- Setup Tracing ---
+	shutdownTracing := func(context.Context) error { return nil }
+	if cfg.Tracing.Enabled {
+		if shutdownTracing, err = setupTracing(cfg.Tracing); err != nil {
+			fatal("Failed to set up tracing", "err", err)
+		}
 	}
-	log.Printf("Config loaded: Listen=%s Header=%s Concurrent=%d Queue=%d Replicas=%d",
-		cfg.ListenAddr, cfg.HeaderName, cfg.MaxConcurrent, cfg.MaxQueue, len(cfg.Replicas))
 
 	// --- Setup Proxy ---
-	proxy, err := NewSimpleProxy(&cfg)
+	proxy, err := NewSimpleProxy(cfg)
 	if err != nil {
-		log.Fatalf("Failed to create proxy: %v", err)
+		fatal("Failed to create proxy", "err", err)
 	}
 
 	// --- Start Server ---
 	server := &http.Server{
-		Addr:         cfg.ListenAddr,
-		Handler:      proxy,
-		ReadTimeout:  10 * time.Second,
-		WriteTimeout: 180 * time.Second, // Allow time for long queries
-		IdleTimeout:  200 * time.Second,
+		Handler:           proxy,
+		ReadTimeout:       cfg.Server.ReadTimeout,
+		ReadHeaderTimeout: cfg.Server.ReadHeaderTimeout,
+		WriteTimeout:      cfg.Server.WriteTimeout, // Allow time for long queries
+		IdleTimeout:       cfg.Server.IdleTimeout,
+	}
+
+	if cfg.TLS.CertFile != "" {
+		server.TLSConfig, err = newListenerTLSConfig(cfg.TLS)
+		if err != nil {
+			fatal("Failed to configure TLS", "err", err)
+		}
+	}
+
+	// --- Listeners (inherited on upgrade or with systemd socket activation) ---
+	inherited, err := inheritedListeners()
+	if err != nil {
+		fatal("Failed to use inherited listeners", "err", err)
+	}
+	listeners := make(map[string]net.Listener)
+	listeners[listenerProxy], err = listen(inherited, listenerProxy, cfg.ListenAddr)
+	if err != nil {
+		fatal("Failed to listen", "addr", cfg.ListenAddr, "err", err)
+	}
+
+	// --- Admin Server (readiness for load balancers) ---
+	var adminServer *http.Server
+	if cfg.AdminAddr != "" {
+		listeners[listenerAdmin], err = listen(inherited, listenerAdmin, cfg.AdminAddr)
+		if err != nil {
+			fatal("Failed to listen", "addr", cfg.AdminAddr, "err", err)
+		}
+		adminServer = &http.Server{
+			Handler:           newAdminHandler(proxy),
+			ReadTimeout:       cfg.AdminServer.ReadTimeout,
+			ReadHeaderTimeout: cfg.AdminServer.ReadHeaderTimeout,
+			WriteTimeout:      cfg.AdminServer.WriteTimeout,
+			IdleTimeout:       cfg.AdminServer.IdleTimeout,
+		}
+		go func() {
+			slog.Info("Starting admin server", "addr", listeners[listenerAdmin].Addr().String())
+			if err := adminServer.Serve(listeners[listenerAdmin]); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				fatal("Admin server failed", "err", err)
+			}
+		}()
+	}
+
+	// --- Native Protocol Server ---
+	var native *NativeProxy
+	if cfg.NativeListenAddr != "" {
+		native, err = NewNativeProxy(proxy)
+		if err != nil {
+			fatal("Failed to create native proxy", "err", err)
+		}
+		listeners[listenerNative], err = listen(inherited, listenerNative, cfg.NativeListenAddr)
+		if err != nil {
+			fatal("Failed to listen", "addr", cfg.NativeListenAddr, "err", err)
+		}
+		go func() {
+			slog.Info("Starting native protocol proxy", "addr", listeners[listenerNative].Addr().String())
+			if err := native.Serve(listeners[listenerNative]); err != nil {
+				fatal("Native server failed", "err", err)
+			}
+		}()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	upgrade := make(chan os.Signal, 1)
+	signal.Notify(upgrade, syscall.SIGUSR2)
+
+	serveErr := make(chan error, 1)
+	go func() {
+		slog.Info("Starting simple ClickHouse proxy", "addr", listeners[listenerProxy].Addr().String(), "tls", server.TLSConfig != nil)
+		if server.TLSConfig != nil {
+			// Certificates come from TLSConfig.GetCertificate so they can be reloaded.
+			serveErr <- server.ServeTLS(listeners[listenerProxy], "", "")
+		} else {
+			serveErr <- server.Serve(listeners[listenerProxy])
+		}
+	}()
+	notifyUpgradeReady()
+
+	// --- An explicit 0 would abort every request at once; use the default ---
+	drainTimeout := cfg.DrainTimeout
+	if drainTimeout <= 0 {
+		drainTimeout = config.Defaults().DrainTimeout
+		slog.Info("Drain timeout not configured, using default", "drain_timeout", drainTimeout)
+	}
+	for {
+		select {
+		case err := <-serveErr:
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				fatal("Server failed", "err", err)
+			}
+		case <-upgrade:
+			// SIGUSR2: hand the listeners to a new process started from the
+			// (possibly replaced) executable, then drain this one.
+			if err := handOff(listeners); err != nil {
+				slog.Error("Upgrade failed, continuing to serve", "err", err)
+				continue
+			}
+			slog.Info("New process is serving, draining this one")
+			if adminServer != nil {
+				// The new process answers readiness checks on the shared socket
+				adminServer.Close()
+			}
+			// The listeners stay open in the new process, no delay needed
+			shutdown(server, native, proxy, 0, drainTimeout)
+		case <-ctx.Done():
+			stop() // A second signal terminates immediately
+			shutdown(server, native, proxy, cfg.ShutdownDelay, drainTimeout)
+		}
+		break
+	}
+	if adminServer != nil {
+		adminServer.Close()
+	}
+	// Write the audit records and export the spans still held in memory
+	flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if proxy.audit != nil {
+		if err := proxy.audit.Close(flushCtx); err != nil {
+			slog.Warn("Failed to write audit records", "err", err)
+		}
+	}
+	if err := shutdownTracing(flushCtx); err != nil {
+		slog.Warn("Failed to flush traces", "err", err)
+	}
+}
+
+// shutdown fails readiness checks and keeps serving for delay, so load
+// balancers notice and stop sending new requests. It then stops accepting
+// connections and waits up to drainTimeout for running and queued requests
+// and native connections. Whatever is still running after that is aborted.
+func shutdown(server *http.Server, native *NativeProxy, proxy *SimpleProxy, delay, drainTimeout time.Duration) {
+	proxy.StartDraining()
+	if delay > 0 {
+		slog.Info("Shutting down, failing readiness checks before closing the listener", "delay", delay)
+		time.Sleep(delay)
+	}
+	inFlight, queued := proxy.InFlight()
+	slog.Info("Shutting down, draining requests", "in_flight", inFlight, "queued", queued, "timeout", drainTimeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	nativeAborted := make(chan int, 1)
+	go func() {
+		if native == nil {
+			nativeAborted <- 0
+			return
+		}
+		nativeAborted <- native.Shutdown(ctx)
+	}()
+	if err := server.Shutdown(ctx); err == nil {
+		slog.Info("All requests drained")
+	} else {
+		inFlight, queued = proxy.InFlight()
+		slog.Warn("Drain timeout exceeded, aborting requests", "aborted", inFlight, "queued", queued)
+		server.Close()
+	}
+	if aborted := <-nativeAborted; aborted > 0 {
+		slog.Warn("Drain timeout exceeded, aborted native connections", "aborted", aborted)
+	}
+}
+
+// stringsFlag collects the values of a repeated flag.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ", ")
+}
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// runPolicyCommand checks a query against a policy file without starting the proxy:
+//
+//	clickhouse-proxy policy -file config/policy.yml -group 123 "DROP TABLE t"
+func runPolicyCommand(args []string) int {
+	fs := flag.NewFlagSet("policy", flag.ExitOnError)
+	policyPath := fs.String("file", "config/policy.yml", "Path to policy file")
+	group := fs.String("group", "", "Group key (header value) of the request")
+	user := fs.String("user", "default", "ClickHouse user of the request")
+	database := fs.String("database", "", "Current database of the request")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: policy [flags] QUERY")
+		fs.PrintDefaults()
+		return 2
+	}
+
+	policyCfg, err := config.LoadPolicy(*policyPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading policy file %s: %v\n", *policyPath, err)
+		return 2
+	}
+	policy, err := NewPolicy(policyCfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid policy file %s: %v\n", *policyPath, err)
+		return 2
 	}
 
-	log.Printf("Starting simple ClickHouse proxy on %s...", cfg.ListenAddr)
-	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
-		log.Fatalf("Server failed: %v", err)
+	query := fs.Arg(0)
+	violation := policy.Check(PolicyRequest{
+		Group:    *group,
+		User:     *user,
+		Database: *database,
+		Query:    QueryInfo{Kind: ClassifyQuery(query), Query: query},
+	})
+	if violation != nil {
+		fmt.Printf("REJECTED: %v\n", violation)
+		return 1
 	}
+	fmt.Println("ALLOWED")
+	return 0
 }
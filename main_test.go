@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"clickhouse-test/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShutdownDelay(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer backend.Close()
+	p, err := NewSimpleProxy(&config.Config{
+		HeaderName:    "X-User-Id",
+		MaxConcurrent: 2,
+		MaxQueue:      2,
+		QueueTimeout:  time.Second,
+		Replicas:      []config.ReplicaConfig{{Name: "r1"}},
+		Nodes:         []config.NodeConfig{{Replica: "r1", Address: strings.TrimPrefix(backend.URL, "http://")}},
+	})
+	require.NoError(t, err)
+	admin := httptest.NewServer(newAdminHandler(p))
+	defer admin.Close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := &http.Server{Handler: p}
+	go server.Serve(listener)
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	query := func() (int, error) {
+		req, err := http.NewRequest(http.MethodGet, "http://"+listener.Addr().String()+"/?query=SELECT+1", nil)
+		require.NoError(t, err)
+		req.Header.Set("X-User-Id", "a")
+		resp, err := client.Do(req)
+		if err != nil {
+			return 0, err
+		}
+		resp.Body.Close()
+		return resp.StatusCode, nil
+	}
+	ready := func() int {
+		resp, err := client.Get(admin.URL + "/ready")
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	require.Equal(t, http.StatusOK, ready())
+
+	const delay = 300 * time.Millisecond
+	start := time.Now()
+	done := make(chan struct{})
+	go func() {
+		shutdown(server, nil, p, delay, time.Second)
+		close(done)
+	}()
+
+	// Readiness fails right away, while new requests are still served
+	require.Eventually(t, func() bool { return ready() == http.StatusServiceUnavailable }, delay/2, 5*time.Millisecond)
+	code, err := query()
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, code)
+
+	<-done
+	require.GreaterOrEqual(t, time.Since(start), delay)
+	_, err = query()
+	require.Error(t, err, "the listener is closed after the delay")
+}
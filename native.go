@@ -0,0 +1,313 @@
+// --- native.go --- (ClickHouse native TCP protocol proxying)
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ClickHouse/ch-go/proto"
+)
+
+const (
+	nativeHandshakeTimeout = 10 * time.Second
+	nativeDialTimeout      = 10 * time.Second
+)
+
+// ClickHouse error codes sent in native Exception packets.
+const (
+	errCodeTooManySimultaneousQueries = 202
+	errCodeAllConnectionTriesFailed   = 279
+	errCodeUnexpectedPacket           = 101
+)
+
+// NativeProxy accepts ClickHouse native protocol connections. It reads the
+// client handshake to find the group key and picks a replica like for HTTP
+// requests. After that it follows the packets both ways: queries go through
+// the policy, class settings, group limits and audit log like HTTP requests,
+// everything else is forwarded unchanged.
+//
+// Limits apply per query: a query holds a group slot from the Query packet
+// until the node sent its last packet for it. Connections to nodes are plain TCP.
+type NativeProxy struct {
+	proxy     *SimpleProxy
+	groupFrom string // "user" or "quota_key"
+
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	wg       sync.WaitGroup
+	ctx      context.Context // Canceled on Close, aborts queued connections
+	cancel   context.CancelFunc
+}
+
+func NewNativeProxy(p *SimpleProxy) (*NativeProxy, error) {
+	groupFrom := p.config.NativeGroupFrom
+	switch groupFrom {
+	case "":
+		groupFrom = "user"
+	case "user", "quota_key":
+	default:
+		return nil, fmt.Errorf("unknown native_group_from %q", groupFrom)
+	}
+	for _, replica := range p.replicas {
+		for _, node := range replica.Nodes {
+			if node.NativeAddress == "" {
+				return nil, fmt.Errorf("node %s has no native_address", node.Address)
+			}
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &NativeProxy{
+		proxy:     p,
+		groupFrom: groupFrom,
+		conns:     make(map[net.Conn]struct{}),
+		ctx:       ctx,
+		cancel:    cancel,
+	}, nil
+}
+
+// Serve accepts connections until the listener is closed.
+func (n *NativeProxy) Serve(l net.Listener) error {
+	n.mu.Lock()
+	n.listener = l
+	n.mu.Unlock()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		n.mu.Lock()
+		n.conns[conn] = struct{}{}
+		n.wg.Add(1)
+		n.mu.Unlock()
+		go func() {
+			defer func() {
+				n.mu.Lock()
+				delete(n.conns, conn)
+				n.mu.Unlock()
+				n.wg.Done()
+			}()
+			n.serveConn(conn)
+		}()
+	}
+}
+
+// Shutdown stops accepting connections and waits for open ones to be closed
+// by their clients. When ctx expires the remaining connections are closed
+// and their number is returned.
+func (n *NativeProxy) Shutdown(ctx context.Context) int {
+	n.mu.Lock()
+	if n.listener != nil {
+		n.listener.Close()
+	}
+	n.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		n.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return 0
+	case <-ctx.Done():
+	}
+
+	n.cancel()
+	n.mu.Lock()
+	aborted := len(n.conns)
+	for conn := range n.conns {
+		conn.Close()
+	}
+	n.mu.Unlock()
+	<-done
+	return aborted
+}
+
+func (n *NativeProxy) serveConn(client net.Conn) {
+	defer client.Close()
+	p := n.proxy
+
+	// 1. Read the client handshake
+	client.SetDeadline(time.Now().Add(nativeHandshakeTimeout))
+	fromUser := newNativeStream(client)
+	code, err := fromUser.UVarInt()
+	if err != nil {
+		return
+	}
+	if proto.ClientCode(code) != proto.ClientCodeHello {
+		writeNativeException(client, errCodeUnexpectedPacket, fmt.Sprintf("Unexpected packet %d, expected Hello", code))
+		return
+	}
+	var hello proto.ClientHello
+	if err := hello.Decode(fromUser.Reader); err != nil {
+		slog.Warn("Native handshake failed", "remote", client.RemoteAddr().String(), "err", err)
+		return
+	}
+	fromUser.discard()
+	if hello.User == "" {
+		hello.User = "default"
+	}
+	// The proxy decodes every packet, so it only offers the protocol
+	// revisions it knows
+	hello.ProtocolVersion = min(hello.ProtocolVersion, proto.Version)
+
+	// 2. Authenticate and get the group key (the quota key is only known later)
+	var identity *Identity
+	groupKey, user := hello.User, hello.User
+	if p.auth != nil {
+		identity, err = p.auth.AuthenticatePassword(hello.User, hello.Password)
+		if err != nil {
+			slog.Warn("Native authentication failed", "remote", client.RemoteAddr().String(), "err", err)
+			writeNativeException(client, errCodeAuthenticationFailed, "Authentication failed")
+			return
+		}
+		groupKey, user = identity.Group, identity.Name
+	}
+
+	// 3. Select a replica and wait for its rate limiter
+	replica := p.selectReplica(nil)
+	if replica == nil || len(replica.Nodes) == 0 {
+		writeNativeException(client, errCodeAllConnectionTriesFailed, "No available backend replicas")
+		return
+	}
+	if err := replica.Wait(n.ctx); err != nil {
+		writeNativeException(client, errCodeAllConnectionTriesFailed, "Backend replica rate limited")
+		return
+	}
+	node := replica.NextNode()
+
+	// 4. Connect and pass the handshake on, with backend credentials if authenticated
+	backend, err := net.DialTimeout("tcp", node.NativeAddress, nativeDialTimeout)
+	if err != nil {
+		slog.Warn("Native connection to node failed", "group", groupKey, "node", node.NativeAddress, "err", err)
+		writeNativeException(client, errCodeAllConnectionTriesFailed, fmt.Sprintf("Connection to %s failed", node.NativeAddress))
+		return
+	}
+	defer backend.Close()
+	if identity != nil {
+		if creds, ok := backendCredentials(p.config, node.Replica, identity.BackendUser); ok {
+			hello.User, hello.Password = creds.User, creds.Password
+		}
+	}
+	var b proto.Buffer
+	hello.Encode(&b)
+	if _, err := backend.Write(b.Buf); err != nil {
+		slog.Warn("Native handshake with node failed", "group", groupKey, "node", node.NativeAddress, "err", err)
+		return
+	}
+
+	// 5. Read the whole server hello and send it on, so the client never
+	// waits for a part the proxy has not read yet
+	backend.SetDeadline(time.Now().Add(nativeHandshakeTimeout))
+	fromNode := newNativeStream(backend)
+	serverHello, err := readServerHello(fromNode, hello.ProtocolVersion, client)
+	if err != nil {
+		slog.Warn("Native handshake with node failed", "group", groupKey, "node", node.NativeAddress, "err", err)
+		return
+	}
+	if serverHello == nil {
+		return // The node sent an exception, passed on to the client
+	}
+	version := min(serverHello.Revision, hello.ProtocolVersion)
+
+	// 6. The addendum after the hello carries the quota key
+	if proto.FeatureAddendum.In(version) {
+		quotaKey, err := fromUser.Str()
+		if err != nil {
+			return
+		}
+		fromUser.discard()
+		b.Reset()
+		b.PutString(quotaKey)
+		if _, err := backend.Write(b.Buf); err != nil {
+			return
+		}
+		if n.groupFrom == "quota_key" && quotaKey != "" {
+			groupKey = quotaKey
+		}
+	}
+
+	// 7. Relay packets both ways until either side closes; each query takes
+	// a group slot of its own
+	client.SetDeadline(time.Time{})
+	backend.SetDeadline(time.Time{})
+	slog.Debug("Native connection established", "group", groupKey, "remote", client.RemoteAddr().String(), "node", node.NativeAddress)
+	startTime := time.Now()
+	session := &nativeSession{
+		n:        n,
+		client:   client,
+		backend:  backend,
+		fromUser: fromUser,
+		fromNode: fromNode,
+		version:  version,
+		groupKey: groupKey,
+		user:     user,
+		identity: identity,
+		database: hello.Database,
+		node:     node,
+	}
+	session.relay()
+	slog.Info("native connection", "group", groupKey, "remote", client.RemoteAddr().String(), "node", node.NativeAddress, "duration", time.Since(startTime))
+}
+
+// readServerHello reads the server hello for a client of the given protocol
+// revision and sends it to the client, with the revision lowered to what the
+// proxy offered. An exception instead of the hello is passed on as is and
+// nil is returned.
+func readServerHello(fromNode *nativeStream, version int, client io.Writer) (*proto.ServerHello, error) {
+	code, err := fromNode.UVarInt()
+	if err != nil {
+		return nil, err
+	}
+	switch proto.ServerCode(code) {
+	case proto.ServerCodeHello:
+	case proto.ServerCodeException:
+		if _, _, err := fromNode.readException(version); err != nil {
+			return nil, err
+		}
+		return nil, fromNode.forward(client)
+	default:
+		return nil, fmt.Errorf("unexpected packet %d, expected Hello", code)
+	}
+	var hello proto.ServerHello
+	if err := hello.DecodeAware(fromNode.Reader, version); err != nil {
+		return nil, err
+	}
+	fromNode.discard()
+	hello.Revision = min(hello.Revision, version)
+	var b proto.Buffer
+	hello.EncodeAware(&b, version)
+	if _, err := client.Write(b.Buf); err != nil {
+		return nil, err
+	}
+	return &hello, nil
+}
+
+// writeNativeException sends an Exception packet, the way ClickHouse reports
+// errors over the native protocol.
+func writeNativeException(w io.Writer, code int, message string) {
+	var b proto.Buffer
+	proto.ServerCodeException.Encode(&b)
+	exception := proto.Exception{
+		Code:    proto.Error(code),
+		Name:    "DB::Exception",
+		Message: "DB::Exception: " + message,
+	}
+	exception.EncodeAware(&b, 0)
+	w.Write(b.Buf)
+}
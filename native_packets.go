@@ -0,0 +1,402 @@
+// --- native_packets.go --- (Packet-level relaying of native protocol connections)
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/ClickHouse/ch-go/proto"
+)
+
+// nativeReaderSize is the read buffer of a native stream. It must be at least
+// the buffer size of proto.NewReader, which then uses our bufio.Reader as is
+// instead of wrapping it, so Buffered tells how far the packets were read.
+const nativeReaderSize = 1 << 20
+
+// nativeStream reads packets from one side of a native connection and keeps
+// the bytes of the packet just read, so it can be passed on exactly as it
+// arrived without being encoded again.
+type nativeStream struct {
+	*proto.Reader
+	buf *bufio.Reader
+	raw []byte // Bytes read from the connection and not yet passed on or dropped
+}
+
+func newNativeStream(conn io.Reader) *nativeStream {
+	s := &nativeStream{}
+	s.buf = bufio.NewReaderSize(&streamRecorder{conn: conn, s: s}, nativeReaderSize)
+	s.Reader = proto.NewReader(s.buf)
+	return s
+}
+
+// streamRecorder keeps a copy of everything read from the connection.
+type streamRecorder struct {
+	conn io.Reader
+	s    *nativeStream
+}
+
+func (r *streamRecorder) Read(p []byte) (int, error) {
+	n, err := r.conn.Read(p)
+	r.s.raw = append(r.s.raw, p[:n]...)
+	return n, err
+}
+
+// packet returns the bytes decoded since the last forward or discard, which
+// is the packet just read. Read-ahead bytes of the next packet are not part of it.
+func (s *nativeStream) packet() []byte {
+	return s.raw[:len(s.raw)-s.buf.Buffered()]
+}
+
+// forward writes the packet just read to w unchanged.
+func (s *nativeStream) forward(w io.Writer) error {
+	packet := s.packet()
+	_, err := w.Write(packet)
+	s.drop(len(packet))
+	return err
+}
+
+// discard drops the packet just read, for packets that are encoded again or
+// not passed on at all.
+func (s *nativeStream) discard() {
+	s.drop(len(s.packet()))
+}
+
+func (s *nativeStream) drop(n int) {
+	s.raw = append(s.raw[:0], s.raw[n:]...)
+}
+
+// skipData reads the table name and block of a data packet. Blocks are
+// decoded in full, as their size only follows from the column types.
+func (s *nativeStream) skipData(version int, compressed bool) error {
+	var data proto.ClientData // Same layout both ways
+	if err := data.DecodeAware(s.Reader, version); err != nil {
+		return err
+	}
+	if compressed {
+		s.EnableCompression()
+		defer s.DisableCompression()
+	}
+	var block proto.Block
+	var results proto.Results
+	return block.DecodeBlock(s.Reader, version, results.Auto())
+}
+
+// readException reads the exception chain of an Exception packet and returns
+// the code and message of the outermost one.
+func (s *nativeStream) readException(version int) (int, string, error) {
+	var top proto.Exception
+	for i := 0; ; i++ {
+		var e proto.Exception
+		if err := e.DecodeAware(s.Reader, version); err != nil {
+			return 0, "", err
+		}
+		if i == 0 {
+			top = e
+		}
+		if !e.Nested {
+			return int(top.Code), top.Message, nil
+		}
+	}
+}
+
+// nativeQuery is a query a native client started.
+type nativeQuery struct {
+	id         string
+	info       QueryInfo
+	limiter    *GroupLimiter // Slot held until the node ends the query
+	start      time.Time
+	compressed bool
+}
+
+// nativeSession is a native connection after the handshake. It follows the
+// packets both ways, so each query is checked like an HTTP request and holds
+// a group slot only until the node has answered it. Idle connections, as
+// clients keep them in their pools, hold no slot.
+type nativeSession struct {
+	n         *NativeProxy
+	client    net.Conn
+	backend   net.Conn
+	fromUser  *nativeStream
+	fromNode  *nativeStream
+	version   int // Negotiated protocol revision
+	groupKey  string
+	user      string
+	identity  *Identity
+	database  string
+	node      *Node
+	writeLock sync.Mutex // Packets to the client come from both directions
+
+	mu    sync.Mutex
+	query *nativeQuery // Running on the node, nil between queries
+}
+
+// relay passes packets both ways until either side closes the connection.
+func (s *nativeSession) relay() {
+	done := make(chan struct{})
+	go func() {
+		if err := s.relayClient(); err != nil && !isClosedConn(err) {
+			slog.Warn("Native connection from client failed", "group", s.groupKey, "remote", s.client.RemoteAddr().String(), "err", err)
+		}
+		s.backend.Close()
+		close(done)
+	}()
+	if err := s.relayNode(); err != nil && !isClosedConn(err) {
+		slog.Warn("Native connection to node failed", "group", s.groupKey, "node", s.node.NativeAddress, "err", err)
+	}
+	s.client.Close()
+	<-done
+	s.finishQuery(0, "connection closed")
+}
+
+// relayClient passes client packets to the node. Queries are checked, get a
+// group slot and the class settings before they are passed on.
+func (s *nativeSession) relayClient() error {
+	compressed := false // Compression of the client's last query, for its data packets
+	rejected := false   // Last query was answered by the proxy; drop its data
+	for {
+		code, err := s.fromUser.UVarInt()
+		if err != nil {
+			return err
+		}
+		switch proto.ClientCode(code) {
+		case proto.ClientCodeQuery:
+			var q proto.Query
+			if err := q.DecodeAware(s.fromUser.Reader, s.version); err != nil {
+				return fmt.Errorf("decode query: %w", err)
+			}
+			s.fromUser.discard()
+			compressed = q.Compression == proto.CompressionEnabled
+			if rejected = !s.startQuery(&q); rejected {
+				continue
+			}
+			var b proto.Buffer
+			q.EncodeAware(&b, s.version)
+			if _, err := s.backend.Write(b.Buf); err != nil {
+				return err
+			}
+			continue
+		case proto.ClientCodeData:
+			if err := s.fromUser.skipData(s.version, compressed); err != nil {
+				return fmt.Errorf("decode data: %w", err)
+			}
+		case proto.ClientCodeCancel:
+		case proto.ClientCodePing:
+			rejected = false
+		default:
+			s.writeException(errCodeUnexpectedPacket, fmt.Sprintf("Unexpected packet %d from client", code))
+			return fmt.Errorf("unsupported packet %d from client", code)
+		}
+		if rejected {
+			s.fromUser.discard()
+			continue
+		}
+		if err := s.fromUser.forward(s.backend); err != nil {
+			return err
+		}
+	}
+}
+
+// relayNode passes node packets to the client and ends the running query on
+// its last packet.
+func (s *nativeSession) relayNode() error {
+	for {
+		code, err := s.fromNode.UVarInt()
+		if err != nil {
+			return err
+		}
+		s.mu.Lock()
+		query := s.query
+		s.mu.Unlock()
+
+		end, exceptionCode, exception := false, 0, ""
+		switch proto.ServerCode(code) {
+		case proto.ServerCodeData, proto.ServerCodeTotals, proto.ServerCodeExtremes:
+			err = s.fromNode.skipData(s.version, query != nil && query.compressed)
+		case proto.ServerCodeLog, proto.ServerProfileEvents:
+			err = s.fromNode.skipData(s.version, false) // Never compressed
+		case proto.ServerCodeProgress:
+			var progress proto.Progress
+			err = progress.DecodeAware(s.fromNode.Reader, s.version)
+		case proto.ServerCodeProfile:
+			var profile proto.Profile
+			err = profile.DecodeAware(s.fromNode.Reader, s.version)
+		case proto.ServerCodeTableColumns:
+			var columns proto.TableColumns
+			err = columns.DecodeAware(s.fromNode.Reader, s.version)
+		case proto.ServerCodeException:
+			exceptionCode, exception, err = s.fromNode.readException(s.version)
+			end = true
+		case proto.ServerCodeEndOfStream:
+			end = true
+		case proto.ServerCodePong:
+		default:
+			return fmt.Errorf("unsupported packet %d from node", code)
+		}
+		if err != nil {
+			return fmt.Errorf("decode packet %d: %w", code, err)
+		}
+
+		s.writeLock.Lock()
+		err = s.fromNode.forward(s.client)
+		s.writeLock.Unlock()
+		if err != nil {
+			return err
+		}
+		if end {
+			s.finishQuery(exceptionCode, exception)
+		}
+	}
+}
+
+// startQuery applies the policy, the class settings and the group limit to
+// a query. It answers the client itself and returns false if the query must
+// not run.
+func (s *nativeSession) startQuery(q *proto.Query) bool {
+	p := s.n.proxy
+	query := &nativeQuery{
+		id:         q.ID,
+		info:       QueryInfo{Kind: ClassifyQuery(q.Body), Query: q.Body},
+		start:      time.Now(),
+		compressed: q.Compression == proto.CompressionEnabled,
+	}
+	reject := func(reason string, code int, message string) bool {
+		slog.Info("native query", "group", s.groupKey, "user", s.user, "kind", query.info.Kind.String(), "remote", s.client.RemoteAddr().String(), "rejected", reason)
+		s.audit(query, reason, code)
+		s.writeException(code, message)
+		return false
+	}
+
+	if p.policy != nil {
+		violation := p.policy.Check(PolicyRequest{
+			Group:    s.groupKey,
+			User:     s.user,
+			Database: s.database,
+			Query:    query.info,
+		})
+		if violation != nil {
+			return reject(rejectPolicy, errCodeAccessDenied, violation.Error())
+		}
+	}
+	if class := p.classes.lookup(s.groupKey, s.identity); class != nil {
+		if err := applyClassSettings(class, q, query.info); err != nil {
+			return reject(rejectSettings, errCodeSettingConstraintViolation, err.Error())
+		}
+	}
+
+	limiter := p.limiterFor(s.groupKey, query.info.Kind)
+	p.queued.Add(1)
+	err := limiter.Acquire(s.n.ctx)
+	p.queued.Add(-1)
+	if err != nil {
+		return reject(rejectReason(err), errCodeTooManySimultaneousQueries, fmt.Sprintf("Too many simultaneous queries for %s: %v", s.groupKey, err))
+	}
+	query.limiter = limiter
+	p.inFlight.Add(1)
+
+	s.mu.Lock()
+	previous := s.query
+	s.query = query
+	s.mu.Unlock()
+	if previous != nil {
+		// A client starting a query before the last one ended; the node
+		// rejects it, but the slot of the first must not leak
+		s.end(previous, 0, "")
+	}
+	return true
+}
+
+// finishQuery ends the running query, if any, when the node sent its last
+// packet for it or the connection closed.
+func (s *nativeSession) finishQuery(exceptionCode int, exception string) {
+	s.mu.Lock()
+	query := s.query
+	s.query = nil
+	s.mu.Unlock()
+	if query != nil {
+		s.end(query, exceptionCode, exception)
+	}
+}
+
+func (s *nativeSession) end(query *nativeQuery, exceptionCode int, exception string) {
+	p := s.n.proxy
+	query.limiter.Release()
+	p.inFlight.Add(-1)
+	slog.Info("native query", "group", s.groupKey, "user", s.user, "kind", query.info.Kind.String(), "remote", s.client.RemoteAddr().String(),
+		"node", s.node.NativeAddress, "duration", time.Since(query.start), "exception_code", exceptionCode, "exception", exception)
+	s.audit(query, "", exceptionCode)
+}
+
+// audit records a native query like an HTTP request. Native queries have no
+// HTTP status, it is left 0.
+func (s *nativeSession) audit(query *nativeQuery, rejected string, exceptionCode int) {
+	a := s.n.proxy.audit
+	if a == nil {
+		return
+	}
+	rec := AuditRecord{
+		Time:          query.start,
+		User:          s.user,
+		Group:         s.groupKey,
+		ClientIP:      s.client.RemoteAddr().String(),
+		Kind:          query.info.Kind.String(),
+		QueryID:       query.id,
+		Query:         auditQuery(query.info.Query, query.info.Kind),
+		ExceptionCode: exceptionCode,
+		DurationMs:    float64(time.Since(query.start).Microseconds()) / 1000,
+		Rejected:      rejected,
+	}
+	if rejected == "" {
+		rec.Node = s.node.NativeAddress
+	}
+	if host, _, err := net.SplitHostPort(rec.ClientIP); err == nil {
+		rec.ClientIP = host
+	}
+	a.add(rec)
+}
+
+func (s *nativeSession) writeException(code int, message string) {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	writeNativeException(s.client, code, message)
+}
+
+// applyClassSettings checks the settings of a native query against the class
+// and sets the class settings on it, as CheckSettings and Apply do for the
+// URL parameters of HTTP requests.
+func applyClassSettings(class *GroupClass, q *proto.Query, info QueryInfo) error {
+	params := make(url.Values, len(q.Settings))
+	for _, setting := range q.Settings {
+		params.Set(setting.Key, setting.Value)
+	}
+	if err := class.CheckSettings(params, info); err != nil {
+		return err
+	}
+	class.Apply(params)
+	for i := range q.Settings {
+		q.Settings[i].Value = params.Get(q.Settings[i].Key)
+		params.Del(q.Settings[i].Key)
+	}
+	added := make([]string, 0, len(params))
+	for name := range params {
+		added = append(added, name)
+	}
+	sort.Strings(added)
+	for _, name := range added {
+		q.Settings = append(q.Settings, proto.Setting{Key: name, Value: params.Get(name)})
+	}
+	return nil
+}
+
+// isClosedConn reports whether err only means that a side closed the connection.
+func isClosedConn(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) || errors.Is(err, syscall.ECONNRESET)
+}
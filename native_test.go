@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"clickhouse-test/config"
+	"github.com/ClickHouse/ch-go/proto"
+	"github.com/stretchr/testify/require"
+)
+
+const testNativeVersion = 54460
+
+// fakeNativeServer answers one handshake and checks the addendum. It sends
+// its hello in two parts, like a slow network would. After that it answers
+// each query with an empty data block and EndOfStream once the client sent
+// its (empty) data, and passes the query on to the returned channel.
+func fakeNativeServer(t *testing.T, wantUser, wantQuotaKey string) (net.Listener, <-chan proto.Query) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	queries := make(chan proto.Query, 10)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := proto.NewReader(conn)
+		code, err := r.UVarInt()
+		if err != nil || proto.ClientCode(code) != proto.ClientCodeHello {
+			return
+		}
+		var hello proto.ClientHello
+		if hello.Decode(r) != nil || hello.User != wantUser {
+			return
+		}
+		var b proto.Buffer
+		serverHello := proto.ServerHello{Name: "ClickHouse", Major: 23, Minor: 8, Revision: testNativeVersion, Timezone: "UTC", DisplayName: "fake", Patch: 1}
+		serverHello.EncodeAware(&b, testNativeVersion)
+		conn.Write(b.Buf[:5])
+		time.Sleep(50 * time.Millisecond)
+		conn.Write(b.Buf[5:])
+		if quotaKey, err := r.Str(); err != nil || quotaKey != wantQuotaKey {
+			return
+		}
+
+		for {
+			code, err := r.UVarInt()
+			if err != nil {
+				return
+			}
+			switch proto.ClientCode(code) {
+			case proto.ClientCodeQuery:
+				var q proto.Query
+				if q.DecodeAware(r, testNativeVersion) != nil {
+					return
+				}
+				queries <- q
+			case proto.ClientCodeData:
+				var data proto.ClientData
+				var block proto.Block
+				var results proto.Results
+				if data.DecodeAware(r, testNativeVersion) != nil || block.DecodeBlock(r, testNativeVersion, results.Auto()) != nil {
+					return
+				}
+				b.Reset()
+				proto.ServerCodeData.Encode(&b)
+				proto.ClientData{}.EncodeAware(&b, testNativeVersion)
+				proto.Block{}.EncodeAware(&b, testNativeVersion)
+				proto.ServerCodeEndOfStream.Encode(&b)
+				conn.Write(b.Buf)
+			default:
+				return
+			}
+		}
+	}()
+	return l, queries
+}
+
+// startNativeProxy serves cfg's native port until the test ends.
+func startNativeProxy(t *testing.T, cfg *config.Config) (*SimpleProxy, string) {
+	p, err := NewSimpleProxy(cfg)
+	require.NoError(t, err)
+	native, err := NewNativeProxy(p)
+	require.NoError(t, err)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go native.Serve(l)
+	t.Cleanup(func() { l.Close() })
+	return p, l.Addr().String()
+}
+
+// nativeTestClient is just enough of a native client to run queries.
+type nativeTestClient struct {
+	conn net.Conn
+	r    *proto.Reader
+}
+
+func dialNative(t *testing.T, addr, user, quotaKey string) *nativeTestClient {
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	var b proto.Buffer
+	proto.ClientHello{Name: "test", Major: 2, Minor: 0, ProtocolVersion: testNativeVersion, User: user}.Encode(&b)
+	b.PutString(quotaKey)
+	_, err = conn.Write(b.Buf)
+	require.NoError(t, err)
+
+	c := &nativeTestClient{conn: conn, r: proto.NewReader(conn)}
+	code, err := c.r.UVarInt()
+	require.NoError(t, err)
+	require.Equal(t, proto.ServerCodeHello, proto.ServerCode(code))
+	var hello proto.ServerHello
+	require.NoError(t, hello.DecodeAware(c.r, testNativeVersion))
+	require.Equal(t, testNativeVersion, hello.Revision)
+	require.Equal(t, "fake", hello.DisplayName)
+	return c
+}
+
+// query runs body and returns the code of the exception it ended with, 0 if none.
+func (c *nativeTestClient) query(t *testing.T, body string, settings ...proto.Setting) int {
+	var b proto.Buffer
+	proto.Query{ID: "q-1", Body: body, Settings: settings, Info: proto.ClientInfo{ProtocolVersion: testNativeVersion, Interface: proto.InterfaceTCP, Query: proto.ClientQueryInitial}}.EncodeAware(&b, testNativeVersion)
+	proto.ClientCodeData.Encode(&b)
+	proto.ClientData{}.EncodeAware(&b, testNativeVersion)
+	proto.Block{}.EncodeAware(&b, testNativeVersion)
+	_, err := c.conn.Write(b.Buf)
+	require.NoError(t, err)
+
+	for {
+		code, err := c.r.UVarInt()
+		require.NoError(t, err)
+		switch proto.ServerCode(code) {
+		case proto.ServerCodeData:
+			var data proto.ClientData
+			var block proto.Block
+			var results proto.Results
+			require.NoError(t, data.DecodeAware(c.r, testNativeVersion))
+			require.NoError(t, block.DecodeBlock(c.r, testNativeVersion, results.Auto()))
+		case proto.ServerCodeEndOfStream:
+			return 0
+		case proto.ServerCodeException:
+			var exception proto.Exception
+			require.NoError(t, exception.DecodeAware(c.r, testNativeVersion))
+			return int(exception.Code)
+		default:
+			t.Fatalf("unexpected packet %d", code)
+		}
+	}
+}
+
+func nativeTestConfig(nativeAddress string) *config.Config {
+	return &config.Config{
+		HeaderName:    "X-User-Id",
+		MaxConcurrent: 1,
+		QueueTimeout:  10 * time.Millisecond,
+		Replicas:      []config.ReplicaConfig{{Name: "r1"}},
+		Nodes:         []config.NodeConfig{{Replica: "r1", Address: "127.0.0.1:8123", NativeAddress: nativeAddress}},
+	}
+}
+
+func TestNativeProxyQuotaKey(t *testing.T) {
+	backend, queries := fakeNativeServer(t, "reader", "team-a")
+	defer backend.Close()
+
+	cfg := nativeTestConfig(backend.Addr().String())
+	cfg.NativeGroupFrom = "quota_key"
+	p, addr := startNativeProxy(t, cfg)
+
+	c := dialNative(t, addr, "reader", "team-a")
+	require.Equal(t, 0, c.query(t, "SELECT 1"))
+	require.Equal(t, "SELECT 1", (<-queries).Body)
+
+	_, ok := p.groupLimiters.Load("team-a")
+	require.True(t, ok, "queries should be limited by the quota key")
+}
+
+func TestNativeProxySlotPerQuery(t *testing.T) {
+	backend, _ := fakeNativeServer(t, "reader", "")
+	defer backend.Close()
+	p, addr := startNativeProxy(t, nativeTestConfig(backend.Addr().String()))
+
+	// An idle connection holds no slot, and a finished query gives its slot back
+	c := dialNative(t, addr, "reader", "")
+	limiter := p.groupLimiter("reader")
+	require.NoError(t, limiter.Acquire(t.Context()))
+	limiter.Release()
+	require.Equal(t, 0, c.query(t, "SELECT 1"))
+	require.Eventually(t, func() bool {
+		if limiter.Acquire(t.Context()) != nil {
+			return false
+		}
+		limiter.Release()
+		return true
+	}, time.Second, 10*time.Millisecond)
+
+	// A query waits for a slot like an HTTP request
+	require.NoError(t, limiter.Acquire(t.Context()))
+	defer limiter.Release()
+	require.Equal(t, errCodeTooManySimultaneousQueries, c.query(t, "SELECT 1"))
+}
+
+func TestNativeProxyPolicyAndSettings(t *testing.T) {
+	backend, queries := fakeNativeServer(t, "reader", "")
+	defer backend.Close()
+	cfg := nativeTestConfig(backend.Addr().String())
+	cfg.PolicyFile = "config/policy.yml"
+	cfg.Classes = []config.ClassConfig{{
+		Name:        "reports",
+		Groups:      []string{"reader"},
+		Settings:    map[string]string{"readonly": "1"},
+		MaxSettings: map[string]string{"max_execution_time": "30"},
+	}}
+	_, addr := startNativeProxy(t, cfg)
+
+	c := dialNative(t, addr, "reader", "")
+	require.Equal(t, errCodeAccessDenied, c.query(t, "SYSTEM FLUSH LOGS"))
+	require.Equal(t, errCodeSettingConstraintViolation, c.query(t, "SELECT 1", proto.Setting{Key: "max_execution_time", Value: "60"}))
+	require.Equal(t, errCodeSettingConstraintViolation, c.query(t, "SELECT 1 SETTINGS readonly = 0"))
+
+	require.Equal(t, 0, c.query(t, "SELECT 1", proto.Setting{Key: "max_execution_time", Value: "10"}))
+	q := <-queries
+	require.Equal(t, "SELECT 1", q.Body)
+	require.Equal(t, []proto.Setting{
+		{Key: "max_execution_time", Value: "10"},
+		{Key: "readonly", Value: "1"},
+	}, q.Settings)
+	require.Empty(t, queries, "rejected queries must not reach the node")
+}
+
+func TestNativeProxyAudit(t *testing.T) {
+	backend, _ := fakeNativeServer(t, "reader", "")
+	defer backend.Close()
+	auditFile := filepath.Join(t.TempDir(), "audit.jsonl")
+	cfg := nativeTestConfig(backend.Addr().String())
+	cfg.PolicyFile = "config/policy.yml"
+	cfg.Audit = config.AuditConfig{Enabled: true, File: auditFile}
+	p, addr := startNativeProxy(t, cfg)
+
+	c := dialNative(t, addr, "reader", "")
+	require.Equal(t, 0, c.query(t, "SELECT 1"))
+	require.Equal(t, errCodeAccessDenied, c.query(t, "SYSTEM FLUSH LOGS"))
+	c.conn.Close()
+	time.Sleep(50 * time.Millisecond) // Let the proxy see the close
+	require.NoError(t, p.audit.Close(context.Background()))
+
+	f, err := os.Open(auditFile)
+	require.NoError(t, err)
+	defer f.Close()
+	var records []AuditRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var rec AuditRecord
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &rec))
+		records = append(records, rec)
+	}
+	require.Len(t, records, 2)
+
+	require.Equal(t, "SELECT 1", records[0].Query)
+	require.Equal(t, "reader", records[0].Group)
+	require.Equal(t, "q-1", records[0].QueryID)
+	require.Equal(t, backend.Addr().String(), records[0].Node)
+	require.Empty(t, records[0].Rejected)
+
+	require.Equal(t, rejectPolicy, records[1].Rejected)
+	require.Equal(t, errCodeAccessDenied, records[1].ExceptionCode)
+	require.Empty(t, records[1].Node)
+}
@@ -0,0 +1,447 @@
+// --- policy.go --- (Query allow/deny rules per group or user)
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"clickhouse-test/config"
+)
+
+const defaultPolicyReloadInterval = 10 * time.Second
+
+// PolicyRequest is what a policy is evaluated against.
+type PolicyRequest struct {
+	Group    string
+	User     string
+	Database string // Current database of the request, empty if not set
+	Query    QueryInfo
+}
+
+// PolicyViolation describes why a query was rejected.
+type PolicyViolation struct {
+	Rule   string
+	Reason string
+}
+
+func (v *PolicyViolation) Error() string {
+	return fmt.Sprintf("query rejected by policy %q: %s", v.Rule, v.Reason)
+}
+
+type policyRule struct {
+	name             string
+	groups           map[string]bool
+	users            map[string]bool
+	denyKinds        map[QueryKind]bool
+	denyStatements   [][]string // Upper-cased keyword sequences
+	requireLimit     bool
+	forbidSelectStar map[string]bool
+	allowedDatabases map[string]bool
+}
+
+// Policy is a compiled set of rules.
+type Policy struct {
+	rules []*policyRule
+}
+
+func NewPolicy(cfg *config.PolicyConfig) (*Policy, error) {
+	policy := &Policy{}
+	for i, ruleCfg := range cfg.Rules {
+		name := ruleCfg.Name
+		if name == "" {
+			name = fmt.Sprintf("rules[%d]", i)
+		}
+		rule := &policyRule{
+			name:             name,
+			groups:           toSet(ruleCfg.Groups),
+			users:            toSet(ruleCfg.Users),
+			denyKinds:        make(map[QueryKind]bool),
+			requireLimit:     ruleCfg.RequireLimit,
+			forbidSelectStar: toSet(ruleCfg.ForbidSelectStar),
+			allowedDatabases: toSet(ruleCfg.AllowedDatabases),
+		}
+		for _, kindName := range ruleCfg.DenyKinds {
+			kind, ok := ParseQueryKind(kindName)
+			if !ok {
+				return nil, fmt.Errorf("policy %q: unknown statement kind %q", name, kindName)
+			}
+			rule.denyKinds[kind] = true
+		}
+		for _, stmt := range ruleCfg.DenyStatements {
+			words := strings.Fields(strings.ToUpper(stmt))
+			if len(words) == 0 {
+				return nil, fmt.Errorf("policy %q: empty deny_statements entry", name)
+			}
+			rule.denyStatements = append(rule.denyStatements, words)
+		}
+		policy.rules = append(policy.rules, rule)
+	}
+	return policy, nil
+}
+
+// Check returns the first violation of any rule applying to the request, or nil.
+func (p *Policy) Check(req PolicyRequest) *PolicyViolation {
+	var stmt *statementInfo
+	for _, rule := range p.rules {
+		if !rule.applies(req) {
+			continue
+		}
+		if stmt == nil {
+			stmt = analyzeStatement(req.Query.Query)
+		}
+		if reason := rule.check(req, stmt); reason != "" {
+			return &PolicyViolation{Rule: rule.name, Reason: reason}
+		}
+	}
+	return nil
+}
+
+func (r *policyRule) applies(req PolicyRequest) bool {
+	return (len(r.groups) == 0 || r.groups[req.Group]) &&
+		(len(r.users) == 0 || r.users[req.User])
+}
+
+func (r *policyRule) check(req PolicyRequest, stmt *statementInfo) string {
+	kind := req.Query.Kind
+	// Rules only see the classifier's prefix of the query. A statement that
+	// is cut before its end, or that has no recognizable first keyword, could
+	// hide anything past the prefix (e.g. 64 KB of comments, then DROP TABLE),
+	// so it fails closed instead of passing every check.
+	if kind == QueryUnknown && strings.TrimSpace(req.Query.Query) != "" {
+		return "statement could not be classified"
+	}
+	if req.Query.Truncated && !(kind == QueryInsert && stmt.insertData) {
+		return fmt.Sprintf("statement is longer than %d bytes and could not be fully inspected", maxClassifyBytes)
+	}
+	if r.denyKinds[kind] {
+		return fmt.Sprintf("%s statements are not allowed", strings.ToUpper(kind.String()))
+	}
+	for _, denied := range r.denyStatements {
+		if hasWordPrefix(stmt.words, denied) {
+			return fmt.Sprintf("%s statements are not allowed", strings.Join(denied, " "))
+		}
+	}
+	if r.requireLimit && stmt.isSelect && !stmt.hasLimit {
+		return "SELECT without LIMIT is not allowed"
+	}
+	if len(r.forbidSelectStar) > 0 && stmt.selectStar {
+		for _, ref := range stmt.tables {
+			db := ref.database
+			if db == "" {
+				db = currentDatabase(req)
+			}
+			if r.forbidSelectStar["*"] || r.forbidSelectStar[ref.table] || r.forbidSelectStar[db+"."+ref.table] {
+				return fmt.Sprintf("SELECT * from %s.%s is not allowed", db, ref.table)
+			}
+		}
+	}
+	if len(r.allowedDatabases) > 0 {
+		if !r.allowedDatabases[currentDatabase(req)] {
+			return fmt.Sprintf("database %s is not allowed", currentDatabase(req))
+		}
+		for _, db := range stmt.databases() {
+			if !r.allowedDatabases[db] {
+				return fmt.Sprintf("database %s is not allowed", db)
+			}
+		}
+	}
+	return ""
+}
+
+// currentDatabase is the database unqualified table names resolve to. When the
+// client did not pick one, ClickHouse's "default" is assumed.
+func currentDatabase(req PolicyRequest) string {
+	if req.Database != "" {
+		return req.Database
+	}
+	return "default"
+}
+
+func hasWordPrefix(words, prefix []string) bool {
+	if len(words) < len(prefix) {
+		return false
+	}
+	for i := range prefix {
+		if words[i] != prefix[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func toSet(values []string) map[string]bool {
+	set := make(map[string]bool, len(values))
+	for _, v := range values {
+		set[v] = true
+	}
+	return set
+}
+
+// --- Statement analysis ---
+
+type tableRef struct {
+	database string // Empty if the name was not qualified
+	table    string
+}
+
+// statementInfo is the result of a shallow, token-based look at a statement.
+type statementInfo struct {
+	words      []string // Leading keywords, upper-cased (e.g. ALTER TABLE)
+	isSelect   bool     // Statement starts with SELECT or WITH
+	hasLimit   bool     // LIMIT at the outermost level
+	selectStar bool     // SELECT * (or t.*) anywhere in the statement
+	tables     []tableRef
+	usedDBs    []string // Databases referenced directly (USE db, CREATE DATABASE db, SHOW TABLES FROM db)
+	insertData bool     // INSERT whose data (FORMAT or VALUES) starts within the query seen
+}
+
+// databases returns every database the statement references. Unqualified
+// tables are reported with an empty name and resolved by the caller.
+func (s *statementInfo) databases() []string {
+	var dbs []string
+	for _, ref := range s.tables {
+		if ref.database != "" {
+			dbs = append(dbs, ref.database)
+		}
+	}
+	return append(dbs, s.usedDBs...)
+}
+
+// Keywords after which a table name follows.
+var tableKeywords = map[string]bool{
+	"FROM":  true,
+	"JOIN":  true,
+	"INTO":  true,
+	"TABLE": true,
+}
+
+func analyzeStatement(query string) *statementInfo {
+	tokens := tokenize(query)
+	stmt := &statementInfo{}
+
+	// Leading keywords, skipping parentheses around the statement.
+	outerDepth := 0
+	for _, tok := range tokens {
+		if tok.kind == tokPunct && tok.text == "(" && len(stmt.words) == 0 {
+			outerDepth++
+			continue
+		}
+		if tok.kind != tokWord {
+			break
+		}
+		stmt.words = append(stmt.words, strings.ToUpper(tok.text))
+	}
+	if len(stmt.words) > 0 {
+		stmt.isSelect = stmt.words[0] == "SELECT" || stmt.words[0] == "WITH"
+	}
+	isShow := len(stmt.words) > 0 && stmt.words[0] == "SHOW"
+	if len(stmt.words) > 0 && stmt.words[0] == "INSERT" {
+		stmt.insertData = insertDataFollows(tokens)
+	}
+
+	depth := 0
+	for i, tok := range tokens {
+		switch {
+		case tok.kind == tokPunct && tok.text == "(":
+			depth++
+		case tok.kind == tokPunct && tok.text == ")":
+			depth--
+		case tok.kind == tokPunct && tok.text == "*" && i > 0:
+			prev := tokens[i-1]
+			prevWord := strings.ToUpper(prev.text)
+			if (prev.kind == tokWord && (prevWord == "SELECT" || prevWord == "DISTINCT")) ||
+				(prev.kind == tokPunct && (prev.text == "," || prev.text == ".")) {
+				stmt.selectStar = true
+			}
+		case tok.kind == tokWord:
+			word := strings.ToUpper(tok.text)
+			switch {
+			case word == "LIMIT" && depth <= outerDepth:
+				stmt.hasLimit = true
+			case word == "DATABASE" || (word == "USE" && i == 0) || (isShow && (word == "FROM" || word == "IN")):
+				if name, _, ok := readName(tokens, skipIfExists(tokens, i+1)); ok {
+					stmt.usedDBs = append(stmt.usedDBs, name)
+				}
+			case tableKeywords[word]:
+				if ref, ok := readTableRef(tokens, i+1); ok {
+					stmt.tables = append(stmt.tables, ref)
+				}
+			}
+		}
+	}
+	return stmt
+}
+
+// insertDataFollows reports whether an INSERT has its data (VALUES or
+// FORMAT <name>) right after the target table and column list. Everything
+// after that is data, so a cut body still has the whole statement. A
+// SELECT anywhere means the statement reads tables we may not have seen,
+// whatever words come later.
+func insertDataFollows(tokens []sqlToken) bool {
+	for _, tok := range tokens {
+		if tok.kind == tokWord && strings.EqualFold(tok.text, "SELECT") {
+			return false
+		}
+	}
+	i := 1 // After INSERT
+	if i >= len(tokens) || !strings.EqualFold(tokens[i].text, "INTO") {
+		return false
+	}
+	i++
+	if i < len(tokens) && tokens[i].kind == tokWord && strings.EqualFold(tokens[i].text, "TABLE") {
+		i++
+	}
+	_, i, ok := readName(tokens, i)
+	if !ok {
+		return false
+	}
+	if i < len(tokens) && tokens[i].kind == tokPunct && tokens[i].text == "." {
+		if _, i, ok = readName(tokens, i+1); !ok {
+			return false
+		}
+	}
+	if isTableFunctionCall(tokens, i) {
+		// Column list, up to its closing parenthesis
+		depth := 0
+		for ; i < len(tokens); i++ {
+			if tokens[i].kind != tokPunct {
+				continue
+			}
+			if tokens[i].text == "(" {
+				depth++
+			} else if tokens[i].text == ")" {
+				depth--
+				if depth == 0 {
+					break
+				}
+			}
+		}
+		i++
+	}
+	if i >= len(tokens) || tokens[i].kind != tokWord {
+		return false
+	}
+	switch strings.ToUpper(tokens[i].text) {
+	case "VALUES":
+		return true
+	case "FORMAT":
+		return i+1 < len(tokens) && tokens[i+1].kind == tokWord
+	}
+	return false
+}
+
+// readTableRef reads "[db.]table" starting at tokens[i]. Subqueries and
+// table functions are not table references.
+func readTableRef(tokens []sqlToken, i int) (tableRef, bool) {
+	first, next, ok := readName(tokens, skipIfExists(tokens, i))
+	if !ok {
+		return tableRef{}, false
+	}
+	ref := tableRef{table: first}
+	if next < len(tokens) && tokens[next].kind == tokPunct && tokens[next].text == "." {
+		table, after, ok := readName(tokens, next+1)
+		if !ok {
+			return tableRef{}, false
+		}
+		ref = tableRef{database: first, table: table}
+		next = after
+	}
+	if isTableFunctionCall(tokens, next) {
+		return tableRef{}, false
+	}
+	return ref, true
+}
+
+// skipIfExists skips "IF [NOT] EXISTS" in DDL statements.
+func skipIfExists(tokens []sqlToken, i int) int {
+	for i < len(tokens) && tokens[i].kind == tokWord {
+		word := strings.ToUpper(tokens[i].text)
+		if word != "IF" && word != "NOT" && word != "EXISTS" {
+			break
+		}
+		i++
+	}
+	return i
+}
+
+func isTableFunctionCall(tokens []sqlToken, i int) bool {
+	return i < len(tokens) && tokens[i].kind == tokPunct && tokens[i].text == "("
+}
+
+// readName reads a bare or quoted identifier at tokens[i].
+func readName(tokens []sqlToken, i int) (string, int, bool) {
+	if i >= len(tokens) {
+		return "", i, false
+	}
+	switch tok := tokens[i]; tok.kind {
+	case tokWord:
+		return tok.text, i + 1, true
+	case tokQuoted:
+		return strings.Trim(tok.text, "`\""), i + 1, true
+	}
+	return "", i, false
+}
+
+// --- Hot reloading ---
+
+// PolicyEngine holds the current Policy and reloads it when policy_file changes.
+type PolicyEngine struct {
+	path    string
+	policy  atomic.Pointer[Policy]
+	modTime time.Time // Only accessed by Reload
+}
+
+func NewPolicyEngine(path string) (*PolicyEngine, error) {
+	e := &PolicyEngine{path: path}
+	if err := e.Reload(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Check evaluates the current rules.
+func (e *PolicyEngine) Check(req PolicyRequest) *PolicyViolation {
+	return e.policy.Load().Check(req)
+}
+
+// Reload re-reads the policy file if it changed since the last load. On
+// error the previous rules stay in effect.
+func (e *PolicyEngine) Reload() error {
+	info, err := os.Stat(e.path)
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(e.modTime) && e.policy.Load() != nil {
+		return nil
+	}
+	cfg, err := config.LoadPolicy(e.path)
+	if err != nil {
+		return err
+	}
+	policy, err := NewPolicy(cfg)
+	if err != nil {
+		return err
+	}
+	e.policy.Store(policy)
+	e.modTime = info.ModTime()
+	slog.Info("Loaded policy rules", "rules", len(cfg.Rules), "file", e.path)
+	return nil
+}
+
+// Watch polls the policy file for changes. It never returns.
+func (e *PolicyEngine) Watch(interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultPolicyReloadInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := e.Reload(); err != nil {
+			slog.Warn("Failed to reload policy file, keeping previous rules", "file", e.path, "err", err)
+		}
+	}
+}
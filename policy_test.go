@@ -0,0 +1,102 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"clickhouse-test/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPolicy(t *testing.T) {
+	policyCfg, err := config.LoadPolicy("config/policy.yml")
+	require.NoError(t, err)
+	policy, err := NewPolicy(policyCfg)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		group    string
+		user     string
+		database string
+		query    string
+		rule     string // Empty if the query is allowed
+	}{
+		{"select allowed", "456", "reader", "", "SELECT * FROM t", ""},
+		{"create allowed", "456", "reader", "", "CREATE TABLE t (id UInt32) ENGINE = Memory", ""},
+		{"drop denied for user", "456", "default", "", "DROP TABLE IF EXISTS t", "no-drop"},
+		{"system denied", "456", "reader", "", "SYSTEM DROP DNS CACHE", "no-admin-statements"},
+		{"limit required", "123", "reader", "", "SELECT id FROM test_table", "dashboards"},
+		{"limit in subquery only", "123", "reader", "", "SELECT id FROM (SELECT id FROM test_table LIMIT 1)", "dashboards"},
+		{"limit present", "123", "reader", "", "SELECT id FROM test_table LIMIT 10", ""},
+		{"select star forbidden", "123", "reader", "", "SELECT * FROM default.test_table LIMIT 10", "dashboards"},
+		{"select star unqualified", "123", "reader", "", "SELECT * FROM test_table LIMIT 10", "dashboards"},
+		{"select star other table", "123", "reader", "", "SELECT * FROM other LIMIT 10", ""},
+		{"database not allowed", "123", "reader", "", "SELECT id FROM system.tables LIMIT 10", "dashboards"},
+		{"current database not allowed", "123", "reader", "analytics", "SELECT id FROM t LIMIT 10", "dashboards"},
+		{"table function", "123", "reader", "", "SELECT number FROM numbers(10) LIMIT 10", ""},
+		{"alter denied for user", "456", "default", "", "ALTER TABLE t DELETE WHERE 1", "no-drop"},
+		{"delete allowed", "456", "default", "", "DELETE FROM t WHERE id = 1", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			violation := policy.Check(PolicyRequest{
+				Group:    tt.group,
+				User:     tt.user,
+				Database: tt.database,
+				Query:    QueryInfo{Kind: ClassifyQuery(tt.query), Query: tt.query},
+			})
+			if tt.rule == "" {
+				assert.Nil(t, violation)
+			} else if assert.NotNil(t, violation) {
+				assert.Equal(t, tt.rule, violation.Rule)
+			}
+		})
+	}
+}
+
+func TestPolicyTruncatedQuery(t *testing.T) {
+	policyCfg, err := config.LoadPolicy("config/policy.yml")
+	require.NoError(t, err)
+	policy, err := NewPolicy(policyCfg)
+	require.NoError(t, err)
+
+	padding := strings.Repeat(" ", maxClassifyBytes)
+	tests := []struct {
+		name string
+		body string
+		rule string // Empty if the query is allowed
+	}{
+		{"whitespace before drop", padding + "DROP TABLE t", "no-admin-statements"},
+		{"comment before drop", "/* " + padding + " */ DROP TABLE t", "no-admin-statements"},
+		{"long select", "SELECT 1 WHERE x IN (" + padding + ")", "no-admin-statements"},
+		{"comment only", "-- nothing to run", "no-admin-statements"},
+		{"long insert data", "INSERT INTO t FORMAT TSV\n" + padding + "1\n", ""},
+		{"long insert values", "INSERT INTO t VALUES " + padding + "(1)", ""},
+		{"long insert with columns", "INSERT INTO db.t (a, b) FORMAT CSV\n" + padding + "1,2\n", ""},
+		{"long insert select", "INSERT INTO t SELECT format, x FROM src WHERE x IN (" + padding + ")", "no-admin-statements"},
+		{"long insert select values", "INSERT INTO t SELECT * FROM (SELECT 1 AS values) WHERE 1 IN (" + padding + ")", "no-admin-statements"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body))
+			info := ClassifyRequest(r)
+			violation := policy.Check(PolicyRequest{Group: "456", User: "default", Query: info})
+			if tt.rule == "" {
+				assert.Nil(t, violation)
+			} else if assert.NotNil(t, violation) {
+				assert.Equal(t, tt.rule, violation.Rule)
+			}
+
+			// The whole body is still forwarded
+			body, err := io.ReadAll(r.Body)
+			require.NoError(t, err)
+			require.Equal(t, tt.body, string(body))
+		})
+	}
+}
@@ -2,36 +2,56 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"errors"
 	"fmt"
-	"io"
-	"log"
 	"log/slog"
 	"net"
 	"net/http"
 	"net/http/httputil"
-	"strings"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
 	"clickhouse-test/config"
 )
 
 type SimpleProxy struct {
-	config        *config.Config
-	replicas      []*Replica
-	nextReplica   uint32       // For simple round-robin
-	groupLimiters sync.Map     // map[string]*GroupLimiter
-	httpClient    *http.Client // For the reverse proxy transport
-	reverseProxy  *httputil.ReverseProxy
+	config         *config.Config
+	replicas       []*Replica
+	nextReplica    uint32   // For simple round-robin
+	groupLimiters  sync.Map // map[string]*GroupLimiter
+	insertLimiters sync.Map // map[string]*GroupLimiter, used when insert limits are configured
+	proxyTimeout   time.Duration
+	policy         *PolicyEngine    // Optional query allow/deny rules
+	auth           *Authenticator   // Optional client authentication
+	classes        *groupClasses    // Settings classes by group key and name
+	cache          *ResponseCache   // Optional response cache for SELECTs
+	coalescer      *Coalescer       // Optional sharing of identical in-flight SELECTs
+	audit          *Auditor         // Optional audit log of every request
+	queryStats     *QueryStats      // Optional per-fingerprint stats and slow query log
+	longQueries    []*longQueryRule // Queries exempt from the server write timeout
+	status         *statusTracker   // Rejections, recent errors and node health for the dashboard
+	httpClient     *http.Client     // For the reverse proxy transport
+	reverseProxy   *httputil.ReverseProxy
+
+	inFlight atomic.Int64 // Requests being handled, including queued ones
+	queued   atomic.Int64 // Requests waiting for a concurrency slot
+	draining atomic.Bool  // Set on shutdown, fails readiness checks
 }
 
 var (
-	nodeCtxKey  = "node"
-	groupCtxKey = "group"
+	nodeCtxKey   = "node"
+	groupCtxKey  = "group"
+	queryCtxKey  = "query"
+	classCtxKey  = "class"
+	identCtxKey  = "identity"
+	accessCtxKey = "access"
+	longCtxKey   = "long"
 )
 
 func WithGroupKey(ctx context.Context, groupKey string) context.Context {
@@ -45,6 +65,61 @@ func GetGroupKey(ctx context.Context) string {
 	return ""
 }
 
+func WithQueryInfo(ctx context.Context, info QueryInfo) context.Context {
+	return context.WithValue(ctx, &queryCtxKey, info)
+}
+
+func GetQueryInfo(ctx context.Context) QueryInfo {
+	if info, ok := ctx.Value(&queryCtxKey).(QueryInfo); ok {
+		return info
+	}
+	return QueryInfo{}
+}
+
+func WithClass(ctx context.Context, class *GroupClass) context.Context {
+	return context.WithValue(ctx, &classCtxKey, class)
+}
+
+func GetClass(ctx context.Context) *GroupClass {
+	if class, ok := ctx.Value(&classCtxKey).(*GroupClass); ok {
+		return class
+	}
+	return nil
+}
+
+func WithIdentity(ctx context.Context, identity *Identity) context.Context {
+	return context.WithValue(ctx, &identCtxKey, identity)
+}
+
+func GetIdentity(ctx context.Context) *Identity {
+	if identity, ok := ctx.Value(&identCtxKey).(*Identity); ok {
+		return identity
+	}
+	return nil
+}
+
+func withAccessLog(ctx context.Context, access *accessLog) context.Context {
+	return context.WithValue(ctx, &accessCtxKey, access)
+}
+
+func getAccessLog(ctx context.Context) *accessLog {
+	if access, ok := ctx.Value(&accessCtxKey).(*accessLog); ok {
+		return access
+	}
+	return nil
+}
+
+func withLongQuery(ctx context.Context, rule *longQueryRule) context.Context {
+	return context.WithValue(ctx, &longCtxKey, rule)
+}
+
+func getLongQuery(ctx context.Context) *longQueryRule {
+	if rule, ok := ctx.Value(&longCtxKey).(*longQueryRule); ok {
+		return rule
+	}
+	return nil
+}
+
 func WithNode(ctx context.Context, node *Node) context.Context {
 	return context.WithValue(ctx, &nodeCtxKey, node)
 }
@@ -57,8 +132,15 @@ func GetNode(ctx context.Context) *Node {
 }
 
 func NewSimpleProxy(cfg *config.Config) (*SimpleProxy, error) {
-	if cfg.HeaderName == "" || len(cfg.Replicas) == 0 {
-		return nil, errors.New("header_name and replicas are required")
+	// Where the group key comes from (header_name, auth or tls.group_from) is
+	// checked by Validate
+	if len(cfg.Replicas) == 0 {
+		return nil, errors.New("replicas are required")
+	}
+	switch cfg.TLS.GroupFrom {
+	case "", "subject_cn", "san_dns", "san_email", "san_uri":
+	default:
+		return nil, fmt.Errorf("unknown tls.group_from %q", cfg.TLS.GroupFrom)
 	}
 
 	replicas := make([]*Replica, 0, len(cfg.Replicas))
@@ -69,154 +151,384 @@ func NewSimpleProxy(cfg *config.Config) (*SimpleProxy, error) {
 				nodesCfg = append(nodesCfg, node)
 			}
 		}
-		r, err := NewReplica(nodesCfg, cfg.ReplicaScheme, cfg.SlowdownRate, cfg.SlowdownBurst)
+		r, err := NewReplica(replicaConf, nodesCfg, cfg.ReplicaScheme, cfg.SlowdownRate, cfg.SlowdownBurst)
 		if err != nil {
 			return nil, fmt.Errorf("failed to create replica %v: %w", replicaConf.Name, err)
 		}
 		replicas = append(replicas, r)
 	}
 
-	// Basic HTTP client transport configuration
-	transport := &http.Transport{
-		MaxIdleConnsPerHost: 100,
-		IdleConnTimeout:     90 * time.Second,
-		// Add other settings like TLS config if needed
+	// HTTP client transport, from the transport section
+	transport := newTransport(cfg.Transport)
+	// Nodes with TLS or replica transport settings get their own transport
+	if err := setupNodeTransports(replicas, cfg.Transport, transport); err != nil {
+		return nil, err
 	}
 
 	// --- Use configured timeout, with a default ---
 	proxyTimeout := cfg.ProxyTimeout
 	if proxyTimeout <= 0 {
 		proxyTimeout = 120 * time.Second // Default if not set or invalid
-		log.Printf("Proxy timeout not configured, using default: %s", proxyTimeout)
+		slog.Info("Proxy timeout not configured, using default", "proxy_timeout", proxyTimeout)
 	}
 
 	var p = &SimpleProxy{
-		config:   cfg,
-		replicas: replicas,
+		config:       cfg,
+		replicas:     replicas,
+		proxyTimeout: proxyTimeout,
+		status:       newStatusTracker(),
 		httpClient: &http.Client{
-			Transport: transport,
+			Transport: &nodeTransport{shared: transport},
 			Timeout:   proxyTimeout,
 		},
 	}
 
+	classes, err := newGroupClasses(cfg)
+	if err != nil {
+		return nil, err
+	}
+	p.classes = classes
+
+	if cfg.Auth.Enabled {
+		auth, err := NewAuthenticator(cfg.Auth)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkBackendCredentials(cfg, replicas); err != nil {
+			return nil, err
+		}
+		auth.backendUsers = availableBackendUsers(cfg, replicas)
+		p.auth = auth
+	}
+
+	if cfg.Cache.Enabled {
+		cache, err := NewResponseCache(cfg.Cache)
+		if err != nil {
+			return nil, err
+		}
+		p.cache = cache
+	}
+
+	if cfg.Coalesce.Enabled {
+		p.coalescer = NewCoalescer(cfg.Coalesce)
+	}
+
+	if cfg.QueryStats.Enabled {
+		p.queryStats = NewQueryStats(cfg.QueryStats)
+	}
+
+	longQueries, err := newLongQueryRules(cfg.Streaming.LongQueries)
+	if err != nil {
+		return nil, err
+	}
+	p.longQueries = longQueries
+
+	if cfg.PolicyFile != "" {
+		policy, err := NewPolicyEngine(cfg.PolicyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load policy file %s: %w", cfg.PolicyFile, err)
+		}
+		p.policy = policy
+		go policy.Watch(cfg.PolicyReloadInterval)
+	}
+
 	reverseProxy := &httputil.ReverseProxy{
 		Director: func(req *http.Request) {
-			node := GetNode(req.Context())
-			req.URL.Scheme = node.URL.Scheme
-			req.URL.Host = node.URL.Host
-			req.URL.Path = req.URL.Path // Use original path
-			req.Host = node.URL.Host    // Set Host header
-			// Optional: Remove the grouping header
-			req.Header.Del(p.config.HeaderName)
-			if p.config.UserAgent != "" {
-				req.Header.Set("User-Agent", p.config.UserAgent)
+			p.directTo(req, GetNode(req.Context()))
+			// Enforce the group class settings (max_execution_time, readonly, ...)
+			params := req.URL.Query()
+			if class := GetClass(req.Context()); class != nil {
+				class.Apply(params)
+			}
+			// Don't let ClickHouse run longer than the client is willing to wait
+			if deadline, ok := req.Context().Deadline(); ok {
+				capExecutionTime(params, deadline)
 			}
-			req.URL.RawQuery = req.URL.RawQuery
+			// Keep the connection busy while a long query has nothing to send
+			if getLongQuery(req.Context()) != nil {
+				requestProgress(params, p.config.Streaming.ProgressInterval)
+			}
+			req.URL.RawQuery = params.Encode()
 		},
 		Transport: p.httpClient.Transport,
 		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
 			replica := GetNode(req.Context())
 			groupKey := GetGroupKey(req.Context())
-			log.Printf("Group %q: Proxy error to %s: %v", groupKey, replica.URL.Host, err)
+			slog.Warn("Proxy error", "group", groupKey, "node", replica.Address, "err", err)
+			if access := getAccessLog(req.Context()); access != nil {
+				access.upstreamErr = err.Error()
+			}
 			// Check for specific errors like context cancellation or timeout
 			statusCode := http.StatusBadGateway
 			// Check if the error is a timeout from the http client
 			var netErr net.Error
 			if errors.As(err, &netErr) && netErr.Timeout() {
 				statusCode = http.StatusGatewayTimeout // More specific error for timeouts
-			} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
-				statusCode = 499 // Client closed request or deadline exceeded before sending
+			} else if errors.Is(err, context.DeadlineExceeded) {
+				statusCode = http.StatusGatewayTimeout // Upstream timeout (proxy_timeout or insert timeout)
+			} else if errors.Is(err, context.Canceled) {
+				statusCode = 499 // Client closed request
 			}
 			// Ensure header isn't already sent before writing header
 			// (httputil usually handles this, but good practice)
 			if _, ok := w.(http.Hijacker); !ok { // Check if response hasn't been hijacked
 				w.WriteHeader(statusCode)
 			} else {
-				log.Printf("Group %q: Cannot write header for error on hijacked connection to %s", groupKey, replica.URL.Host)
+				slog.Warn("Cannot write header for error on hijacked connection", "group", groupKey, "node", replica.Address)
 			}
 		},
-		ModifyResponse: func(resp *http.Response) error {
-			node := GetNode(resp.Request.Context())
-			groupKey := GetGroupKey(resp.Request.Context())
-			// TODO modify should not decide on slowing down, it should only put info about the instance state.
-
-			// Check if this response indicates the need to slow down
-			// WARNING: Reading the body is tricky. Best if CH provides a header or specific status code.
-			shouldSlowDown := false
-			if p.config.SlowdownCode > 0 && resp.StatusCode == p.config.SlowdownCode {
-				shouldSlowDown = true
-			}
-
-			// If checking body content is necessary:
-			if !shouldSlowDown && p.config.SlowdownError != "" && (resp.StatusCode >= 500 || resp.StatusCode == http.StatusServiceUnavailable) {
-				// Read body (up to a limit to avoid memory issues)
-				const maxBodyRead = 1 * 1024 * 1024 // 1MB limit
-				bodyBytes, readErr := io.ReadAll(io.LimitReader(resp.Body, maxBodyRead))
-				// Always close the original body reader *after* trying to read
-				if closeErr := resp.Body.Close(); closeErr != nil {
-					log.Printf("Group %q: Error closing original response body from %s: %v", groupKey, node.URL.Host, closeErr)
-				}
-
-				if readErr == nil {
-					// Restore the body for the client
-					resp.Body = io.NopCloser(bytes.NewReader(bodyBytes))
-					resp.ContentLength = int64(len(bodyBytes)) // May need adjustment if original was chunked/unknown
-					// Ensure Transfer-Encoding is removed if ContentLength is set.
-					// The Go http server usually handles this, but explicit can be safer.
-					resp.Header.Del("Transfer-Encoding")
-
-					// Check if the error message is present
-					if strings.Contains(string(bodyBytes), p.config.SlowdownError) {
-						shouldSlowDown = true
-					}
-				} else {
-					log.Printf("Group %q: Error reading response body from %s for slowdown check: %v", groupKey, node.URL.Host, readErr)
-					// Cannot check body, maybe return error to proxy?
-					// If we return an error here, the client gets a generic Bad Gateway.
-					// return fmt.Errorf("failed to read response body: %w", readErr)
-					// If we return nil, the potentially erroneous (but unreadable) response goes to client.
-				}
-			}
+		ModifyResponse: p.checkResponse, // Slowdown triggers and exceptions, also mid-stream
+		// Stream results (JSONEachRow, exports, ...) as ClickHouse produces them
+		FlushInterval: flushInterval(cfg.Streaming),
+	}
 
-			if shouldSlowDown {
-				log.Printf("Group %q: Triggering slowdown for replica %s", groupKey, node.URL.Host)
-				if node != nil {
-					node.Replica.SlowDown()
-				}
-			}
-			return nil // Return nil even if slowdown triggered
-		},
-		// Add FlushInterval for streaming responses if needed
-		// FlushInterval: -1, // Use Go's default flushing
+	if cfg.Tracing.Enabled {
+		// Below hedging, so every attempt gets its own span
+		reverseProxy.Transport = &tracingTransport{next: reverseProxy.Transport}
+	}
+	if cfg.Hedge.Enabled {
+		reverseProxy.Transport = newHedgeTransport(p, reverseProxy.Transport, cfg.Hedge)
 	}
 
 	p.reverseProxy = reverseProxy
+
+	if cfg.Audit.Enabled {
+		audit, err := NewAuditor(cfg.Audit, p)
+		if err != nil {
+			return nil, fmt.Errorf("failed to set up audit log: %w", err)
+		}
+		p.audit = audit
+	}
 	return p, nil
 }
 
-func (p *SimpleProxy) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
-	startTime := time.Now()
-
-	// 1. Get Group Key
-	groupKey := r.Header.Get(p.config.HeaderName)
-	if groupKey == "" {
-		slog.Debug("Missing header", "header", p.config.HeaderName)
-		http.Error(rw, fmt.Sprintf("Missing header: %s", p.config.HeaderName), http.StatusBadRequest)
-		return
+// directTo points an outgoing request at the given node. The original path
+// and query string are kept as sent by the client.
+func (p *SimpleProxy) directTo(req *http.Request, node *Node) {
+	req.URL.Scheme = node.URL.Scheme
+	req.URL.Host = node.URL.Host
+	req.Host = node.URL.Host // Set Host header
+	// Optional: Remove the grouping header
+	req.Header.Del(p.config.HeaderName)
+	if p.config.UserAgent != "" {
+		req.Header.Set("User-Agent", p.config.UserAgent)
 	}
+	p.applyCredentials(req, node)
+}
 
-	// 2. Get or Create Limiter for the group
-	limiterUntyped, _ := p.groupLimiters.LoadOrStore(groupKey, NewGroupLimiter(
+// groupLimiter returns the limiter for the group, creating it on first use.
+func (p *SimpleProxy) groupLimiter(groupKey string) *GroupLimiter {
+	if limiter, ok := p.groupLimiters.Load(groupKey); ok {
+		return limiter.(*GroupLimiter)
+	}
+	limiter, _ := p.groupLimiters.LoadOrStore(groupKey, NewGroupLimiter(
 		p.config.MaxConcurrent,
 		p.config.MaxQueue,
 		p.config.QueueTimeout,
 	))
-	limiter := limiterUntyped.(*GroupLimiter)
+	return limiter.(*GroupLimiter)
+}
+
+// limiterFor returns the limiter a request of the given kind must acquire.
+// INSERTs get their own per-group limiter when insert limits are configured.
+func (p *SimpleProxy) limiterFor(groupKey string, kind QueryKind) *GroupLimiter {
+	insertCfg := p.config.Insert
+	if kind != QueryInsert || insertCfg.MaxConcurrent <= 0 {
+		return p.groupLimiter(groupKey)
+	}
+	if limiter, ok := p.insertLimiters.Load(groupKey); ok {
+		return limiter.(*GroupLimiter)
+	}
+	queueTimeout := insertCfg.QueueTimeout
+	if queueTimeout <= 0 {
+		queueTimeout = p.config.QueueTimeout
+	}
+	limiter, _ := p.insertLimiters.LoadOrStore(groupKey, NewGroupLimiter(
+		insertCfg.MaxConcurrent,
+		insertCfg.MaxQueue,
+		queueTimeout,
+	))
+	return limiter.(*GroupLimiter)
+}
+
+// upstreamTimeout returns how long a request of the given kind may take
+// upstream. Long queries use the timeout of their rule, if it has one.
+func (p *SimpleProxy) upstreamTimeout(kind QueryKind, long *longQueryRule) time.Duration {
+	if long != nil && long.timeout > 0 {
+		return long.timeout
+	}
+	if kind == QueryInsert && p.config.Insert.Timeout > 0 {
+		return p.config.Insert.Timeout
+	}
+	return p.proxyTimeout
+}
+
+// replicaLabelsFor returns the labels a replica must have to serve the kind.
+func (p *SimpleProxy) replicaLabelsFor(kind QueryKind) map[string]string {
+	if kind == QueryInsert {
+		return p.config.Insert.ReplicaLabels
+	}
+	return nil
+}
+
+func (p *SimpleProxy) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	startTime := time.Now()
+	p.inFlight.Add(1)
+	defer p.inFlight.Add(-1)
+	access := newAccessLog(rw, r, startTime)
+	defer access.write() // One access log line per request, whatever happens
+	if p.audit != nil {
+		defer p.audit.Record(access) // Runs just before write, when the response is done
+	}
+	if p.queryStats != nil {
+		defer p.queryStats.Record(access)
+	}
+	defer p.status.record(access) // Rejection counts, recent errors and node health
+	rw = access.rw
+	ctx, span := startRequestSpan(r) // Continues the client's traceparent, if any
+	defer endRequestSpan(span, access)
+	ctx = withAccessLog(ctx, access)
+	if sc := span.SpanContext(); sc.IsSampled() {
+		access.traceID = sc.TraceID().String()
+	}
+
+	// 1. Get Group Key (from the authenticated identity when auth is enabled)
+	user := requestUser(r)
+	var groupKey string
+	if p.auth != nil {
+		identity, err := p.auth.Authenticate(r)
+		if err != nil {
+			slog.Warn("Authentication failed", "remote", r.RemoteAddr, "err", err)
+			access.reject(rejectUnauthenticated)
+			rw.Header().Set("WWW-Authenticate", `Basic realm="clickhouse"`)
+			writeClickHouseError(rw, http.StatusUnauthorized, errCodeAuthenticationFailed, "AUTHENTICATION_FAILED", "Authentication failed")
+			return
+		}
+		ctx = WithIdentity(ctx, identity)
+		groupKey, user = identity.Group, identity.Name
+	} else if p.config.TLS.GroupFrom != "" {
+		certKey, err := certGroupKey(r.TLS, p.config.TLS.GroupFrom)
+		if err != nil {
+			slog.Warn("Client certificate rejected", "remote", r.RemoteAddr, "err", err)
+			access.reject(rejectUnauthenticated)
+			writeClickHouseError(rw, http.StatusUnauthorized, errCodeAuthenticationFailed, "AUTHENTICATION_FAILED", "Client certificate required")
+			return
+		}
+		groupKey = certKey
+	} else {
+		groupKey = r.Header.Get(p.config.HeaderName)
+		if groupKey == "" {
+			slog.Debug("Missing header", "header", p.config.HeaderName, "remote", r.RemoteAddr)
+			access.reject(rejectMissingGroup)
+			http.Error(rw, fmt.Sprintf("Missing header: %s", p.config.HeaderName), http.StatusBadRequest)
+			return
+		}
+	}
+	access.groupKey, access.user = groupKey, user
+
+	// 2. Classify the statement (SELECT, INSERT, DDL, ...)
+	queryInfo := ClassifyRequest(r)
+	ctx = WithQueryInfo(WithGroupKey(ctx, groupKey), queryInfo)
+	access.kind, access.query, access.truncated = queryInfo.Kind, queryInfo.Query, queryInfo.Truncated
+
+	// 3. Enforce query policy before taking any slot
+	if p.policy != nil {
+		violation := p.policy.Check(PolicyRequest{
+			Group:    groupKey,
+			User:     user,
+			Database: requestDatabase(r),
+			Query:    queryInfo,
+		})
+		if violation != nil {
+			slog.Info("Query denied by policy", "group", groupKey, "rule", violation.Rule, "reason", violation.Reason)
+			access.reject(rejectPolicy)
+			writeClickHouseError(rw, http.StatusForbidden, errCodeAccessDenied, "ACCESS_DENIED", violation.Error())
+			return
+		}
+	}
+
+	// 4. Check settings against the group class caps
+	class := p.classes.lookup(groupKey, GetIdentity(ctx))
+	if class != nil {
+		if err := class.CheckSettings(r.URL.Query(), queryInfo); err != nil {
+			slog.Info("Settings rejected", "group", groupKey, "class", class.Name, "err", err)
+			access.reject(rejectSettings)
+			writeClickHouseError(rw, http.StatusBadRequest, errCodeSettingConstraintViolation, "SETTING_CONSTRAINT_VIOLATION", err.Error())
+			return
+		}
+		ctx = WithClass(ctx, class)
+	}
 
-	// 3. Acquire Concurrency Slot (handles queueing)
-	ctx := r.Context()
-	if err := limiter.Acquire(ctx); err != nil {
-		log.Printf("Group %q: Failed to acquire slot: %v", groupKey, err)
+	// The write deadline follows the data from here, for cached and shared
+	// responses as well as our own
+	long := p.longQuery(groupKey, user, class, queryInfo)
+	if long != nil {
+		access.longQuery = long.name
+		ctx = withLongQuery(ctx, long)
+	}
+	rw = p.newDeadlineWriter(rw, long, startTime)
+
+	// 5. Serve repeated SELECTs from the cache; hits take no slot
+	cacheFilling := false
+	if p.cache != nil {
+		if key, ttl, ok := p.cache.Key(r.WithContext(ctx), groupKey, user, queryInfo); ok {
+			cached, fill := p.cache.Get(ctx, key, ttl)
+			if cached != nil {
+				access.shared = "cache"
+				writeCachedResponse(rw, cached)
+				return
+			}
+			if fill != nil {
+				defer fill.Complete(nil) // Releases waiters if we fail before a response
+				recorder := &cacheRecorder{ResponseWriter: rw, limit: p.cache.maxEntrySize}
+				defer func() {
+					// The reverse proxy aborts with a panic when the upstream
+					// body breaks or the deadline hits; what we have is partial
+					if aborted := recover(); aborted != nil {
+						fill.Complete(nil)
+						panic(aborted)
+					}
+					fill.Complete(recorder.response())
+				}()
+				rw = recorder
+				rw.Header().Set(cacheHeader, "MISS")
+				cacheFilling = true
+			}
+		}
+	}
+
+	// 6. Share the execution of an identical in-flight SELECT; followers take no slot
+	if p.coalescer != nil && !cacheFilling {
+		if key, ok := coalesceKey(r.WithContext(ctx), groupKey, user, queryInfo); ok {
+			flight, reader := p.coalescer.Join(key)
+			if reader != nil {
+				if flight.Follow(ctx, rw, reader) {
+					access.shared = "coalesced"
+					return
+				}
+				slog.Debug("Shared request failed, sending on its own", "group", groupKey, "kind", queryInfo.Kind.String())
+			} else {
+				defer p.coalescer.finish(key, flight)
+				rw = flight.Writer(rw)
+				ctx = flight.detach(ctx) // Followers keep the execution going if our client leaves
+			}
+		}
+	}
+
+	// 7. Get or Create Limiter for the group (inserts may have their own)
+	limiter := p.limiterFor(groupKey, queryInfo.Kind)
+
+	// 8. Acquire Concurrency Slot (handles queueing)
+	queueStart := time.Now() // Cache and coalescing waits above are not queueing
+	p.queued.Add(1)
+	acquireCtx, acquireSpan := tracer.Start(ctx, "GroupLimiter.Acquire",
+		trace.WithAttributes(attribute.String("proxy.group", groupKey)))
+	err := limiter.Acquire(acquireCtx)
+	endSpan(acquireSpan, err)
+	p.queued.Add(-1)
+	access.queueWait = time.Since(queueStart)
+	if err != nil {
+		access.reject(rejectReason(err))
 		statusCode := http.StatusServiceUnavailable
 		if errors.Is(err, ErrQueueFull) || errors.Is(err, ErrQueueTimeout) {
 			statusCode = http.StatusTooManyRequests
@@ -228,35 +540,97 @@ func (p *SimpleProxy) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 	}
 	defer limiter.Release() // IMPORTANT: Release the slot when done
 
-	// 4. Select Replica (Simple Round Robin - NEEDS HEALTH CHECKS FOR PROD)
-	replica := p.selectReplica()
+	// 9. Select Replica (Simple Round Robin - NEEDS HEALTH CHECKS FOR PROD)
+	replica := p.selectReplica(p.replicaLabelsFor(queryInfo.Kind))
 	if replica == nil {
-		log.Printf("Group %q: No replicas available", groupKey)
+		slog.Warn("No replicas available", "group", groupKey, "kind", queryInfo.Kind.String())
+		access.reject(rejectNoReplica)
 		http.Error(rw, "No available backend replicas", http.StatusServiceUnavailable)
 		return
 	}
 
-	// 5. Wait for Replica's Rate Limiter
-	if err := replica.Wait(ctx); err != nil {
-		log.Printf("Group %q: Replica %s rate limit wait error: %v", groupKey, replica.Name, err)
+	// 10. Wait for Replica's Rate Limiter
+	waitCtx, waitSpan := tracer.Start(ctx, "Replica.Wait", trace.WithAttributes(
+		attribute.String("proxy.group", groupKey),
+		attribute.String("proxy.replica", replica.Name)))
+	err = replica.Wait(waitCtx)
+	endSpan(waitSpan, err)
+	access.queueWait = time.Since(queueStart)
+	if err != nil {
 		statusCode := http.StatusServiceUnavailable
+		access.reject(rejectRateLimited)
 		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
 			statusCode = 499
+			access.reject(rejectCanceled)
 		}
 		http.Error(rw, "Backend replica rate limited or request cancelled", statusCode)
 		return
 	}
 
-	// 7. Serve the request
+	// 11. Serve the request
 	node := replica.NextNode()
-	log.Printf("Group %q: Proxying to %s (Queued/Limited: %t)", groupKey, node.Address, time.Since(startTime) > 10*time.Millisecond) // Basic indicator if it waited
-	newR := r.WithContext(WithNode(WithGroupKey(r.Context(), groupKey), node))
+	access.node = node.Address
+	deadline := p.requestDeadline(r, queryInfo.Kind, long, startTime)
+	if !time.Now().Before(deadline) {
+		access.reject(rejectDeadline)
+		writeClickHouseError(rw, http.StatusGatewayTimeout, errCodeTimeoutExceeded, "TIMEOUT_EXCEEDED", "Timeout exceeded while waiting in proxy queue")
+		return
+	}
+	upstreamCtx, cancel := context.WithDeadline(WithNode(ctx, node), deadline)
+	defer cancel()
+	newR := r.WithContext(upstreamCtx)
+	upstreamStart := time.Now()
+	defer func() {
+		access.upstream = time.Since(upstreamStart) // Deferred so aborted copies are counted too
+		// The reverse proxy panics when the body copy breaks off, after the
+		// status was sent; the server still needs to see the panic
+		if aborted := recover(); aborted != nil {
+			access.aborted = true
+			panic(aborted)
+		}
+	}()
 	p.reverseProxy.ServeHTTP(rw, newR)
-	log.Printf("Group %q: Finished request to %s (Duration: %s)", groupKey, replica.Name, time.Since(startTime))
 }
 
-// selectReplica implements simple round-robin. NEEDS HEALTH CHECKS.
-func (p *SimpleProxy) selectReplica() *Replica {
+// ClickHouse error codes used in proxy-generated errors.
+const (
+	errCodeAccessDenied = 497
+)
+
+// writeClickHouseError writes an error in the format ClickHouse itself uses,
+// so clients surface it like any other server exception.
+func writeClickHouseError(rw http.ResponseWriter, statusCode, code int, name, message string) {
+	rw.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+	rw.Header().Set("X-ClickHouse-Exception-Code", strconv.Itoa(code))
+	rw.WriteHeader(statusCode)
+	fmt.Fprintf(rw, "Code: %d. DB::Exception: %s. (%s)\n", code, message, name)
+}
+
+// requestUser returns the ClickHouse user the client authenticates as.
+func requestUser(r *http.Request) string {
+	if user := r.Header.Get("X-ClickHouse-User"); user != "" {
+		return user
+	}
+	if user := r.URL.Query().Get("user"); user != "" {
+		return user
+	}
+	if user, _, ok := r.BasicAuth(); ok && user != "" {
+		return user
+	}
+	return "default"
+}
+
+// requestDatabase returns the database selected by the client, if any.
+func requestDatabase(r *http.Request) string {
+	if db := r.Header.Get("X-ClickHouse-Database"); db != "" {
+		return db
+	}
+	return r.URL.Query().Get("database")
+}
+
+// selectReplica implements simple round-robin over the replicas carrying the
+// given labels (all replicas if labels is empty). NEEDS HEALTH CHECKS.
+func (p *SimpleProxy) selectReplica(labels map[string]string) *Replica {
 	numReplicas := uint32(len(p.replicas))
 	if numReplicas == 0 {
 		return nil
@@ -265,8 +639,14 @@ func (p *SimpleProxy) selectReplica() *Replica {
 	// Atomically get the next index
 	idx := atomic.AddUint32(&p.nextReplica, 1) - 1
 
-	// Basic round robin - wrap around
-	selected := p.replicas[idx%numReplicas]
+	// Basic round robin - wrap around, skipping replicas without the labels
+	var selected *Replica
+	for i := uint32(0); i < numReplicas; i++ {
+		if r := p.replicas[(idx+i)%numReplicas]; r.HasLabels(labels) {
+			selected = r
+			break
+		}
+	}
 
 	// !!! Placeholder for health check !!!
 	// In production, you would loop here, checking health:
@@ -280,3 +660,18 @@ func (p *SimpleProxy) selectReplica() *Replica {
 
 	return selected
 }
+
+// selectReplicaExcept picks the next replica in round-robin order that is not
+// the excluded one. Returns nil if there is no other replica. It only looks
+// at the counter, so hedged requests do not shift the round-robin for
+// everyone else.
+func (p *SimpleProxy) selectReplicaExcept(exclude *Replica) *Replica {
+	numReplicas := uint32(len(p.replicas))
+	idx := atomic.LoadUint32(&p.nextReplica)
+	for i := uint32(0); i < numReplicas; i++ {
+		if r := p.replicas[(idx+i)%numReplicas]; r != exclude && len(r.Nodes) > 0 {
+			return r
+		}
+	}
+	return nil
+}
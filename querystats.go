@@ -0,0 +1,286 @@
+// --- querystats.go --- (Query fingerprints, rolling stats and the slow query log)
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"clickhouse-test/config"
+)
+
+const (
+	defaultStatsWindow          = 15 * time.Minute
+	defaultStatsMaxFingerprints = 1000
+	maxLatencySamples           = 512 // Per fingerprint and window, for percentiles
+	maxGroupsPerFingerprint     = 100
+	topGroupsReported           = 5
+)
+
+// fingerprintQuery normalizes a query into its shape: literals become ?,
+// lists of them collapse to a single ?, comments and formatting are dropped.
+// It returns a short id for the shape and the shape itself.
+func fingerprintQuery(query string, kind QueryKind) (id, text string) {
+	var texts []string
+	for _, tok := range tokenize(auditQuery(query, kind)) {
+		t := tok.text
+		if tok.kind == tokString || tok.kind == tokNumber {
+			t = "?"
+		}
+		// "IN (1, 2, 3)" and "IN (4, 5)" are the same query
+		if n := len(texts); t == "?" && n >= 2 && texts[n-1] == "," && texts[n-2] == "?" {
+			texts = texts[:n-1]
+			continue
+		}
+		texts = append(texts, t)
+	}
+	text = strings.Join(texts, " ")
+	sum := sha256.Sum256([]byte(text))
+	return hex.EncodeToString(sum[:8]), text
+}
+
+// fingerprintBucket holds the stats of one fingerprint for one window.
+type fingerprintBucket struct {
+	query     string
+	count     int64
+	errors    int64
+	bytesRead uint64
+	totalTime time.Duration
+	latencies []time.Duration // Ring of the latest samples
+	next      int
+	groups    map[string]int64
+}
+
+func (b *fingerprintBucket) addLatency(d time.Duration) {
+	if len(b.latencies) < maxLatencySamples {
+		b.latencies = append(b.latencies, d)
+		return
+	}
+	b.latencies[b.next] = d
+	b.next = (b.next + 1) % maxLatencySamples
+}
+
+// QueryStats keeps per-fingerprint stats of the queries sent to ClickHouse.
+// Stats are kept for the current and the previous window, so reports cover
+// between one and two windows and old queries age out.
+type QueryStats struct {
+	window          time.Duration
+	maxFingerprints int
+	slowThreshold   time.Duration
+
+	mu            sync.Mutex
+	windowStart   time.Time
+	current       map[string]*fingerprintBucket
+	previous      map[string]*fingerprintBucket
+	untracked     int64 // Queries not tracked because max_fingerprints was reached
+	untrackedPrev int64
+}
+
+func NewQueryStats(cfg config.QueryStatsConfig) *QueryStats {
+	window := cfg.Window
+	if window <= 0 {
+		window = defaultStatsWindow
+	}
+	maxFingerprints := cfg.MaxFingerprints
+	if maxFingerprints <= 0 {
+		maxFingerprints = defaultStatsMaxFingerprints
+	}
+	return &QueryStats{
+		window:          window,
+		maxFingerprints: maxFingerprints,
+		slowThreshold:   cfg.SlowQueryThreshold,
+		windowStart:     time.Now(),
+		current:         make(map[string]*fingerprintBucket),
+		previous:        make(map[string]*fingerprintBucket),
+	}
+}
+
+// Record adds a finished request to the stats. Only requests that ClickHouse
+// executed are counted; rejected, cached and coalesced ones are not.
+func (s *QueryStats) Record(l *accessLog) {
+	if l.node == "" || l.rejected != "" || l.shared != "" || l.query == "" {
+		return
+	}
+	id, text := fingerprintQuery(l.query, l.kind)
+	header := l.rw.Header()
+	_, readBytes := parseSummary(header.Get("X-ClickHouse-Summary"))
+	statusCode := l.statusCode()
+	// An exception at the end of a 200 body or a copy that broke off failed
+	// just the same
+	exceptionCode, _ := l.clickhouseException()
+	failed := statusCode >= http.StatusBadRequest || exceptionCode != 0 || l.upstreamErr != "" || l.aborted
+
+	if s.slowThreshold > 0 && l.upstream >= s.slowThreshold {
+		slog.Warn("slow query", "group", l.groupKey, "user", l.user, "fingerprint", id, "query", text,
+			"query_id", l.queryID(), "node", l.node, "status", statusCode, "bytes_read", readBytes,
+			"upstream", l.upstream, "queue_wait", l.queueWait)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rotateLocked(time.Now())
+	b, ok := s.current[id]
+	if !ok {
+		if len(s.current) >= s.maxFingerprints {
+			s.untracked++
+			return
+		}
+		b = &fingerprintBucket{query: text, groups: make(map[string]int64)}
+		s.current[id] = b
+	}
+	b.count++
+	if failed {
+		b.errors++
+	}
+	b.bytesRead += readBytes
+	b.totalTime += l.upstream
+	b.addLatency(l.upstream)
+	if _, ok := b.groups[l.groupKey]; ok || len(b.groups) < maxGroupsPerFingerprint {
+		b.groups[l.groupKey]++
+	}
+}
+
+// rotateLocked starts a new window when the current one is over.
+func (s *QueryStats) rotateLocked(now time.Time) {
+	elapsed := now.Sub(s.windowStart)
+	if elapsed < s.window {
+		return
+	}
+	if elapsed < 2*s.window {
+		s.previous, s.untrackedPrev = s.current, s.untracked
+	} else {
+		// Idle for more than a window, the current one is stale too
+		s.previous, s.untrackedPrev = make(map[string]*fingerprintBucket), 0
+	}
+	s.current, s.untracked = make(map[string]*fingerprintBucket), 0
+	s.windowStart = now
+}
+
+// GroupCount is a group and its number of queries.
+type GroupCount struct {
+	Group string `json:"group"`
+	Count int64  `json:"count"`
+}
+
+// FingerprintStats is the report for one fingerprint.
+type FingerprintStats struct {
+	Fingerprint string       `json:"fingerprint"`
+	Query       string       `json:"query"`
+	Count       int64        `json:"count"`
+	ErrorRate   float64      `json:"error_rate"`
+	P50Ms       float64      `json:"p50_ms"`
+	P99Ms       float64      `json:"p99_ms"`
+	TotalTimeMs float64      `json:"total_time_ms"`
+	BytesRead   uint64       `json:"bytes_read"`
+	TopGroups   []GroupCount `json:"top_groups"`
+}
+
+// QueryStatsReport is what the admin API returns.
+type QueryStatsReport struct {
+	Since        time.Time          `json:"since"`
+	Untracked    int64              `json:"untracked"` // Queries beyond max_fingerprints
+	Fingerprints []FingerprintStats `json:"fingerprints"`
+}
+
+// Report returns the stats of up to limit fingerprints, worst first by the
+// given order: "time" (total time, the default), "count", "p99", "errors"
+// or "bytes".
+func (s *QueryStats) Report(order string, limit int) QueryStatsReport {
+	s.mu.Lock()
+	s.rotateLocked(time.Now())
+	report := QueryStatsReport{Since: s.windowStart.Add(-s.window), Untracked: s.untracked + s.untrackedPrev}
+	merged := make(map[string][]*fingerprintBucket)
+	for id, b := range s.previous {
+		merged[id] = append(merged[id], b)
+	}
+	for id, b := range s.current {
+		merged[id] = append(merged[id], b)
+	}
+	for id, buckets := range merged {
+		report.Fingerprints = append(report.Fingerprints, summarizeBuckets(id, buckets))
+	}
+	s.mu.Unlock()
+
+	less := map[string]func(a, b FingerprintStats) bool{
+		"time":   func(a, b FingerprintStats) bool { return a.TotalTimeMs > b.TotalTimeMs },
+		"count":  func(a, b FingerprintStats) bool { return a.Count > b.Count },
+		"p99":    func(a, b FingerprintStats) bool { return a.P99Ms > b.P99Ms },
+		"errors": func(a, b FingerprintStats) bool { return a.ErrorRate > b.ErrorRate },
+		"bytes":  func(a, b FingerprintStats) bool { return a.BytesRead > b.BytesRead },
+	}[order]
+	if less == nil {
+		less = func(a, b FingerprintStats) bool { return a.TotalTimeMs > b.TotalTimeMs }
+	}
+	fps := report.Fingerprints
+	sort.Slice(fps, func(i, j int) bool { return less(fps[i], fps[j]) })
+	if limit > 0 && len(fps) > limit {
+		report.Fingerprints = fps[:limit]
+	}
+	return report
+}
+
+func summarizeBuckets(id string, buckets []*fingerprintBucket) FingerprintStats {
+	stats := FingerprintStats{Fingerprint: id}
+	var errors int64
+	var totalTime time.Duration
+	var latencies []time.Duration
+	groups := make(map[string]int64)
+	for _, b := range buckets {
+		stats.Query = b.query
+		stats.Count += b.count
+		stats.BytesRead += b.bytesRead
+		errors += b.errors
+		totalTime += b.totalTime
+		latencies = append(latencies, b.latencies...)
+		for group, n := range b.groups {
+			groups[group] += n
+		}
+	}
+	if stats.Count > 0 {
+		stats.ErrorRate = float64(errors) / float64(stats.Count)
+	}
+	stats.TotalTimeMs = durationMs(totalTime)
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	stats.P50Ms = durationMs(percentile(latencies, 0.50))
+	stats.P99Ms = durationMs(percentile(latencies, 0.99))
+	for group, n := range groups {
+		stats.TopGroups = append(stats.TopGroups, GroupCount{Group: group, Count: n})
+	}
+	sort.Slice(stats.TopGroups, func(i, j int) bool {
+		if stats.TopGroups[i].Count != stats.TopGroups[j].Count {
+			return stats.TopGroups[i].Count > stats.TopGroups[j].Count
+		}
+		return stats.TopGroups[i].Group < stats.TopGroups[j].Group
+	})
+	if len(stats.TopGroups) > topGroupsReported {
+		stats.TopGroups = stats.TopGroups[:topGroupsReported]
+	}
+	return stats
+}
+
+// percentile returns the q-th percentile of sorted samples.
+func percentile(sorted []time.Duration, q float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[int(q*float64(len(sorted)-1))]
+}
+
+func durationMs(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// queryStatsParams reads the sort order and limit of a /queries request.
+func queryStatsParams(r *http.Request) (order string, limit int) {
+	limit = 50
+	if n, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && n > 0 {
+		limit = n
+	}
+	return r.URL.Query().Get("sort"), limit
+}
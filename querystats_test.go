@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"clickhouse-test/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFingerprintQuery(t *testing.T) {
+	id1, text := fingerprintQuery("SELECT * FROM t WHERE id IN (1, 2, 3) AND name = 'a' -- first", QuerySelect)
+	require.Equal(t, "SELECT * FROM t WHERE id IN ( ? ) AND name = ?", text)
+	id2, _ := fingerprintQuery("SELECT *\nFROM t WHERE id IN (4) AND name = 'b'", QuerySelect)
+	require.Equal(t, id1, id2)
+	id3, _ := fingerprintQuery("SELECT * FROM u WHERE id IN (4) AND name = 'b'", QuerySelect)
+	require.NotEqual(t, id1, id3)
+
+	_, text = fingerprintQuery("INSERT INTO t FORMAT TSV 1\t2\n", QueryInsert)
+	require.Equal(t, "INSERT INTO t FORMAT TSV", text)
+}
+
+func TestQueryStatsReport(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-ClickHouse-Summary", `{"read_rows":"10","read_bytes":"100"}`)
+		if strings.Contains(r.URL.Query().Get("query"), "missing") {
+			w.Header().Set("X-ClickHouse-Exception-Code", "60")
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte("1\n"))
+	}))
+	defer backend.Close()
+
+	cfg := &config.Config{
+		HeaderName:    "X-User-Id",
+		MaxConcurrent: 2,
+		MaxQueue:      1,
+		QueueTimeout:  time.Second,
+		Replicas:      []config.ReplicaConfig{{Name: "r1"}},
+		Nodes:         []config.NodeConfig{{Replica: "r1", Address: strings.TrimPrefix(backend.URL, "http://")}},
+		QueryStats:    config.QueryStatsConfig{Enabled: true},
+	}
+	p, err := NewSimpleProxy(cfg)
+	require.NoError(t, err)
+
+	send := func(group, query string) {
+		r := httptest.NewRequest(http.MethodGet, "/?query="+strings.ReplaceAll(query, " ", "+"), nil)
+		r.Header.Set("X-User-Id", group)
+		p.ServeHTTP(httptest.NewRecorder(), r)
+	}
+	send("a", "SELECT x FROM t WHERE id = 1")
+	send("a", "SELECT x FROM t WHERE id = 2")
+	send("b", "SELECT x FROM t WHERE id = 3")
+	send("b", "SELECT x FROM missing")
+	send("", "SELECT x FROM t WHERE id = 4") // Rejected, not counted
+
+	rw := httptest.NewRecorder()
+	newAdminHandler(p).ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/queries?sort=count", nil))
+	require.Equal(t, http.StatusOK, rw.Code)
+	var report QueryStatsReport
+	require.NoError(t, json.Unmarshal(rw.Body.Bytes(), &report))
+	require.Len(t, report.Fingerprints, 2)
+
+	top := report.Fingerprints[0]
+	require.Equal(t, "SELECT x FROM t WHERE id = ?", top.Query)
+	require.EqualValues(t, 3, top.Count)
+	require.EqualValues(t, 300, top.BytesRead)
+	require.Zero(t, top.ErrorRate)
+	require.Equal(t, []GroupCount{{Group: "a", Count: 2}, {Group: "b", Count: 1}}, top.TopGroups)
+
+	require.EqualValues(t, 1, report.Fingerprints[1].Count)
+	require.Equal(t, 1.0, report.Fingerprints[1].ErrorRate)
+}
+
+func TestQueryStatsCountsBrokenResponses(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query().Get("query")
+		w.Write([]byte("1\n"))
+		switch {
+		case strings.Contains(query, "exception"):
+			// Failed after the 200 was sent
+			w.Write([]byte("Code: 241. DB::Exception: Memory limit (total) exceeded. (MEMORY_LIMIT_EXCEEDED) (version 23.8.1.1)\n"))
+		case strings.Contains(query, "broken"):
+			w.(http.Flusher).Flush()
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err == nil {
+				conn.Close()
+			}
+		}
+	}))
+	defer backend.Close()
+
+	cfg := &config.Config{
+		HeaderName:    "X-User-Id",
+		MaxConcurrent: 2,
+		QueueTimeout:  time.Second,
+		Replicas:      []config.ReplicaConfig{{Name: "r1"}},
+		Nodes:         []config.NodeConfig{{Replica: "r1", Address: strings.TrimPrefix(backend.URL, "http://")}},
+		QueryStats:    config.QueryStatsConfig{Enabled: true},
+	}
+	p, err := NewSimpleProxy(cfg)
+	require.NoError(t, err)
+	srv := httptest.NewServer(p) // A real server, so the reverse proxy aborts the handler
+	defer srv.Close()
+
+	for _, table := range []string{"ok", "exception", "broken"} {
+		req, err := http.NewRequest(http.MethodGet, srv.URL+"/?query=SELECT+x+FROM+"+table, nil)
+		require.NoError(t, err)
+		req.Header.Set("X-User-Id", "123")
+		resp, err := srv.Client().Do(req)
+		require.NoError(t, err)
+		io.Copy(io.Discard, resp.Body) // Fails for the broken one
+		resp.Body.Close()
+	}
+
+	errorRates := func() map[string]float64 {
+		rw := httptest.NewRecorder()
+		newAdminHandler(p).ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/queries", nil))
+		var report QueryStatsReport
+		require.NoError(t, json.Unmarshal(rw.Body.Bytes(), &report))
+		rates := make(map[string]float64)
+		for _, f := range report.Fingerprints {
+			rates[f.Query] = f.ErrorRate
+		}
+		return rates
+	}
+	want := map[string]float64{
+		"SELECT x FROM ok":        0,
+		"SELECT x FROM exception": 1,
+		"SELECT x FROM broken":    1,
+	}
+	require.Eventually(t, func() bool { return assert.ObjectsAreEqual(want, errorRates()) }, time.Second, 10*time.Millisecond)
+}
@@ -4,7 +4,8 @@ package main
 import (
 	"clickhouse-test/config"
 	"context"
-	"log"
+	"log/slog"
+	"net/http"
 	"net/url"
 	"sync"
 	"sync/atomic"
@@ -13,14 +14,20 @@ import (
 )
 
 type Node struct {
-	URL     *url.URL
-	Address string
-	Replica *Replica
+	URL           *url.URL
+	Address       string
+	NativeAddress string // host:port of the native protocol, empty if not configured
+	Replica       *Replica
+	TLS           *config.BackendTLSConfig // Node or replica TLS settings, nil for defaults
+	transport     http.RoundTripper        // Set by the proxy; nil uses the shared transport
 }
 
 // Replica represents a backend ClickHouse node with its own rate limiter
 type Replica struct {
 	Name         string
+	Labels       map[string]string
+	Credentials  map[string]config.Credentials // Backend user -> ClickHouse credentials
+	Transport    *config.TransportConfig       // Connection settings of the replica, nil for the shared transport
 	Nodes        []*Node
 	limiter      *rate.Limiter
 	mu           sync.Mutex // Protects limiter state changes
@@ -31,7 +38,7 @@ type Replica struct {
 	nextNode uint32
 }
 
-func NewReplica(nodesConfig []config.NodeConfig, scheme string, slowRate float64, slowBurst int) (*Replica, error) {
+func NewReplica(replicaConfig config.ReplicaConfig, nodesConfig []config.NodeConfig, scheme string, slowRate float64, slowBurst int) (*Replica, error) {
 	if scheme == "" {
 		scheme = "http"
 	}
@@ -40,9 +47,13 @@ func NewReplica(nodesConfig []config.NodeConfig, scheme string, slowRate float64
 		// Start with no rate limit (Infinite rate, burst of 1 is effectively no limit)
 		limiter = rate.NewLimiter(rate.Inf, 1)
 		replica = &Replica{
-			limiter:   limiter,
-			slowRate:  rate.Limit(slowRate),
-			slowBurst: slowBurst,
+			Name:        replicaConfig.Name,
+			Labels:      replicaConfig.Labels,
+			Credentials: replicaConfig.Credentials,
+			Transport:   replicaConfig.Transport,
+			limiter:     limiter,
+			slowRate:    rate.Limit(slowRate),
+			slowBurst:   slowBurst,
 		}
 	)
 	for _, node := range nodesConfig {
@@ -51,7 +62,17 @@ func NewReplica(nodesConfig []config.NodeConfig, scheme string, slowRate float64
 		if err != nil {
 			return nil, err
 		}
-		nodes = append(nodes, &Node{URL: parsedURL, Address: parsedURL.String(), Replica: replica})
+		tlsConfig := node.TLS
+		if tlsConfig == nil {
+			tlsConfig = replicaConfig.TLS
+		}
+		nodes = append(nodes, &Node{
+			URL:           parsedURL,
+			Address:       parsedURL.String(),
+			NativeAddress: node.NativeAddress,
+			Replica:       replica,
+			TLS:           tlsConfig,
+		})
 	}
 	replica.Nodes = nodes
 
@@ -63,13 +84,29 @@ func (r *Replica) Wait(ctx context.Context) error {
 	return r.limiter.Wait(ctx)
 }
 
+// HasLabels reports whether the replica carries all the given labels.
+func (r *Replica) HasLabels(labels map[string]string) bool {
+	for k, v := range labels {
+		if r.Labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// Allow reports whether a request may be sent to the replica right now,
+// without waiting for the rate limiter.
+func (r *Replica) Allow() bool {
+	return r.limiter.Allow()
+}
+
 // SlowDown reduces the rate limit for this replica.
 func (r *Replica) SlowDown() {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 	// Avoid repeatedly setting the limit if already slowed down
 	if !r.isSlowedDown {
-		log.Printf("Slowing down replica %s to %v req/sec", r.Nodes[0].Address, r.slowRate)
+		slog.Warn("Slowing down replica", "replica", r.Name, "rate", float64(r.slowRate))
 		r.limiter.SetLimit(r.slowRate)
 		r.limiter.SetBurst(r.slowBurst)
 		r.isSlowedDown = true
@@ -77,6 +114,14 @@ func (r *Replica) SlowDown() {
 	}
 }
 
+// RateLimit returns the replica's current rate limit (rate.Inf when not
+// limited), its burst and whether it has been slowed down.
+func (r *Replica) RateLimit() (limit rate.Limit, burst int, slowedDown bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.limiter.Limit(), r.limiter.Burst(), r.isSlowedDown
+}
+
 func (r *Replica) NextNode() *Node {
 	idx := atomic.AddUint32(&r.nextNode, 1) - 1
 	return r.Nodes[idx%uint32(len(r.Nodes))]
@@ -0,0 +1,151 @@
+// --- settings.go --- (Per-class ClickHouse settings injection and caps)
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"clickhouse-test/config"
+)
+
+const errCodeSettingConstraintViolation = 452
+
+// GroupClass holds the ClickHouse settings enforced for a class of groups.
+type GroupClass struct {
+	Name        string
+	Settings    map[string]string  // Always set, overriding the client
+	MaxSettings map[string]float64 // Client values above these are rejected
+}
+
+func newGroupClass(cfg config.ClassConfig) (*GroupClass, error) {
+	class := &GroupClass{
+		Name:        cfg.Name,
+		Settings:    cfg.Settings,
+		MaxSettings: make(map[string]float64, len(cfg.MaxSettings)),
+	}
+	for name, value := range cfg.MaxSettings {
+		limit, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("class %q: max_settings.%s must be numeric: %w", cfg.Name, name, err)
+		}
+		class.MaxSettings[name] = limit
+	}
+	return class, nil
+}
+
+// groupClasses indexes the configured classes.
+type groupClasses struct {
+	byGroup      map[string]*GroupClass
+	byName       map[string]*GroupClass
+	defaultClass *GroupClass // Class for groups not listed, may be nil
+}
+
+func newGroupClasses(cfg *config.Config) (*groupClasses, error) {
+	classes := &groupClasses{
+		byGroup: make(map[string]*GroupClass),
+		byName:  make(map[string]*GroupClass),
+	}
+	for _, classCfg := range cfg.Classes {
+		class, err := newGroupClass(classCfg)
+		if err != nil {
+			return nil, err
+		}
+		classes.byName[class.Name] = class
+		for _, group := range classCfg.Groups {
+			classes.byGroup[group] = class
+		}
+	}
+	if cfg.DefaultClass != "" {
+		defaultClass, ok := classes.byName[cfg.DefaultClass]
+		if !ok {
+			return nil, fmt.Errorf("default_class %q is not defined in classes", cfg.DefaultClass)
+		}
+		classes.defaultClass = defaultClass
+	}
+	return classes, nil
+}
+
+// lookup returns the class of a request: the one named by the identity if
+// any, else the group's class, else the default class. May return nil.
+func (c *groupClasses) lookup(groupKey string, identity *Identity) *GroupClass {
+	if identity != nil && identity.Class != "" {
+		if class, ok := c.byName[identity.Class]; ok {
+			return class
+		}
+	}
+	if class, ok := c.byGroup[groupKey]; ok {
+		return class
+	}
+	return c.defaultClass
+}
+
+// CheckSettings returns an error if the request raises a capped setting above
+// the class maximum in the URL, or sets a forced or capped setting in the
+// query's SETTINGS clause. Query-level settings override the URL parameters
+// Apply sets, so they are not allowed for those names at all.
+func (c *GroupClass) CheckSettings(params url.Values, info QueryInfo) error {
+	if len(c.Settings) == 0 && len(c.MaxSettings) == 0 {
+		return nil
+	}
+	for name, values := range params {
+		limit, capped := c.MaxSettings[name]
+		if !capped {
+			continue
+		}
+		for _, value := range values {
+			// 0 means unlimited for ClickHouse's limits, so it is above any cap
+			v, err := strconv.ParseFloat(strings.Trim(value, "'"), 64)
+			if err != nil || v > limit || (v == 0 && limit > 0) {
+				return fmt.Errorf("setting %s = %s is not allowed, maximum for class %s is %v", name, value, c.Name, limit)
+			}
+		}
+	}
+	if !info.complete() {
+		// A SETTINGS clause past the classified prefix would go unnoticed
+		return fmt.Errorf("query is longer than %d bytes, settings of class %s cannot be checked", maxClassifyBytes, c.Name)
+	}
+	for name := range querySettings(info.Query) {
+		if _, forced := c.Settings[name]; forced {
+			return fmt.Errorf("setting %s is set by class %s and cannot be changed in the query", name, c.Name)
+		}
+		if _, capped := c.MaxSettings[name]; capped {
+			return fmt.Errorf("setting %s is capped for class %s and cannot be set in the query", name, c.Name)
+		}
+	}
+	return nil
+}
+
+// Apply sets the class settings on the outgoing URL parameters. Capped
+// settings the client did not set are set to their maximum.
+func (c *GroupClass) Apply(params url.Values) {
+	for name, value := range c.Settings {
+		params.Set(name, value)
+	}
+	for name, limit := range c.MaxSettings {
+		if params.Get(name) == "" {
+			params.Set(name, strconv.FormatFloat(limit, 'f', -1, 64))
+		}
+	}
+}
+
+// querySettings returns the "SETTINGS name = value, ..." pairs of a query.
+func querySettings(query string) map[string]string {
+	tokens := tokenize(query)
+	settings := make(map[string]string)
+	for i := 0; i < len(tokens); i++ {
+		if tokens[i].kind != tokWord || !strings.EqualFold(tokens[i].text, "SETTINGS") {
+			continue
+		}
+		for i+3 < len(tokens) && tokens[i+1].kind == tokWord && tokens[i+2].text == "=" {
+			settings[tokens[i+1].text] = tokens[i+3].text
+			i += 3
+			if i+1 >= len(tokens) || tokens[i+1].text != "," {
+				break
+			}
+			i++
+		}
+	}
+	return settings
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"clickhouse-test/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGroupClass(t *testing.T) {
+	class, err := newGroupClass(config.ClassConfig{
+		Name:        "dashboard",
+		Settings:    map[string]string{"readonly": "1"},
+		MaxSettings: map[string]string{"max_execution_time": "30"},
+	})
+	require.NoError(t, err)
+
+	assert.NoError(t, class.CheckSettings(url.Values{"max_execution_time": {"10"}}, queryInfo("SELECT 1")))
+	assert.Error(t, class.CheckSettings(url.Values{"max_execution_time": {"60"}}, queryInfo("SELECT 1")))
+	assert.Error(t, class.CheckSettings(url.Values{}, queryInfo("SELECT 1 SETTINGS max_threads = 2, max_execution_time = 600")))
+
+	params := url.Values{"readonly": {"0"}, "default_format": {"JSON"}}
+	class.Apply(params)
+	assert.Equal(t, url.Values{
+		"readonly":           {"1"},
+		"default_format":     {"JSON"},
+		"max_execution_time": {"30"},
+	}, params)
+}
+
+func queryInfo(query string) QueryInfo {
+	return QueryInfo{Kind: ClassifyQuery(query), Query: query}
+}
+
+func TestGroupClassCaps(t *testing.T) {
+	class, err := newGroupClass(config.ClassConfig{
+		Name:     "dashboard",
+		Settings: map[string]string{"readonly": "1"},
+		MaxSettings: map[string]string{
+			"max_execution_time": "30",
+			"max_memory_usage":   "1000000000",
+			"max_result_rows":    "10000",
+		},
+	})
+	require.NoError(t, err)
+
+	t.Run("zero is unlimited", func(t *testing.T) {
+		for _, name := range []string{"max_execution_time", "max_memory_usage", "max_result_rows"} {
+			assert.Error(t, class.CheckSettings(url.Values{name: {"0"}}, queryInfo("SELECT 1")), name)
+		}
+		assert.NoError(t, class.CheckSettings(url.Values{"max_result_rows": {"1"}}, queryInfo("SELECT 1")))
+	})
+
+	t.Run("query settings", func(t *testing.T) {
+		tests := []struct {
+			query   string
+			allowed bool
+		}{
+			{"SELECT 1 SETTINGS max_threads = 2", true},
+			{"SELECT 1 SETTINGS readonly = 0", false},
+			{"SELECT 1 SETTINGS max_memory_usage = 10", false}, // Under the cap, but still overrides Apply
+			{"SELECT 1 SETTINGS max_threads = 2, max_memory_usage = 100000000000", false},
+		}
+		for _, tt := range tests {
+			err := class.CheckSettings(url.Values{}, queryInfo(tt.query))
+			if tt.allowed {
+				assert.NoError(t, err, tt.query)
+			} else {
+				assert.Error(t, err, tt.query)
+			}
+		}
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		padding := strings.Repeat(" ", maxClassifyBytes)
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("SELECT 1"+padding+"SETTINGS max_memory_usage = 0"))
+		assert.Error(t, class.CheckSettings(url.Values{}, ClassifyRequest(r)))
+
+		// INSERT data past the prefix does not hide any settings
+		r = httptest.NewRequest(http.MethodPost, "/", strings.NewReader("INSERT INTO t FORMAT TSV\n"+padding+"1\n"))
+		assert.NoError(t, class.CheckSettings(url.Values{}, ClassifyRequest(r)))
+	})
+}
@@ -0,0 +1,208 @@
+// --- slowdown.go --- (Replica slowdown and error detection on upstream responses)
+package main
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	exceptionMarker    = "DB::Exception:"
+	exceptionPrefixLen = 32   // Bytes kept before the marker, for "Code: 202. "
+	maxExceptionLen    = 4096 // Longer exception messages are cut
+)
+
+var exceptionCodeRe = regexp.MustCompile(`Code: (\d+)\. ` + regexp.QuoteMeta(exceptionMarker))
+
+// endsWithException reports whether a complete body ends in a ClickHouse
+// exception, as ClickHouse appends one to a result it already started
+// sending when the query fails halfway.
+func endsWithException(body []byte) bool {
+	tail := bytes.TrimRight(body, " \t\r\n")
+	tail = tail[max(0, len(tail)-maxExceptionLen-exceptionPrefixLen):]
+	return exceptionCodeRe.Match(tail)
+}
+
+// exceptionScanner watches a response body while it is copied to the client
+// and reports a ClickHouse exception at the end of it. That covers error
+// responses as well as exceptions ClickHouse appends to a result it already
+// started streaming with a 200 status. Only the exception text is kept, the
+// body itself is never buffered.
+type exceptionScanner struct {
+	io.ReadCloser
+	onException func(code int, message string)
+	tail        []byte // Last bytes before the current read, for markers split across reads
+	capture     []byte // Exception text from the marker on, nil while there is none
+	complete    bool   // The exception line has ended; more data means it was not the end
+	reported    bool
+}
+
+func (s *exceptionScanner) Read(p []byte) (int, error) {
+	n, err := s.ReadCloser.Read(p)
+	if !s.reported {
+		s.scan(p[:n])
+		if err != nil && s.capture != nil {
+			// End of the body, or the connection broke right after the exception
+			s.reported = true
+			s.report()
+		}
+	}
+	return n, err
+}
+
+func (s *exceptionScanner) scan(chunk []byte) {
+	for len(chunk) > 0 {
+		if s.capture == nil {
+			chunk = s.findMarker(chunk)
+			continue
+		}
+		if s.complete {
+			// Only whitespace may follow an exception that ends the body
+			rest := bytes.TrimLeft(chunk, " \t\r\n")
+			if len(rest) == 0 {
+				return
+			}
+			s.capture, s.complete = nil, false
+			chunk = rest
+			continue
+		}
+		line, rest, found := bytes.Cut(chunk, []byte("\n"))
+		if room := maxExceptionLen - len(s.capture); room > 0 {
+			s.capture = append(s.capture, line[:min(len(line), room)]...)
+		}
+		if !found {
+			return
+		}
+		s.complete = true
+		chunk = rest
+	}
+}
+
+// findMarker looks for the exception marker in chunk, also where it spans
+// the previous read. It starts a capture when found and returns the part of
+// chunk that still needs scanning.
+func (s *exceptionScanner) findMarker(chunk []byte) []byte {
+	edge := min(len(chunk), len(exceptionMarker)-1)
+	joined := append(s.tail[:len(s.tail):len(s.tail)], chunk[:edge]...)
+	if i := bytes.Index(joined, []byte(exceptionMarker)); i >= 0 {
+		s.startCapture(joined[:i], joined[i:])
+		return chunk[edge:]
+	}
+	if i := bytes.Index(chunk, []byte(exceptionMarker)); i >= 0 {
+		s.startCapture(append(s.tail[:len(s.tail):len(s.tail)], chunk[:i]...), nil)
+		return chunk[i:]
+	}
+	// Keep the end of the stream for the next read
+	if len(chunk) >= exceptionPrefixLen {
+		s.tail = append(s.tail[:0], chunk[len(chunk)-exceptionPrefixLen:]...)
+	} else {
+		s.tail = append(s.tail, chunk...)
+		s.tail = s.tail[max(0, len(s.tail)-exceptionPrefixLen):]
+	}
+	return nil
+}
+
+// startCapture begins an exception with the text before the marker on the
+// same line, followed by start.
+func (s *exceptionScanner) startCapture(before, start []byte) {
+	if i := bytes.LastIndexByte(before, '\n'); i >= 0 {
+		before = before[i+1:]
+	}
+	before = before[max(0, len(before)-exceptionPrefixLen):]
+	s.capture = append(append(make([]byte, 0, 256), before...), start...)
+	s.tail = s.tail[:0]
+	s.complete = false
+}
+
+func (s *exceptionScanner) report() {
+	message := strings.TrimSpace(string(s.capture))
+	code := 0
+	if m := exceptionCodeRe.FindStringSubmatch(message); m != nil {
+		code, _ = strconv.Atoi(m[1])
+		message = message[strings.Index(message, m[0]):]
+	}
+	s.onException(code, message)
+}
+
+// isSlowdownCode reports whether a ClickHouse exception code is configured to
+// slow down the replica.
+func (p *SimpleProxy) isSlowdownCode(code int) bool {
+	for _, c := range p.config.SlowdownExceptionCodes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// isSlowdownMessage reports whether an exception message contains one of the
+// configured slowdown errors.
+func (p *SimpleProxy) isSlowdownMessage(message string) bool {
+	if p.config.SlowdownError != "" && strings.Contains(message, p.config.SlowdownError) {
+		return true
+	}
+	for _, pattern := range p.config.SlowdownErrors {
+		if strings.Contains(message, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkResponse is the reverse proxy's ModifyResponse. It slows the replica
+// down on a configured status or exception code and watches the body for
+// exceptions as it streams, without reading it ahead.
+//
+// Only error responses slow the replica down. A 200 body is the query's own
+// result and may contain anything, including text that looks like an
+// exception (a user can SELECT it); exceptions found there are logged and
+// recorded, never acted on.
+func (p *SimpleProxy) checkResponse(resp *http.Response) error {
+	ctx := resp.Request.Context()
+	node := GetNode(ctx)
+	groupKey := GetGroupKey(ctx)
+	access := getAccessLog(ctx)
+	collapseProgress(resp.Header)
+
+	slowedDown := false
+	slowDown := func(reason string) {
+		if slowedDown || node == nil {
+			return
+		}
+		slowedDown = true
+		slog.Warn("Triggering slowdown for replica", "group", groupKey, "node", node.Address, "reason", reason)
+		node.Replica.SlowDown()
+	}
+	if p.config.SlowdownCode > 0 && resp.StatusCode == p.config.SlowdownCode {
+		slowDown("status " + strconv.Itoa(resp.StatusCode))
+	} else if code, err := strconv.Atoi(resp.Header.Get("X-ClickHouse-Exception-Code")); err == nil && p.isSlowdownCode(code) {
+		slowDown("exception code " + strconv.Itoa(code))
+	}
+
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		return nil // The proxy needs the upgraded connection as it is
+	}
+	// The code header is only sent with the status; the message patterns of
+	// error responses, and exceptions in a streamed result, need the body
+	resp.Body = &exceptionScanner{
+		ReadCloser: resp.Body,
+		onException: func(code int, message string) {
+			if access != nil {
+				access.exceptionCode, access.exception = code, message
+			}
+			if resp.StatusCode < http.StatusBadRequest {
+				slog.Warn("ClickHouse exception after the response started", "group", groupKey, "node", node.Address, "code", code)
+				return
+			}
+			if p.isSlowdownCode(code) || p.isSlowdownMessage(message) {
+				slowDown("exception " + strconv.Itoa(code))
+			}
+		},
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"clickhouse-test/config"
+	"github.com/stretchr/testify/require"
+)
+
+const tooManyQueries = "Code: 202. DB::Exception: Too many simultaneous queries. Maximum: 100. (TOO_MANY_SIMULTANEOUS_QUERIES) (version 24.3.1.1)"
+
+func TestExceptionScanner(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		wantCode int
+		wantMsg  string
+	}{
+		{"error response", tooManyQueries + "\n", 202, tooManyQueries},
+		{"after streamed rows", `{"n":1}` + "\n" + `{"n":2}` + "\n" + tooManyQueries + "\n\n", 202, tooManyQueries},
+		{"on the same line as data", `{"n":1}` + tooManyQueries, 202, tooManyQueries},
+		{"without code", "DB::Exception: broken\n", 0, "DB::Exception: broken"},
+		{"in the data, not at the end", `{"msg":"` + tooManyQueries + `"}` + "\n" + `{"n":2}` + "\n", -1, ""},
+		{"no exception", strings.Repeat(`{"n":1}`+"\n", 100), -1, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, msg := -1, ""
+			scanner := &exceptionScanner{
+				// One byte per read, so the marker is always split across reads
+				ReadCloser: io.NopCloser(iotest.OneByteReader(strings.NewReader(tt.body))),
+				onException: func(c int, m string) {
+					code, msg = c, m
+				},
+			}
+			body, err := io.ReadAll(scanner)
+			require.NoError(t, err)
+			require.Equal(t, tt.body, string(body))
+			require.Equal(t, tt.wantCode, code)
+			require.Equal(t, tt.wantMsg, msg)
+		})
+	}
+}
+
+func TestSlowdownOnStreamedException(t *testing.T) {
+	status, withHeader := http.StatusOK, false
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if withHeader {
+			w.Header().Set("X-ClickHouse-Exception-Code", "202")
+		}
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+		}
+		io.WriteString(w, `{"n":1}`+"\n")
+		w.(http.Flusher).Flush() // Chunked, as ClickHouse streams it
+		io.WriteString(w, tooManyQueries+"\n")
+	}))
+	defer backend.Close()
+
+	cfg := &config.Config{
+		HeaderName:             "X-User-Id",
+		MaxConcurrent:          2,
+		MaxQueue:               1,
+		QueueTimeout:           time.Second,
+		Replicas:               []config.ReplicaConfig{{Name: "r1"}},
+		Nodes:                  []config.NodeConfig{{Replica: "r1", Address: strings.TrimPrefix(backend.URL, "http://")}},
+		SlowdownExceptionCodes: []int{202},
+		SlowdownRate:           1,
+		SlowdownBurst:          1,
+	}
+	query := func() (*httptest.ResponseRecorder, bool) {
+		p, err := NewSimpleProxy(cfg)
+		require.NoError(t, err)
+		r := httptest.NewRequest(http.MethodGet, "/?query=SELECT+1+FORMAT+JSONEachRow", nil)
+		r.Header.Set("X-User-Id", "a")
+		rw := httptest.NewRecorder()
+		p.ServeHTTP(rw, r)
+		_, _, slowedDown := p.replicas[0].RateLimit()
+		return rw, slowedDown
+	}
+
+	// The exception comes after a 200 and part of the result. The body is the
+	// query's own result, so it must not slow the replica down (a user could
+	// SELECT that text); the exception is only logged
+	rw, slowedDown := query()
+	require.Equal(t, http.StatusOK, rw.Code)
+	require.Equal(t, `{"n":1}`+"\n"+tooManyQueries+"\n", rw.Body.String())
+	require.False(t, slowedDown, "a 200 body must not trigger a slowdown")
+
+	// An error response is passed on as it streams, not read ahead
+	status, withHeader = http.StatusServiceUnavailable, true
+	rw, slowedDown = query()
+	require.True(t, slowedDown)
+	require.Equal(t, http.StatusServiceUnavailable, rw.Code)
+	require.Empty(t, rw.Header().Get("Content-Length"))
+	require.Equal(t, `{"n":1}`+"\n"+tooManyQueries+"\n", rw.Body.String())
+
+	// The body of an error response counts without the code header too
+	status, withHeader = http.StatusInternalServerError, false
+	_, slowedDown = query()
+	require.True(t, slowedDown)
+}
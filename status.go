@@ -0,0 +1,235 @@
+// --- status.go --- (Live proxy state for the admin dashboard)
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	maxRecentErrors      = 50
+	maxGroupsReported    = 20
+	nodeFailingThreshold = 3 // Consecutive failures before a node shows as failing
+)
+
+// RecentError is a request that failed upstream or in the proxy.
+type RecentError struct {
+	Time    time.Time `json:"time"`
+	Group   string    `json:"group"`
+	Node    string    `json:"node"`
+	Status  int       `json:"status"`
+	QueryID string    `json:"query_id"`
+	Message string    `json:"message"`
+}
+
+// nodeHealth is what requests have shown about a node. There are no active
+// health checks; a node is failing after several upstream errors in a row.
+type nodeHealth struct {
+	requests    int64
+	failures    int64
+	consecutive int
+	lastError   string
+	lastErrorAt time.Time
+}
+
+// statusTracker counts what happened to requests for the dashboard.
+type statusTracker struct {
+	started time.Time
+
+	mu         sync.Mutex
+	rejections map[string]int64
+	errors     []RecentError // Ring of the latest errors
+	nextError  int
+	nodes      map[string]*nodeHealth // By node address
+}
+
+func newStatusTracker() *statusTracker {
+	return &statusTracker{
+		started:    time.Now(),
+		rejections: make(map[string]int64),
+		nodes:      make(map[string]*nodeHealth),
+	}
+}
+
+// record adds a finished request.
+func (t *statusTracker) record(l *accessLog) {
+	statusCode := l.statusCode()
+	exceptionCode, exception := l.clickhouseException()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if l.rejected != "" {
+		t.rejections[l.rejected]++
+		return
+	}
+	if l.node == "" || l.shared != "" || statusCode == 499 {
+		return // Not sent upstream, or the client went away
+	}
+
+	// Client errors (bad SQL, unknown table) say nothing about the node
+	failed := l.upstreamErr != "" || statusCode >= http.StatusInternalServerError
+	health := t.nodes[l.node]
+	if health == nil {
+		health = &nodeHealth{}
+		t.nodes[l.node] = health
+	}
+	health.requests++
+	if !failed {
+		health.consecutive = 0
+	}
+	if !failed && exceptionCode == 0 && statusCode < http.StatusBadRequest {
+		return
+	}
+
+	message := l.upstreamErr
+	switch {
+	case message != "":
+	case exception != "":
+		message = exception
+	case exceptionCode != 0:
+		message = fmt.Sprintf("ClickHouse exception, code %d", exceptionCode)
+	default:
+		message = http.StatusText(statusCode)
+	}
+	if failed {
+		health.failures++
+		health.consecutive++
+		health.lastError, health.lastErrorAt = message, time.Now()
+	}
+	recent := RecentError{
+		Time:    time.Now(),
+		Group:   l.groupKey,
+		Node:    l.node,
+		Status:  statusCode,
+		QueryID: l.queryID(),
+		Message: message,
+	}
+	if len(t.errors) < maxRecentErrors {
+		t.errors = append(t.errors, recent)
+	} else {
+		t.errors[t.nextError] = recent
+		t.nextError = (t.nextError + 1) % maxRecentErrors
+	}
+}
+
+// NodeStatus is the state of one node.
+type NodeStatus struct {
+	Address     string     `json:"address"`
+	Health      string     `json:"health"` // "ok", "failing" or "unknown" before the first request
+	Requests    int64      `json:"requests"`
+	Failures    int64      `json:"failures"`
+	LastError   string     `json:"last_error,omitempty"`
+	LastErrorAt *time.Time `json:"last_error_at,omitempty"`
+}
+
+// ReplicaStatus is the state of one replica and its nodes.
+type ReplicaStatus struct {
+	Name       string            `json:"name"`
+	Labels     map[string]string `json:"labels,omitempty"`
+	SlowedDown bool              `json:"slowed_down"`
+	RateLimit  *float64          `json:"rate_limit"` // Requests per second, null when not limited
+	Burst      int               `json:"burst"`
+	Nodes      []NodeStatus      `json:"nodes"`
+}
+
+// GroupStatus is the load of one group limiter.
+type GroupStatus struct {
+	Group         string `json:"group"`
+	Insert        bool   `json:"insert,omitempty"` // The separate limiter for INSERTs
+	Active        int    `json:"active"`
+	MaxConcurrent int    `json:"max_concurrent"`
+	Queued        int    `json:"queued"`
+	MaxQueue      int    `json:"max_queue"`
+}
+
+// StatusReport is the proxy state served at /status and shown on the dashboard.
+type StatusReport struct {
+	Time         time.Time        `json:"time"`
+	Uptime       string           `json:"uptime"`
+	Draining     bool             `json:"draining"`
+	InFlight     int64            `json:"in_flight"`
+	Queued       int64            `json:"queued"`
+	Replicas     []ReplicaStatus  `json:"replicas"`
+	Groups       []GroupStatus    `json:"groups"` // Busiest first, idle groups left out
+	Rejections   map[string]int64 `json:"rejections"`
+	RecentErrors []RecentError    `json:"recent_errors"` // Newest first
+}
+
+// Status returns a snapshot of the proxy state.
+func (p *SimpleProxy) Status() StatusReport {
+	now := time.Now()
+	report := StatusReport{
+		Time:       now,
+		Uptime:     now.Sub(p.status.started).Round(time.Second).String(),
+		Draining:   p.draining.Load(),
+		Rejections: make(map[string]int64),
+	}
+	report.InFlight, report.Queued = p.InFlight()
+
+	p.status.mu.Lock()
+	for _, replica := range p.replicas {
+		limit, burst, slowedDown := replica.RateLimit()
+		rs := ReplicaStatus{Name: replica.Name, Labels: replica.Labels, SlowedDown: slowedDown, Burst: burst}
+		if limit != rate.Inf {
+			perSecond := float64(limit)
+			rs.RateLimit = &perSecond
+		}
+		for _, node := range replica.Nodes {
+			ns := NodeStatus{Address: node.Address, Health: "unknown"}
+			if health := p.status.nodes[node.Address]; health != nil {
+				ns.Health = "ok"
+				if health.consecutive >= nodeFailingThreshold {
+					ns.Health = "failing"
+				}
+				ns.Requests, ns.Failures, ns.LastError = health.requests, health.failures, health.lastError
+				if !health.lastErrorAt.IsZero() {
+					lastErrorAt := health.lastErrorAt
+					ns.LastErrorAt = &lastErrorAt
+				}
+			}
+			rs.Nodes = append(rs.Nodes, ns)
+		}
+		report.Replicas = append(report.Replicas, rs)
+	}
+	for reason, n := range p.status.rejections {
+		report.Rejections[reason] = n
+	}
+	for i := range p.status.errors {
+		// Walk the ring backwards from the newest entry
+		idx := (p.status.nextError - 1 - i + 2*len(p.status.errors)) % len(p.status.errors)
+		report.RecentErrors = append(report.RecentErrors, p.status.errors[idx])
+	}
+	p.status.mu.Unlock()
+
+	collect := func(limiters *sync.Map, insert bool) {
+		limiters.Range(func(key, value any) bool {
+			gs := GroupStatus{Group: key.(string), Insert: insert}
+			gs.Active, gs.MaxConcurrent = value.(*GroupLimiter).Active()
+			gs.Queued, gs.MaxQueue = value.(*GroupLimiter).Queued()
+			if gs.Active > 0 || gs.Queued > 0 {
+				report.Groups = append(report.Groups, gs)
+			}
+			return true
+		})
+	}
+	collect(&p.groupLimiters, false)
+	collect(&p.insertLimiters, true)
+	sort.Slice(report.Groups, func(i, j int) bool {
+		a, b := report.Groups[i], report.Groups[j]
+		if a.Queued != b.Queued {
+			return a.Queued > b.Queued
+		}
+		if a.Active != b.Active {
+			return a.Active > b.Active
+		}
+		return a.Group < b.Group
+	})
+	if len(report.Groups) > maxGroupsReported {
+		report.Groups = report.Groups[:maxGroupsReported]
+	}
+	return report
+}
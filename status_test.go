@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"clickhouse-test/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatusReportsNodesRejectionsAndErrors(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Query().Get("query"), "fail") {
+			w.Header().Set("X-ClickHouse-Exception-Code", "241")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("1\n"))
+	}))
+	defer backend.Close()
+
+	cfg := &config.Config{
+		HeaderName:    "X-User-Id",
+		MaxConcurrent: 2,
+		MaxQueue:      1,
+		QueueTimeout:  time.Second,
+		Replicas:      []config.ReplicaConfig{{Name: "r1"}},
+		Nodes:         []config.NodeConfig{{Replica: "r1", Address: strings.TrimPrefix(backend.URL, "http://")}},
+	}
+	p, err := NewSimpleProxy(cfg)
+	require.NoError(t, err)
+
+	send := func(group, query string) {
+		r := httptest.NewRequest(http.MethodGet, "/?query="+query, nil)
+		r.Header.Set("X-User-Id", group)
+		p.ServeHTTP(httptest.NewRecorder(), r)
+	}
+	send("a", "SELECT+1")
+	for i := 0; i < nodeFailingThreshold; i++ {
+		send("a", "SELECT+fail")
+	}
+	send("", "SELECT+1")
+
+	admin := newAdminHandler(p)
+	rw := httptest.NewRecorder()
+	admin.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/status", nil))
+	require.Equal(t, http.StatusOK, rw.Code)
+	var status StatusReport
+	require.NoError(t, json.Unmarshal(rw.Body.Bytes(), &status))
+
+	require.Len(t, status.Replicas, 1)
+	require.Nil(t, status.Replicas[0].RateLimit)
+	node := status.Replicas[0].Nodes[0]
+	require.Equal(t, "failing", node.Health)
+	require.EqualValues(t, 4, node.Requests)
+	require.EqualValues(t, 3, node.Failures)
+	require.Equal(t, map[string]int64{rejectMissingGroup: 1}, status.Rejections)
+	require.Len(t, status.RecentErrors, nodeFailingThreshold)
+	require.Equal(t, "ClickHouse exception, code 241", status.RecentErrors[0].Message)
+	require.Empty(t, status.Groups) // Nothing running any more
+
+	rw = httptest.NewRecorder()
+	admin.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/", nil))
+	require.Equal(t, http.StatusOK, rw.Code)
+	require.Contains(t, rw.Body.String(), "<title>ClickHouse proxy</title>")
+}
@@ -0,0 +1,182 @@
+// --- streaming.go --- (Streaming responses and long-running queries)
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"time"
+
+	"clickhouse-test/config"
+)
+
+// longQueryRule is a compiled streaming.long_queries entry.
+type longQueryRule struct {
+	name    string
+	groups  map[string]bool
+	users   map[string]bool
+	classes map[string]bool
+	kinds   map[QueryKind]bool
+	match   *regexp.Regexp // nil matches every query
+	timeout time.Duration  // 0 keeps proxy_timeout
+}
+
+func newLongQueryRules(cfg []config.LongQueryConfig) ([]*longQueryRule, error) {
+	rules := make([]*longQueryRule, 0, len(cfg))
+	for i, ruleCfg := range cfg {
+		name := ruleCfg.Name
+		if name == "" {
+			name = fmt.Sprintf("long_queries[%d]", i)
+		}
+		rule := &longQueryRule{
+			name:    name,
+			groups:  toSet(ruleCfg.Groups),
+			users:   toSet(ruleCfg.Users),
+			classes: toSet(ruleCfg.Classes),
+			kinds:   make(map[QueryKind]bool),
+			timeout: ruleCfg.Timeout,
+		}
+		for _, kindName := range ruleCfg.Kinds {
+			kind, ok := ParseQueryKind(kindName)
+			if !ok {
+				return nil, fmt.Errorf("long query %q: unknown statement kind %q", name, kindName)
+			}
+			rule.kinds[kind] = true
+		}
+		if ruleCfg.Match != "" {
+			re, err := regexp.Compile(ruleCfg.Match)
+			if err != nil {
+				return nil, fmt.Errorf("long query %q: %w", name, err)
+			}
+			rule.match = re
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func (r *longQueryRule) applies(groupKey, user string, class *GroupClass, info QueryInfo) bool {
+	if len(r.groups) > 0 && !r.groups[groupKey] {
+		return false
+	}
+	if len(r.users) > 0 && !r.users[user] {
+		return false
+	}
+	if len(r.classes) > 0 && (class == nil || !r.classes[class.Name]) {
+		return false
+	}
+	if len(r.kinds) > 0 && !r.kinds[info.Kind] {
+		return false
+	}
+	return r.match == nil || r.match.MatchString(info.Query)
+}
+
+// longQuery returns the first long query rule matching the request, or nil.
+func (p *SimpleProxy) longQuery(groupKey, user string, class *GroupClass, info QueryInfo) *longQueryRule {
+	for _, rule := range p.longQueries {
+		if rule.applies(groupKey, user, class, info) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// flushInterval converts streaming.flush_interval to the ReverseProxy
+// convention, where a negative value flushes after every write.
+func flushInterval(cfg config.StreamingConfig) time.Duration {
+	if cfg.FlushInterval <= 0 {
+		return -1
+	}
+	return cfg.FlushInterval
+}
+
+// requestProgress asks ClickHouse to send X-ClickHouse-Progress headers at
+// the given interval, unless the client chose its own. The headers only keep
+// the connection between the proxy and ClickHouse busy while a long query has
+// no result to send yet. Nothing reaches the client before the header block
+// ends, so they do nothing for the client connection, and they do not reset
+// the transport's ResponseHeaderTimeout either.
+func requestProgress(params url.Values, interval time.Duration) {
+	if interval <= 0 || params.Has("send_progress_in_http_headers") {
+		return
+	}
+	params.Set("send_progress_in_http_headers", "1")
+	params.Set("http_headers_progress_interval_ms", strconv.FormatInt(interval.Milliseconds(), 10))
+}
+
+// collapseProgress keeps only the last X-ClickHouse-Progress header. ClickHouse
+// sends one per interval, and thousands of them are of no use to clients.
+func collapseProgress(header http.Header) {
+	if progress := header.Values("X-ClickHouse-Progress"); len(progress) > 1 {
+		header.Set("X-ClickHouse-Progress", progress[len(progress)-1])
+	}
+}
+
+// deadlineWriter pushes the client connection's write deadline forward while
+// the response is written, so a streaming response only fails when the
+// client stops reading, not when the fixed server.write_timeout runs out.
+type deadlineWriter struct {
+	http.ResponseWriter
+	rc       *http.ResponseController
+	idle     time.Duration // 0 only clears the deadline (long queries)
+	deadline time.Time     // Current write deadline, zero for none
+}
+
+// newDeadlineWriter wraps rw for a request that arrived at startTime. Long
+// queries start without a write deadline. It returns rw unchanged when there
+// is nothing to do or the connection does not support deadlines.
+func (p *SimpleProxy) newDeadlineWriter(rw http.ResponseWriter, long *longQueryRule, startTime time.Time) http.ResponseWriter {
+	idle := p.config.Streaming.WriteIdleTimeout
+	if idle <= 0 && long == nil {
+		return rw
+	}
+	w := &deadlineWriter{
+		ResponseWriter: rw,
+		rc:             http.NewResponseController(rw),
+		idle:           idle,
+	}
+	if long != nil {
+		if err := w.rc.SetWriteDeadline(time.Time{}); err != nil {
+			return rw
+		}
+	} else if p.config.Server.WriteTimeout > 0 {
+		w.deadline = startTime.Add(p.config.Server.WriteTimeout) // Set by the server on arrival
+	}
+	return w
+}
+
+// extend moves the deadline to idle from now, if that is later. It is only
+// moved in steps of a tenth of idle, not on every small write.
+func (w *deadlineWriter) extend() {
+	if w.idle <= 0 {
+		return
+	}
+	next := time.Now().Add(w.idle)
+	if !w.deadline.IsZero() && next.Sub(w.deadline) < w.idle/10 {
+		return
+	}
+	if err := w.rc.SetWriteDeadline(next); err == nil {
+		w.deadline = next
+	}
+}
+
+func (w *deadlineWriter) WriteHeader(statusCode int) {
+	w.extend()
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *deadlineWriter) Write(b []byte) (int, error) {
+	w.extend()
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the client connection.
+func (w *deadlineWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *deadlineWriter) Flush() {
+	w.rc.Flush()
+}
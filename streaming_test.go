@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"clickhouse-test/config"
+	"github.com/stretchr/testify/require"
+)
+
+// startStreamingProxy serves a proxy in front of backend with the given
+// server write timeout.
+func startStreamingProxy(t *testing.T, backend *httptest.Server, writeTimeout time.Duration, streaming config.StreamingConfig) *httptest.Server {
+	t.Helper()
+	cfg := &config.Config{
+		HeaderName:    "X-User-Id",
+		MaxConcurrent: 2,
+		MaxQueue:      1,
+		QueueTimeout:  time.Second,
+		Server:        config.ServerConfig{WriteTimeout: writeTimeout},
+		Replicas:      []config.ReplicaConfig{{Name: "r1"}},
+		Nodes:         []config.NodeConfig{{Replica: "r1", Address: strings.TrimPrefix(backend.URL, "http://")}},
+		Streaming:     streaming,
+	}
+	p, err := NewSimpleProxy(cfg)
+	require.NoError(t, err)
+	srv := httptest.NewUnstartedServer(p)
+	srv.Config.WriteTimeout = writeTimeout
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func queryProxy(t *testing.T, srv *httptest.Server, query string) (*http.Response, error) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/?query="+url.QueryEscape(query), nil)
+	require.NoError(t, err)
+	req.Header.Set("X-User-Id", "etl")
+	return srv.Client().Do(req)
+}
+
+func TestStreamingExtendsWriteDeadline(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 8; i++ {
+			io.WriteString(w, `{"n":1}`+"\n")
+			w.(http.Flusher).Flush()
+			time.Sleep(100 * time.Millisecond)
+		}
+	}))
+	defer backend.Close()
+	srv := startStreamingProxy(t, backend, 300*time.Millisecond, config.StreamingConfig{WriteIdleTimeout: 250 * time.Millisecond})
+
+	start := time.Now()
+	resp, err := queryProxy(t, srv, "SELECT number FROM numbers(8) FORMAT JSONEachRow")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	// Rows are flushed as they come, not when the response is complete
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	require.NoError(t, err)
+	require.Equal(t, `{"n":1}`+"\n", line)
+	require.Less(t, time.Since(start), 300*time.Millisecond)
+
+	// The response outlives the 300ms write timeout because data keeps flowing
+	rest, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, 7, strings.Count(string(rest), "\n"))
+}
+
+func TestLongQueryIsExemptFromWriteTimeout(t *testing.T) {
+	var params url.Values
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		params = r.URL.Query()
+		w.Header().Add("X-ClickHouse-Progress", `{"read_rows":"1"}`)
+		w.Header().Add("X-ClickHouse-Progress", `{"read_rows":"2"}`)
+		time.Sleep(400 * time.Millisecond)
+		io.WriteString(w, "done\n")
+	}))
+	defer backend.Close()
+	srv := startStreamingProxy(t, backend, 200*time.Millisecond, config.StreamingConfig{
+		ProgressInterval: 10 * time.Second,
+		LongQueries:      []config.LongQueryConfig{{Name: "exports", Match: `(?i)FORMAT\s+Parquet`}},
+	})
+
+	resp, err := queryProxy(t, srv, "SELECT * FROM events FORMAT Parquet")
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	require.Equal(t, "done\n", string(body))
+	require.Equal(t, []string{`{"read_rows":"2"}`}, resp.Header.Values("X-ClickHouse-Progress"))
+	require.Equal(t, "1", params.Get("send_progress_in_http_headers"))
+	require.Equal(t, "10000", params.Get("http_headers_progress_interval_ms"))
+
+	// Other queries are still cut off by the write timeout
+	resp, err = queryProxy(t, srv, "SELECT * FROM events")
+	if err == nil {
+		body, err = io.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	require.True(t, err != nil || string(body) != "done\n", "response should have been cut off")
+	require.False(t, params.Has("send_progress_in_http_headers"))
+}
+
+func TestFollowerExtendsWriteDeadline(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"n":1}`+"\n")
+		w.(http.Flusher).Flush()
+		close(started)
+		<-release
+		for i := 0; i < 7; i++ {
+			io.WriteString(w, `{"n":1}`+"\n")
+			w.(http.Flusher).Flush()
+			time.Sleep(100 * time.Millisecond)
+		}
+	}))
+	defer backend.Close()
+	cfg := &config.Config{
+		HeaderName:    "X-User-Id",
+		MaxConcurrent: 1,
+		QueueTimeout:  10 * time.Millisecond,
+		Server:        config.ServerConfig{WriteTimeout: 300 * time.Millisecond},
+		Replicas:      []config.ReplicaConfig{{Name: "r1"}},
+		Nodes:         []config.NodeConfig{{Replica: "r1", Address: strings.TrimPrefix(backend.URL, "http://")}},
+		Streaming:     config.StreamingConfig{WriteIdleTimeout: 250 * time.Millisecond},
+		Coalesce:      config.CoalesceConfig{Enabled: true},
+	}
+	p, err := NewSimpleProxy(cfg)
+	require.NoError(t, err)
+	srv := httptest.NewUnstartedServer(p)
+	srv.Config.WriteTimeout = cfg.Server.WriteTimeout
+	srv.Start()
+	defer srv.Close()
+
+	read := func() (string, error) {
+		resp, err := queryProxy(t, srv, "SELECT number FROM numbers(8) FORMAT JSONEachRow")
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		return string(body), err
+	}
+	leader := make(chan string, 1)
+	go func() {
+		body, _ := read()
+		leader <- body
+	}()
+	<-started
+	follower := make(chan string, 1)
+	go func() {
+		body, _ := read()
+		follower <- body
+	}()
+	require.Eventually(t, func() bool {
+		p.coalescer.mu.Lock()
+		defer p.coalescer.mu.Unlock()
+		for _, f := range p.coalescer.flights {
+			return f.shared()
+		}
+		return false
+	}, time.Second, time.Millisecond)
+	close(release)
+
+	// Both outlive the 300ms write timeout, the follower too
+	require.Equal(t, 8, strings.Count(<-leader, "\n"))
+	require.Equal(t, 8, strings.Count(<-follower, "\n"))
+}
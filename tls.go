@@ -0,0 +1,241 @@
+// --- tls.go --- (TLS for the listener and backends, with certificate reloading)
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"clickhouse-test/config"
+)
+
+// reloadCheckInterval limits how often certificate files are stat'ed.
+const reloadCheckInterval = 1 * time.Second
+
+// reloadingFile holds a value loaded from one or more files and loads it
+// again when any of the files changes. If reloading fails the previous
+// value is kept.
+type reloadingFile[T any] struct {
+	paths     []string
+	load      func() (T, error)
+	mu        sync.Mutex
+	value     T
+	modTimes  []time.Time
+	lastCheck time.Time
+}
+
+func newReloadingFile[T any](load func() (T, error), paths ...string) (*reloadingFile[T], error) {
+	f := &reloadingFile[T]{paths: paths, load: load}
+	modTimes, err := f.stat()
+	if err != nil {
+		return nil, err
+	}
+	if f.value, err = load(); err != nil {
+		return nil, err
+	}
+	f.modTimes = modTimes
+	f.lastCheck = time.Now()
+	return f, nil
+}
+
+// Get returns the current value, reloading it first if a file changed.
+func (f *reloadingFile[T]) Get() T {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if time.Since(f.lastCheck) < reloadCheckInterval {
+		return f.value
+	}
+	f.lastCheck = time.Now()
+
+	modTimes, err := f.stat()
+	if err != nil {
+		slog.Warn("Failed to check files for changes, keeping loaded version", "files", f.paths, "err", err)
+		return f.value
+	}
+	changed := false
+	for i := range modTimes {
+		if !modTimes[i].Equal(f.modTimes[i]) {
+			changed = true
+		}
+	}
+	if !changed {
+		return f.value
+	}
+	value, err := f.load()
+	if err != nil {
+		slog.Warn("Failed to reload files, keeping loaded version", "files", f.paths, "err", err)
+		return f.value
+	}
+	slog.Info("Reloaded files", "files", f.paths)
+	f.value, f.modTimes = value, modTimes
+	return f.value
+}
+
+func (f *reloadingFile[T]) stat() ([]time.Time, error) {
+	modTimes := make([]time.Time, len(f.paths))
+	for i, path := range f.paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		modTimes[i] = info.ModTime()
+	}
+	return modTimes, nil
+}
+
+// newCertificate returns a reloading certificate/key pair.
+func newCertificate(certFile, keyFile string) (*reloadingFile[*tls.Certificate], error) {
+	return newReloadingFile(func() (*tls.Certificate, error) {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		return &cert, nil
+	}, certFile, keyFile)
+}
+
+// newCertPool returns a reloading pool of the PEM certificates in caFile.
+func newCertPool(caFile string) (*reloadingFile[*x509.CertPool], error) {
+	return newReloadingFile(func() (*x509.CertPool, error) {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		return pool, nil
+	}, caFile)
+}
+
+// newListenerTLSConfig builds the TLS config of the proxy listener.
+// Certificates and client CAs are re-read when their files change.
+func newListenerTLSConfig(cfg config.ListenerTLSConfig) (*tls.Config, error) {
+	cert, err := newCertificate(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load listener certificate: %w", err)
+	}
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return cert.Get(), nil
+		},
+		// ServeTLS adds these to its own copy of the config, which the clones
+		// made by GetConfigForClient below would not see
+		NextProtos: []string{"h2", "http/1.1"},
+	}
+	if cfg.ClientCAFile == "" {
+		return tlsConfig, nil
+	}
+
+	clientCAs, err := newCertPool(cfg.ClientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load client CA file: %w", err)
+	}
+	clientAuth := tls.RequireAndVerifyClientCert
+	switch cfg.ClientAuth {
+	case "", "require":
+	case "verify_if_given":
+		clientAuth = tls.VerifyClientCertIfGiven
+	default:
+		return nil, fmt.Errorf("unknown client_auth %q", cfg.ClientAuth)
+	}
+	tlsConfig.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		connConfig := tlsConfig.Clone()
+		connConfig.GetConfigForClient = nil
+		connConfig.ClientAuth = clientAuth
+		connConfig.ClientCAs = clientCAs.Get()
+		return connConfig, nil
+	}
+	return tlsConfig, nil
+}
+
+var ErrNoClientCertificate = errors.New("no verified client certificate")
+
+// certGroupKey derives the group key from the verified client certificate.
+func certGroupKey(state *tls.ConnectionState, from string) (string, error) {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return "", ErrNoClientCertificate
+	}
+	cert := state.VerifiedChains[0][0]
+	var key string
+	switch from {
+	case "subject_cn":
+		key = cert.Subject.CommonName
+	case "san_dns":
+		if len(cert.DNSNames) > 0 {
+			key = cert.DNSNames[0]
+		}
+	case "san_email":
+		if len(cert.EmailAddresses) > 0 {
+			key = cert.EmailAddresses[0]
+		}
+	case "san_uri":
+		if len(cert.URIs) > 0 {
+			key = cert.URIs[0].String()
+		}
+	default:
+		return "", fmt.Errorf("unknown group_from %q", from)
+	}
+	if key == "" {
+		return "", fmt.Errorf("client certificate has no %s", from)
+	}
+	return key, nil
+}
+
+// newBackendTLSConfig builds the client TLS config used toward the ClickHouse
+// node at host. A custom CA bundle and client certificate are re-read when
+// they change.
+func newBackendTLSConfig(cfg *config.BackendTLSConfig, host string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         cfg.ServerName,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		cert, err := newCertificate(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return cert.Get(), nil
+		}
+	}
+	if cfg.CAFile != "" && !cfg.InsecureSkipVerify {
+		roots, err := newCertPool(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load CA file: %w", err)
+		}
+		// Built-in verification would pin the pool loaded at startup, so verify
+		// against the current pool ourselves. The name is not taken from the
+		// connection state: it is empty there for IP addresses, which would
+		// skip the host check. VerifyHostname checks IP SANs for IPs.
+		verifyName := cfg.ServerName
+		if verifyName == "" {
+			verifyName = host
+		}
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) == 0 {
+				return errors.New("node presented no certificate")
+			}
+			intermediates := x509.NewCertPool()
+			for _, cert := range state.PeerCertificates[1:] {
+				intermediates.AddCert(cert)
+			}
+			_, err := state.PeerCertificates[0].Verify(x509.VerifyOptions{
+				Roots:         roots.Get(),
+				Intermediates: intermediates,
+				DNSName:       verifyName,
+			})
+			return err
+		}
+	}
+	return tlsConfig, nil
+}
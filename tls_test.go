@@ -0,0 +1,286 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"clickhouse-test/config"
+	"github.com/stretchr/testify/require"
+)
+
+// testCA issues certificates into PEM files of a temporary directory.
+type testCA struct {
+	t      *testing.T
+	dir    string
+	cert   *x509.Certificate
+	key    *ecdsa.PrivateKey
+	file   string // CA certificate PEM
+	serial int64
+}
+
+func newTestCA(t *testing.T) *testCA {
+	ca := &testCA{t: t, dir: t.TempDir()}
+	ca.cert, ca.key = ca.create(&x509.Certificate{
+		Subject:               pkix.Name{CommonName: "test CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+	ca.file = ca.write("ca.pem", "CERTIFICATE", ca.cert.Raw)
+	return ca
+}
+
+// issue signs a leaf certificate built from template and returns its
+// certificate and key files.
+func (ca *testCA) issue(name string, template *x509.Certificate) (certFile, keyFile string) {
+	cert, key := ca.create(template, ca.cert, ca.key)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(ca.t, err)
+	return ca.write(name+".pem", "CERTIFICATE", cert.Raw), ca.write(name+"-key.pem", "EC PRIVATE KEY", keyDER)
+}
+
+func (ca *testCA) create(template, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(ca.t, err)
+	ca.serial++
+	template.SerialNumber = big.NewInt(ca.serial)
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	require.NoError(ca.t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(ca.t, err)
+	return cert, key
+}
+
+func (ca *testCA) write(name, blockType string, der []byte) string {
+	path := filepath.Join(ca.dir, name)
+	require.NoError(ca.t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600))
+	return path
+}
+
+var (
+	serverTemplate = func() *x509.Certificate {
+		return &x509.Certificate{
+			Subject:     pkix.Name{CommonName: "localhost"},
+			DNSNames:    []string{"localhost"},
+			IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}
+	}
+	clientTemplate = func() *x509.Certificate {
+		return &x509.Certificate{
+			Subject:     pkix.Name{CommonName: "dashboards"},
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}
+	}
+)
+
+func TestReloadingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "value")
+	require.NoError(t, os.WriteFile(path, []byte("one"), 0o600))
+	f, err := newReloadingFile(func() (string, error) {
+		b, err := os.ReadFile(path)
+		if err == nil && len(b) == 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		return string(b), err
+	}, path)
+	require.NoError(t, err)
+	require.Equal(t, "one", f.Get())
+
+	modTime := time.Now()
+	update := func(content string) {
+		modTime = modTime.Add(time.Second)
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+		require.NoError(t, os.Chtimes(path, modTime, modTime))
+	}
+
+	// Changes are only looked for once per reloadCheckInterval
+	update("two")
+	require.Equal(t, "one", f.Get())
+	f.lastCheck = time.Time{}
+	require.Equal(t, "two", f.Get())
+
+	// A file that fails to load, or is gone, keeps the previous value
+	update("")
+	f.lastCheck = time.Time{}
+	require.Equal(t, "two", f.Get())
+	require.NoError(t, os.Remove(path))
+	f.lastCheck = time.Time{}
+	require.Equal(t, "two", f.Get())
+
+	update("three")
+	f.lastCheck = time.Time{}
+	require.Equal(t, "three", f.Get())
+
+	_, err = newReloadingFile(func() (string, error) { return "", nil }, filepath.Join(t.TempDir(), "missing"))
+	require.Error(t, err)
+}
+
+func TestCertificateReload(t *testing.T) {
+	ca := newTestCA(t)
+	certFile, keyFile := ca.issue("server", serverTemplate())
+	cert, err := newCertificate(certFile, keyFile)
+	require.NoError(t, err)
+	first := cert.Get().Leaf
+
+	// Renewed in place, as cert-manager and similar tools do
+	renewed, renewedKey := ca.issue("renewed", serverTemplate())
+	for from, to := range map[string]string{renewed: certFile, renewedKey: keyFile} {
+		require.NoError(t, os.Rename(from, to))
+		later := time.Now().Add(time.Minute)
+		require.NoError(t, os.Chtimes(to, later, later))
+	}
+	cert.lastCheck = time.Time{}
+	second := cert.Get().Leaf
+	require.NotEqual(t, first.SerialNumber, second.SerialNumber)
+}
+
+func TestCertGroupKey(t *testing.T) {
+	uri, err := url.Parse("spiffe://example.org/dashboards")
+	require.NoError(t, err)
+	cert := &x509.Certificate{
+		Subject:        pkix.Name{CommonName: "dashboards"},
+		DNSNames:       []string{"dashboards.example.org", "other.example.org"},
+		EmailAddresses: []string{"team@example.org"},
+		URIs:           []*url.URL{uri},
+	}
+	state := &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+
+	tests := []struct {
+		from  string
+		state *tls.ConnectionState
+		want  string // Empty for an error
+	}{
+		{"subject_cn", state, "dashboards"},
+		{"san_dns", state, "dashboards.example.org"},
+		{"san_email", state, "team@example.org"},
+		{"san_uri", state, "spiffe://example.org/dashboards"},
+		{"san_dns", &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{}}}}, ""},
+		{"san_ip", state, ""},
+		{"subject_cn", &tls.ConnectionState{}, ""}, // Presented but not verified
+		{"subject_cn", nil, ""},                    // Plain HTTP
+	}
+	for _, tt := range tests {
+		key, err := certGroupKey(tt.state, tt.from)
+		if tt.want == "" {
+			require.Error(t, err, tt.from)
+			continue
+		}
+		require.NoError(t, err, tt.from)
+		require.Equal(t, tt.want, key)
+	}
+}
+
+func TestListenerTLSKeepsHTTP2WithClientCertificates(t *testing.T) {
+	ca := newTestCA(t)
+	certFile, keyFile := ca.issue("server", serverTemplate())
+	clientCertFile, clientKeyFile := ca.issue("client", clientTemplate())
+	tlsConfig, err := newListenerTLSConfig(config.ListenerTLSConfig{
+		CertFile:     certFile,
+		KeyFile:      keyFile,
+		ClientCAFile: ca.file,
+	})
+	require.NoError(t, err)
+
+	server := &http.Server{
+		TLSConfig: tlsConfig,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key, err := certGroupKey(r.TLS, "subject_cn")
+			require.NoError(t, err)
+			io.WriteString(w, key)
+		}),
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go server.ServeTLS(listener, "", "")
+	defer server.Close()
+
+	clientCert, err := tls.LoadX509KeyPair(clientCertFile, clientKeyFile)
+	require.NoError(t, err)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	client := &http.Client{Transport: &http.Transport{
+		ForceAttemptHTTP2: true,
+		TLSClientConfig:   &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{clientCert}},
+	}}
+	resp, err := client.Get("https://" + listener.Addr().String())
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, 2, resp.ProtoMajor)
+	require.Equal(t, "dashboards", string(body))
+
+	// Without a client certificate the handshake fails
+	client = &http.Client{Transport: &http.Transport{
+		ForceAttemptHTTP2: true,
+		TLSClientConfig:   &tls.Config{RootCAs: roots},
+	}}
+	_, err = client.Get("https://" + listener.Addr().String())
+	require.Error(t, err)
+}
+
+func TestBackendTLSVerifiesNodeHost(t *testing.T) {
+	ca := newTestCA(t)
+	otherCert, otherKey := ca.issue("other", &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "other.example.org"},
+		DNSNames:    []string{"other.example.org"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	nodeCert, nodeKey := ca.issue("node", serverTemplate())
+
+	serve := func(certFile, keyFile string) string {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		require.NoError(t, err)
+		listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+		require.NoError(t, err)
+		server := &http.Server{Handler: http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})}
+		go server.Serve(listener)
+		t.Cleanup(func() { server.Close() })
+		return listener.Addr().String()
+	}
+	// Through the same setup as the proxy: replica_scheme https and the node
+	// address as it is configured
+	get := func(tlsCfg *config.BackendTLSConfig, address string) error {
+		replica, err := NewReplica(config.ReplicaConfig{Name: "r1", TLS: tlsCfg},
+			[]config.NodeConfig{{Replica: "r1", Address: address}}, "https", 1, 1)
+		require.NoError(t, err)
+		require.NoError(t, setupNodeTransports([]*Replica{replica}, config.TransportConfig{}, &http.Transport{}))
+		node := replica.Nodes[0]
+		transport := node.transport.(*http.Transport)
+		defer transport.CloseIdleConnections()
+		resp, err := (&http.Client{Transport: transport}).Get(node.Address)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	// Signed by ca_file, but for another host than the node's IP address
+	other := serve(otherCert, otherKey)
+	require.Error(t, get(&config.BackendTLSConfig{CAFile: ca.file}, other))
+	require.NoError(t, get(&config.BackendTLSConfig{CAFile: ca.file, ServerName: "other.example.org"}, other))
+
+	node := serve(nodeCert, nodeKey)
+	require.NoError(t, get(&config.BackendTLSConfig{CAFile: ca.file}, node), "IP SAN of the node")
+	require.Error(t, get(&config.BackendTLSConfig{CAFile: ca.file, ServerName: "other.example.org"}, node))
+}
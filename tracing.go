@@ -0,0 +1,189 @@
+// --- tracing.go --- (OpenTelemetry spans and trace context forwarding)
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"clickhouse-test/config"
+)
+
+// tracer goes through the global provider, so spans are no-ops until
+// setupTracing installs a real one.
+var tracer = otel.Tracer("clickhouse-proxy")
+
+// setupTracing installs the global tracer provider and the W3C trace context
+// propagator. The returned function flushes and stops the exporter.
+//
+// Both exporters write the stdouttrace JSON encoding, which is meant for
+// local testing and reading by eye. It is not OTLP: a collector cannot
+// ingest the "json_file" output.
+func setupTracing(cfg config.TracingConfig) (func(context.Context) error, error) {
+	var out io.Writer
+	var file *os.File
+	switch cfg.Exporter {
+	case "", "stdout":
+		out = os.Stdout
+	case "json_file":
+		if cfg.File == "" {
+			return nil, fmt.Errorf("tracing exporter \"json_file\" needs tracing.file")
+		}
+		f, err := os.OpenFile(cfg.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open trace file: %w", err)
+		}
+		out, file = f, f
+	default:
+		return nil, fmt.Errorf("unknown tracing exporter %q", cfg.Exporter)
+	}
+	exporter, err := stdouttrace.New(stdouttrace.WithWriter(out))
+	if err != nil {
+		return nil, err
+	}
+
+	serviceName := cfg.ServiceName
+	if serviceName == "" {
+		serviceName = "clickhouse-proxy"
+	}
+	ratio := cfg.SampleRatio
+	if ratio <= 0 {
+		ratio = 1
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(serviceName))),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	return func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		if file != nil {
+			file.Close()
+		}
+		return err
+	}, nil
+}
+
+// startRequestSpan continues the caller's trace (traceparent header) if there
+// is one and starts the span covering the whole proxied request.
+func startRequestSpan(r *http.Request) (context.Context, trace.Span) {
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	return tracer.Start(ctx, "proxy.request",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			semconv.HTTPMethod(r.Method),
+			attribute.String("net.sock.peer.addr", r.RemoteAddr),
+		))
+}
+
+// endRequestSpan adds what the access log knows about the request and ends
+// the span.
+func endRequestSpan(span trace.Span, access *accessLog) {
+	statusCode := access.statusCode()
+	span.SetAttributes(
+		attribute.String("proxy.group", access.groupKey),
+		attribute.String("proxy.kind", access.kind.String()),
+		semconv.HTTPStatusCode(statusCode),
+	)
+	if access.rejected != "" {
+		span.SetAttributes(attribute.String("proxy.rejected", access.rejected))
+	}
+	if access.shared != "" {
+		span.SetAttributes(attribute.String("proxy.shared", access.shared))
+	}
+	if statusCode >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, http.StatusText(statusCode))
+	}
+	span.End()
+}
+
+// endSpan records err, if any, and ends the span.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// tracingTransport wraps each upstream call in a client span and sends the
+// trace context to ClickHouse, which continues it in its own
+// system.opentelemetry_span_log. The span ends when the body is closed, so it
+// covers streaming the response too.
+type tracingTransport struct {
+	next http.RoundTripper
+}
+
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	attrs := []attribute.KeyValue{
+		attribute.String("proxy.group", GetGroupKey(req.Context())),
+		semconv.HTTPMethod(req.Method),
+	}
+	if node := GetNode(req.Context()); node != nil {
+		attrs = append(attrs, attribute.String("proxy.node", node.Address))
+		if node.Replica != nil {
+			attrs = append(attrs, attribute.String("proxy.replica", node.Replica.Name))
+		}
+	}
+	ctx, span := tracer.Start(req.Context(), "clickhouse.http",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrs...))
+
+	// RoundTrippers must not modify the request, so the header goes on a copy
+	req = req.Clone(ctx)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		endSpan(span, err)
+		return nil, err
+	}
+	span.SetAttributes(semconv.HTTPStatusCode(resp.StatusCode))
+	if resp.StatusCode >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, http.StatusText(resp.StatusCode))
+	}
+	if code := resp.Header.Get("X-ClickHouse-Exception-Code"); code != "" {
+		span.SetAttributes(attribute.String("clickhouse.exception_code", code))
+	}
+	if queryID := resp.Header.Get("X-ClickHouse-Query-Id"); queryID != "" {
+		span.SetAttributes(attribute.String("clickhouse.query_id", queryID))
+	}
+	resp.Body = &tracedBody{ReadCloser: resp.Body, span: span}
+	return resp, nil
+}
+
+// tracedBody ends the upstream span once the response has been read.
+type tracedBody struct {
+	io.ReadCloser
+	span trace.Span
+	err  error
+}
+
+func (b *tracedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		b.err = err
+	}
+	return n, err
+}
+
+func (b *tracedBody) Close() error {
+	err := b.ReadCloser.Close()
+	endSpan(b.span, b.err)
+	return err
+}
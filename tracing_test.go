@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"clickhouse-test/config"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracingContinuesClientTrace(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	prevProvider, prevPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	defer func() {
+		otel.SetTracerProvider(prevProvider)
+		otel.SetTextMapPropagator(prevPropagator)
+	}()
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	var upstreamTraceparent string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamTraceparent = r.Header.Get("traceparent")
+		w.Write([]byte("1\n"))
+	}))
+	defer backend.Close()
+
+	cfg := &config.Config{
+		HeaderName:    "X-User-Id",
+		MaxConcurrent: 2,
+		MaxQueue:      1,
+		QueueTimeout:  time.Second,
+		Replicas:      []config.ReplicaConfig{{Name: "r1"}},
+		Nodes:         []config.NodeConfig{{Replica: "r1", Address: strings.TrimPrefix(backend.URL, "http://")}},
+		Tracing:       config.TracingConfig{Enabled: true},
+	}
+	p, err := NewSimpleProxy(cfg)
+	require.NoError(t, err)
+
+	r := httptest.NewRequest(http.MethodGet, "/?query=SELECT+1", nil)
+	r.Header.Set("X-User-Id", "123")
+	r.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	rw := httptest.NewRecorder()
+	p.ServeHTTP(rw, r)
+	require.Equal(t, http.StatusOK, rw.Code)
+
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	for _, span := range recorder.Ended() {
+		require.Equal(t, traceID, span.SpanContext().TraceID().String())
+		spans[span.Name()] = span
+	}
+	require.Contains(t, spans, "proxy.request")
+	require.Contains(t, spans, "GroupLimiter.Acquire")
+	require.Contains(t, spans, "Replica.Wait")
+	require.Contains(t, spans, "clickhouse.http")
+
+	// ClickHouse continues the trace under the upstream span
+	upstream := spans["clickhouse.http"]
+	require.Equal(t, "00-"+traceID+"-"+upstream.SpanContext().SpanID().String()+"-01", upstreamTraceparent)
+	require.Equal(t, spans["proxy.request"].SpanContext().SpanID(), upstream.Parent().SpanID())
+	attrs := make(map[string]string)
+	for _, kv := range upstream.Attributes() {
+		attrs[string(kv.Key)] = kv.Value.Emit()
+	}
+	require.Equal(t, "123", attrs["proxy.group"])
+	require.Equal(t, "r1", attrs["proxy.replica"])
+}
+
+func TestSetupTracingJSONFile(t *testing.T) {
+	prevProvider, prevPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	defer func() {
+		otel.SetTracerProvider(prevProvider)
+		otel.SetTextMapPropagator(prevPropagator)
+	}()
+
+	_, err := setupTracing(config.TracingConfig{Enabled: true, Exporter: "file", File: "traces.json"})
+	require.Error(t, err, "the old name suggested OTLP")
+
+	path := filepath.Join(t.TempDir(), "traces.json")
+	shutdown, err := setupTracing(config.TracingConfig{Enabled: true, Exporter: "json_file", File: path})
+	require.NoError(t, err)
+	_, span := otel.Tracer("test").Start(context.Background(), "test.span")
+	span.End()
+	require.NoError(t, shutdown(context.Background()))
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Contains(t, string(data), `"Name":"test.span"`)
+}
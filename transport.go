@@ -0,0 +1,84 @@
+// --- transport.go --- (Connections to ClickHouse nodes)
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"clickhouse-test/config"
+)
+
+// newTransport builds the HTTP transport used to reach ClickHouse nodes.
+func newTransport(cfg config.TransportConfig) *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   cfg.DialTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	return &http.Transport{
+		DialContext:            dialer.DialContext,
+		TLSHandshakeTimeout:    cfg.TLSHandshakeTimeout,
+		ResponseHeaderTimeout:  cfg.ResponseHeaderTimeout,
+		IdleConnTimeout:        cfg.IdleConnTimeout,
+		MaxIdleConnsPerHost:    cfg.MaxIdleConnsPerHost,
+		MaxConnsPerHost:        cfg.MaxConnsPerHost,
+		MaxResponseHeaderBytes: cfg.MaxResponseHeaderSize,
+	}
+}
+
+// nodeTransport sends each request through the transport of the node it is
+// directed to, so nodes can use their own TLS and connection settings.
+type nodeTransport struct {
+	shared *http.Transport
+}
+
+func (t *nodeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if node := GetNode(req.Context()); node != nil && node.transport != nil {
+		return node.transport.RoundTrip(req)
+	}
+	return t.shared.RoundTrip(req)
+}
+
+// transportKey identifies the settings a node transport is built from.
+type transportKey struct {
+	tls       *config.BackendTLSConfig
+	host      string // Name the node certificate is verified against, with tls only
+	transport *config.TransportConfig
+}
+
+// setupNodeTransports gives nodes with TLS settings, or in a replica with its
+// own transport settings, their own transport. Nodes with the same settings
+// share a transport; with TLS only nodes of the same host do, as the node
+// certificate is verified against it.
+func setupNodeTransports(replicas []*Replica, base config.TransportConfig, shared *http.Transport) error {
+	transports := make(map[transportKey]*http.Transport)
+	for _, replica := range replicas {
+		for _, node := range replica.Nodes {
+			key := transportKey{tls: node.TLS, transport: replica.Transport}
+			if key == (transportKey{}) {
+				continue
+			}
+			if node.TLS != nil {
+				key.host = node.URL.Hostname() // Address is the full URL
+			}
+			transport, ok := transports[key]
+			if !ok {
+				transport = shared.Clone()
+				if replica.Transport != nil {
+					transport = newTransport(base.Merge(replica.Transport))
+				}
+				if node.TLS != nil {
+					tlsConfig, err := newBackendTLSConfig(node.TLS, key.host)
+					if err != nil {
+						return fmt.Errorf("node %s: %w", node.Address, err)
+					}
+					transport.TLSClientConfig = tlsConfig
+				}
+				transports[key] = transport
+			}
+			node.transport = transport
+		}
+	}
+	return nil
+}